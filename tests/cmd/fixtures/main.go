@@ -0,0 +1,229 @@
+// Command fixtures manages the fixtures of the integration tests.
+//
+// Usage:
+//
+//	fixtures lint [-fixtures metadata.yaml]
+//	fixtures checksums [-root fixtures] [-verify]
+//	fixtures generate -out DIR [-train N] [-test M] [-size 1MB] [-steps K] ...
+//
+// lint checks the chaincode and storage sections of metadata.yaml agree, and
+// that every storage uuid has a file under pathDataFolder. It reports all the
+// violations with their YAML location, and exits with status 1 if any.
+//
+// checksums rebuilds the checksum manifests of the fastest fixtures from the
+// data, pred and untargetedTest files. With -verify, it reports the files the
+// manifests are stale for instead, and exits with status 1 if any.
+//
+// generate writes a synthetic dataset of N train and M test files of a given
+// size to DIR, with its metadata.yaml and checksum manifest. With -steps, it
+// writes K datasets to DIR/step<i>-<bytes>B, each -factor times larger than
+// the previous one, to find the size Storage or the worker breaks at.
+package main
+
+import (
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/MorpheoOrg/morpheo-go-packages/common"
+
+	"github.com/MorpheoOrg/morpheo-devenv/tests/fixtures/checksums"
+	"github.com/MorpheoOrg/morpheo-devenv/tests/fixtures/synth"
+	"github.com/MorpheoOrg/morpheo-devenv/tests/lint"
+)
+
+// checksummedDirs hold the fixture files of the fastest binaries, relative to
+// the fixtures root
+var checksummedDirs = []string{
+	"data_fastest",
+	"algo/fastest/fixtures/pred",
+	"problem/fastest/fixtures/untargetedTest",
+}
+
+// checksumManifests are shipped in /fixtures by the fastest and pytest images
+var checksumManifests = []string{
+	"algo/fastest/fixtures/" + checksums.FileName,
+	"algo/pytest/" + checksums.FileName,
+	"problem/fastest/fixtures/" + checksums.FileName,
+}
+
+// commands maps the subcommands to their function, called with the remaining
+// arguments
+var commands = map[string]func(args []string) error{
+	"lint":      lintCommand,
+	"checksums": checksumsCommand,
+	"generate":  generateCommand,
+}
+
+// fastestProblem and fastestAlgo are the storage uuids of the fastest problem
+// and algo, the synthetic datasets are registered for by default
+const (
+	fastestProblem = "c89d0eb7-2336-48d7-873b-27073ccd363f"
+	fastestAlgo    = "8f5c97ff-ee61-4cf1-a0ac-6852bac08408"
+)
+
+func main() {
+	log.SetFlags(0)
+	flag.Usage = usage
+	flag.Parse()
+	if flag.NArg() < 1 {
+		usage()
+		os.Exit(2)
+	}
+	command, ok := commands[flag.Arg(0)]
+	if !ok {
+		fmt.Fprintf(os.Stderr, "Unknown command %q\n", flag.Arg(0))
+		usage()
+		os.Exit(2)
+	}
+	if err := command(flag.Args()[1:]); err != nil {
+		log.Fatalf("[fixtures] %s", err)
+	}
+}
+
+func usage() {
+	fmt.Fprintf(os.Stderr, "Usage: %s <command> [flags]\n\nCommands:\n", os.Args[0])
+	fmt.Fprintln(os.Stderr, "  lint       Check the consistency of metadata.yaml and of the fixture files")
+	fmt.Fprintln(os.Stderr, "  checksums  Rebuild, or -verify, the checksum manifests of the fastest fixtures")
+	fmt.Fprintln(os.Stderr, "  generate   Write synthetic datasets of a given size, to stress Storage and the worker")
+}
+
+func lintCommand(args []string) error {
+	fs := flag.NewFlagSet("lint", flag.ExitOnError)
+	path := fs.String("fixtures", "fixtures/metadata.yaml", "Path of the fixtures metadata.yaml")
+	fs.Parse(args)
+
+	fixtures, err := common.ParseDataFromFile(*path)
+	if err != nil {
+		return fmt.Errorf("Error parsing %s: %s", *path, err)
+	}
+	violations := lint.Fixtures(fixtures)
+	for _, violation := range violations {
+		fmt.Printf("%s: %s\n", *path, violation)
+	}
+	if len(violations) > 0 {
+		return fmt.Errorf("%d violation(s) in %s", len(violations), *path)
+	}
+	log.Printf("[fixtures] %s is consistent", *path)
+	return nil
+}
+
+func checksumsCommand(args []string) error {
+	fs := flag.NewFlagSet("checksums", flag.ExitOnError)
+	root := fs.String("root", "fixtures", "Root of the fixtures")
+	verify := fs.Bool("verify", false, "Report the stale files instead of rebuilding the manifests")
+	fs.Parse(args)
+
+	if *verify {
+		stale := 0
+		for _, manifestPath := range checksumManifests {
+			path := filepath.Join(*root, manifestPath)
+			m, err := checksums.Read(path)
+			if err != nil {
+				return err
+			}
+			files, err := checksums.Verify(m, *root, checksummedDirs)
+			if err != nil {
+				return err
+			}
+			for _, file := range files {
+				fmt.Printf("%s: %s\n", path, file)
+			}
+			stale += len(files)
+		}
+		if stale > 0 {
+			return fmt.Errorf("%d stale checksum(s), rebuild the manifests with the checksums command", stale)
+		}
+		log.Printf("[fixtures] Checksum manifests are up to date")
+		return nil
+	}
+
+	m, err := checksums.Generate(*root, checksummedDirs)
+	if err != nil {
+		return err
+	}
+	for _, manifestPath := range checksumManifests {
+		path := filepath.Join(*root, manifestPath)
+		if err := m.WriteFile(path); err != nil {
+			return err
+		}
+		log.Printf("[fixtures] Wrote %d checksums to %s", len(m.Entries), path)
+	}
+	return nil
+}
+
+func generateCommand(args []string) error {
+	fs := flag.NewFlagSet("generate", flag.ExitOnError)
+	out := fs.String("out", "", "Directory of the dataset, which must not exist or be empty")
+	train := fs.Int("train", 2, "Number of train data files")
+	test := fs.Int("test", 2, "Number of test data files")
+	size := fs.String("size", "1MB", "Size of each data file: B, KB, MB or GB")
+	format := fs.String("format", "hdf5", "Format of the data files: "+strings.Join(synth.Formats, ", "))
+	values := fs.Int("values", 1000, "Number of targets of each hdf5 file, the -pred-size of the fastest algo in hash mode")
+	sizeTrainDataset := fs.Int("size-train-dataset", 0, "Number of train data of each learnuplet (default: all the train data)")
+	seed := fs.Int64("seed", 1, "Seed of the UUIDs and contents, the same seed giving the same dataset")
+	problem := fs.String("problem", fastestProblem, "Storage uuid of the problem the data is registered for")
+	algo := fs.String("algo", fastestAlgo, "Storage uuid of the algo registered for the problem")
+	blobs := fs.String("blobs", "../data/fixtures", "pathDataFolder to copy the problem and algo files from")
+	steps := fs.Int("steps", 1, "Number of datasets, each -factor times larger than the previous one")
+	factor := fs.Float64("factor", 2, "Size growth between two steps")
+	fs.Parse(args)
+
+	if *out == "" {
+		return fmt.Errorf("missing -out directory")
+	}
+	if *steps < 1 || *factor <= 1 && *steps > 1 {
+		return fmt.Errorf("invalid %d steps of factor %g, should be at least 1 step, growing by a factor above 1", *steps, *factor)
+	}
+	bytes, err := synth.ParseSize(*size)
+	if err != nil {
+		return err
+	}
+	opts := synth.Options{
+		Train:            *train,
+		Test:             *test,
+		Format:           *format,
+		Values:           *values,
+		SizeTrainDataset: *sizeTrainDataset,
+		Problem:          *problem,
+		Algo:             *algo,
+		Blobs:            *blobs,
+	}
+	if opts.SizeTrainDataset == 0 {
+		opts.SizeTrainDataset = opts.Train
+	}
+
+	for step := 0; step < *steps; step++ {
+		opts.Size = bytes
+		// Each step has its own UUIDs, so that they can be posted to the
+		// same Storage
+		opts.Seed = *seed + int64(step)
+		// Named by their exact size, as close sizes format alike
+		dir := *out
+		if *steps > 1 {
+			dir = filepath.Join(*out, fmt.Sprintf("step%02d-%dB", step+1, bytes))
+		}
+		d, err := synth.Generate(dir, opts)
+		if err != nil {
+			return err
+		}
+		path := filepath.Join(d.Dir, "metadata.yaml")
+		fixtures, err := common.ParseDataFromFile(path)
+		if err != nil {
+			return fmt.Errorf("Error parsing %s: %s", path, err)
+		}
+		violations := lint.Fixtures(fixtures)
+		for _, violation := range violations {
+			fmt.Printf("%s: %s\n", path, violation)
+		}
+		if len(violations) > 0 {
+			return fmt.Errorf("%d violation(s) in %s", len(violations), path)
+		}
+		log.Printf("[fixtures] Wrote %d train and %d test data of %s to %s", len(d.Train), len(d.Test), synth.FormatSize(d.FileSize), d.Dir)
+		bytes = int64(float64(bytes) * *factor)
+	}
+	return nil
+}
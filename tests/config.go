@@ -0,0 +1,350 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"gopkg.in/yaml.v2"
+)
+
+// Config holds the endpoints and paths used by the integration tests. Each
+// setting can be set, by increasing priority, in a YAML file (-config), in an
+// environment variable, or with a flag.
+type Config struct {
+	Peer    string `yaml:"peer"`
+	Storage string `yaml:"storage"`
+	Compute string `yaml:"compute"`
+
+	FixturesYAML string `yaml:"fixtures"`
+	Dataset      string `yaml:"dataset"`
+	Isolate      bool   `yaml:"isolate"`
+	Replace      bool   `yaml:"replace"`
+	Parallel     int    `yaml:"parallel"`
+
+	ModelLineage     bool      `yaml:"modelLineage"`
+	ScriptedScores   []float64 `yaml:"scriptedScores"`
+	FailureScenarios bool      `yaml:"failureScenarios"`
+	Scenarios        string    `yaml:"scenarios"`
+
+	PeerConfig    string `yaml:"peerConfig"`
+	PeerOrg       string `yaml:"peerOrg"`
+	PeerChannel   string `yaml:"peerChannel"`
+	PeerChaincode string `yaml:"peerChaincode"`
+	// PeerAttempts and PeerBackoff set the retries of the peer calls failing
+	// with transient errors
+	PeerAttempts int           `yaml:"peerAttempts"`
+	PeerBackoff  time.Duration `yaml:"peerBackoff"`
+
+	StorageHost     string `yaml:"storageHost"`
+	StoragePort     int    `yaml:"storagePort"`
+	StorageUser     string `yaml:"storageUser"`
+	StoragePassword string `yaml:"storagePassword"`
+
+	ComputeHost     string `yaml:"computeHost"`
+	ComputePort     int    `yaml:"computePort"`
+	ComputeUser     string `yaml:"computeUser"`
+	ComputePassword string `yaml:"computePassword"`
+
+	WaitTimeout time.Duration `yaml:"waitTimeout"`
+	Timeout     time.Duration `yaml:"timeout"`
+
+	JUnitReport string `yaml:"junitReport"`
+	JSONReport  string `yaml:"jsonReport"`
+}
+
+// defaultConfig targets the devenv started by docker-compose
+func defaultConfig() *Config {
+	return &Config{
+		Peer:    "fabric",
+		Storage: "docker",
+		Compute: "docker",
+
+		FixturesYAML: "fixtures/metadata.yaml",
+		Parallel:     1,
+
+		PeerConfig:    "/secrets/config.yaml",
+		PeerOrg:       "Aphp",
+		PeerChannel:   "mychannel",
+		PeerChaincode: "mycc",
+		PeerAttempts:  5,
+		PeerBackoff:   time.Second,
+
+		StorageHost:     "storage",
+		StoragePort:     80,
+		StorageUser:     "u",
+		StoragePassword: "p",
+
+		ComputeHost: "compute",
+		ComputePort: 80,
+
+		WaitTimeout: 10 * time.Minute,
+		Timeout:     30 * time.Minute,
+
+		JUnitReport: "integration-report.xml",
+		JSONReport:  "integration-report.json",
+	}
+}
+
+// setting binds a Config field to its flag and environment variable
+type setting struct {
+	flag  string
+	env   string
+	usage string
+	value func(c *Config) flag.Value
+}
+
+var settings = []setting{
+	{"peer", "MORPHEO_TESTS_PEER", "Peer to run the tests against: fabric/fake", func(c *Config) flag.Value { return (*stringValue)(&c.Peer) }},
+	{"storage", "MORPHEO_TESTS_STORAGE", "Storage to run the tests against: docker/local", func(c *Config) flag.Value { return (*stringValue)(&c.Storage) }},
+	{"compute", "MORPHEO_TESTS_COMPUTE", "Compute worker to run the tests against: docker/local", func(c *Config) flag.Value { return (*stringValue)(&c.Compute) }},
+	{"fixtures", "MORPHEO_TESTS_FIXTURES", "Path of the fixtures metadata.yaml", func(c *Config) flag.Value { return (*stringValue)(&c.FixturesYAML) }},
+	{"dataset", "MORPHEO_TESTS_DATASET", "Directory of a synthetic dataset written by `fixtures generate`, learnt on instead of the fixtures (requires -compute local)", func(c *Config) flag.Value { return (*stringValue)(&c.Dataset) }},
+	{"isolate", "MORPHEO_TESTS_ISOLATE", "Give fresh UUIDs to the fixtures, to isolate the run from previous ones", func(c *Config) flag.Value { return (*boolValue)(&c.Isolate) }},
+	{"replace", "MORPHEO_TESTS_REPLACE", "Delete and post again the Storage resources differing from their fixture, instead of failing", func(c *Config) flag.Value { return (*boolValue)(&c.Replace) }},
+	{"parallel", "MORPHEO_TESTS_PARALLEL", "Number of fixtures posted or registered at a time", func(c *Config) flag.Value { return (*intValue)(&c.Parallel) }},
+	{"model-lineage", "MORPHEO_TESTS_MODEL_LINEAGE", "Check the models trained along the learnuplet chain of the fixture algo extend each other", func(c *Config) flag.Value { return (*boolValue)(&c.ModelLineage) }},
+	{"scripted-scores", "MORPHEO_TESTS_SCRIPTED_SCORES", "Comma-separated scores of fastest algos to register, checking the ledger ranks them by score (requires -compute local)", func(c *Config) flag.Value { return (*floatsValue)(&c.ScriptedScores) }},
+	{"failure-scenarios", "MORPHEO_TESTS_FAILURE_SCENARIOS", "Check failed learnuplets: a broken algo, and failures reported directly to the chaincode (requires -compute local)", func(c *Config) flag.Value { return (*boolValue)(&c.FailureScenarios) }},
+	{"scenarios", "MORPHEO_TESTS_SCENARIOS", "Directory of YAML scenario files to run after the built-in tests", func(c *Config) flag.Value { return (*stringValue)(&c.Scenarios) }},
+	{"peer-config", "MORPHEO_TESTS_PEER_CONFIG", "Path of the peer SDK config", func(c *Config) flag.Value { return (*stringValue)(&c.PeerConfig) }},
+	{"peer-org", "MORPHEO_TESTS_PEER_ORG", "Organization of the peer user", func(c *Config) flag.Value { return (*stringValue)(&c.PeerOrg) }},
+	{"peer-channel", "MORPHEO_TESTS_PEER_CHANNEL", "Channel of the orchestrator chaincode", func(c *Config) flag.Value { return (*stringValue)(&c.PeerChannel) }},
+	{"peer-chaincode", "MORPHEO_TESTS_PEER_CHAINCODE", "Name of the orchestrator chaincode", func(c *Config) flag.Value { return (*stringValue)(&c.PeerChaincode) }},
+	{"peer-attempts", "MORPHEO_TESTS_PEER_ATTEMPTS", "Maximum attempts of a peer call failing with transient errors, such as timeouts or MVCC read conflicts", func(c *Config) flag.Value { return (*intValue)(&c.PeerAttempts) }},
+	{"peer-backoff", "MORPHEO_TESTS_PEER_BACKOFF", "Initial wait between two attempts of a peer call, doubled at each attempt", func(c *Config) flag.Value { return (*durationValue)(&c.PeerBackoff) }},
+	{"storage-host", "MORPHEO_TESTS_STORAGE_HOST", "Storage hostname", func(c *Config) flag.Value { return (*stringValue)(&c.StorageHost) }},
+	{"storage-port", "MORPHEO_TESTS_STORAGE_PORT", "Storage port", func(c *Config) flag.Value { return (*intValue)(&c.StoragePort) }},
+	{"storage-user", "STORAGE_AUTH_USER", "Storage basic auth user", func(c *Config) flag.Value { return (*stringValue)(&c.StorageUser) }},
+	{"storage-password", "STORAGE_AUTH_PASSWORD", "Storage basic auth password", func(c *Config) flag.Value { return (*stringValue)(&c.StoragePassword) }},
+	{"compute-host", "MORPHEO_TESTS_COMPUTE_HOST", "Compute hostname", func(c *Config) flag.Value { return (*stringValue)(&c.ComputeHost) }},
+	{"compute-port", "MORPHEO_TESTS_COMPUTE_PORT", "Compute port", func(c *Config) flag.Value { return (*intValue)(&c.ComputePort) }},
+	{"compute-user", "MORPHEO_TESTS_COMPUTE_AUTH_USER", "Compute basic auth user", func(c *Config) flag.Value { return (*stringValue)(&c.ComputeUser) }},
+	{"compute-password", "MORPHEO_TESTS_COMPUTE_AUTH_PASSWORD", "Compute basic auth password", func(c *Config) flag.Value { return (*stringValue)(&c.ComputePassword) }},
+	{"wait-timeout", "MORPHEO_TESTS_WAIT_TIMEOUT", "Maximum duration of each wait for a chaincode status", func(c *Config) flag.Value { return (*durationValue)(&c.WaitTimeout) }},
+	{"timeout", "MORPHEO_TESTS_TIMEOUT", "Maximum duration of the whole tests", func(c *Config) flag.Value { return (*durationValue)(&c.Timeout) }},
+	{"junit-report", "MORPHEO_TESTS_JUNIT_REPORT", "Path of the JUnit XML report", func(c *Config) flag.Value { return (*stringValue)(&c.JUnitReport) }},
+	{"json-report", "MORPHEO_TESTS_JSON_REPORT", "Path of the JSON summary", func(c *Config) flag.Value { return (*stringValue)(&c.JSONReport) }},
+}
+
+// loadConfig builds the Config from, by increasing priority, the defaults,
+// the YAML file given by -config (or $MORPHEO_TESTS_CONFIG), the environment
+// and the flags, and validates it
+func loadConfig(fs *flag.FlagSet, args []string) (*Config, error) {
+	// Parse the flags a first time, to get the config file and the flags
+	// actually set on the command line
+	parsed := defaultConfig()
+	configPath := fs.String("config", os.Getenv("MORPHEO_TESTS_CONFIG"), "Path of an optional YAML config file ($MORPHEO_TESTS_CONFIG)")
+	for _, s := range settings {
+		fs.Var(s.value(parsed), s.flag, fmt.Sprintf("%s ($%s)", s.usage, s.env))
+	}
+	if err := fs.Parse(args); err != nil {
+		return nil, err
+	}
+	setFlags := make(map[string]string)
+	fs.Visit(func(f *flag.Flag) {
+		setFlags[f.Name] = f.Value.String()
+	})
+
+	c := defaultConfig()
+	if *configPath != "" {
+		data, err := ioutil.ReadFile(*configPath)
+		if err != nil {
+			return nil, fmt.Errorf("Error reading config file: %s", err)
+		}
+		if err := yaml.UnmarshalStrict(data, c); err != nil {
+			return nil, fmt.Errorf("Error parsing config file %s: %s", *configPath, err)
+		}
+	}
+	for _, s := range settings {
+		if value, ok := os.LookupEnv(s.env); ok {
+			if err := s.value(c).Set(value); err != nil {
+				return nil, fmt.Errorf("Invalid $%s: %s", s.env, err)
+			}
+		}
+	}
+	for _, s := range settings {
+		if value, ok := setFlags[s.flag]; ok {
+			s.value(c).Set(value)
+		}
+	}
+
+	return c, c.validate()
+}
+
+// validate checks the settings are consistent, and that the files they
+// reference exist
+func (c *Config) validate() error {
+	if err := oneOf("peer", c.Peer, "fabric", "fake"); err != nil {
+		return err
+	}
+	if err := oneOf("storage", c.Storage, "docker", "local"); err != nil {
+		return err
+	}
+	if err := oneOf("compute", c.Compute, "docker", "local"); err != nil {
+		return err
+	}
+	if _, err := os.Stat(c.FixturesYAML); err != nil {
+		return fmt.Errorf("invalid fixtures: %s", err)
+	}
+	if c.PeerAttempts < 1 {
+		return fmt.Errorf("invalid peer attempts %d, should be at least 1", c.PeerAttempts)
+	}
+	if c.Parallel < 1 {
+		return fmt.Errorf("invalid parallel %d, should be at least 1", c.Parallel)
+	}
+	if c.StorageUser == "" || c.StoragePassword == "" {
+		return fmt.Errorf("storage user and password must be set")
+	}
+	if c.Storage == "docker" {
+		if c.StorageHost == "" {
+			return fmt.Errorf("storage host must be set")
+		}
+		if c.StoragePort < 1 || c.StoragePort > 65535 {
+			return fmt.Errorf("invalid storage port %d", c.StoragePort)
+		}
+	}
+	if c.Compute == "docker" {
+		if c.ComputeHost == "" {
+			return fmt.Errorf("compute host must be set")
+		}
+		if c.ComputePort < 1 || c.ComputePort > 65535 {
+			return fmt.Errorf("invalid compute port %d", c.ComputePort)
+		}
+	}
+	if len(c.ScriptedScores) > 0 {
+		if c.Compute != "local" {
+			return fmt.Errorf("scripted scores require the local compute worker")
+		}
+		seen := make(map[float64]bool)
+		for _, score := range c.ScriptedScores {
+			if seen[score] {
+				return fmt.Errorf("duplicate scripted score %g, scores must be distinct to be ranked", score)
+			}
+			seen[score] = true
+		}
+	}
+	if c.Dataset != "" {
+		if c.Compute != "local" {
+			return fmt.Errorf("datasets require the local compute worker")
+		}
+		if len(c.ScriptedScores) > 0 || c.FailureScenarios {
+			return fmt.Errorf("scripted scores and failure scenarios run on the fixtures, not on datasets")
+		}
+		if _, err := os.Stat(filepath.Join(c.Dataset, "metadata.yaml")); err != nil {
+			return fmt.Errorf("invalid dataset: %s", err)
+		}
+	}
+	if c.FailureScenarios && c.Compute != "local" {
+		return fmt.Errorf("failure scenarios require the local compute worker")
+	}
+	if c.Scenarios != "" {
+		if info, err := os.Stat(c.Scenarios); err != nil || !info.IsDir() {
+			return fmt.Errorf("invalid scenarios: %s is not a directory", c.Scenarios)
+		}
+	}
+	if c.WaitTimeout <= 0 || c.Timeout <= 0 {
+		return fmt.Errorf("timeouts must be positive")
+	}
+	if c.Peer == "fabric" {
+		return c.validatePeerConfig()
+	}
+	return nil
+}
+
+// validatePeerConfig checks the org and the channel are defined in the peer
+// SDK config
+func (c *Config) validatePeerConfig() error {
+	data, err := ioutil.ReadFile(c.PeerConfig)
+	if err != nil {
+		return fmt.Errorf("invalid peer config: %s", err)
+	}
+	var peerConfig struct {
+		Channels      map[string]interface{} `yaml:"channels"`
+		Organizations map[string]interface{} `yaml:"organizations"`
+	}
+	if err := yaml.Unmarshal(data, &peerConfig); err != nil {
+		return fmt.Errorf("Error parsing peer config %s: %s", c.PeerConfig, err)
+	}
+	if _, ok := peerConfig.Organizations[c.PeerOrg]; !ok {
+		return fmt.Errorf("organization %s is not defined in %s", c.PeerOrg, c.PeerConfig)
+	}
+	if _, ok := peerConfig.Channels[c.PeerChannel]; !ok {
+		return fmt.Errorf("channel %s is not defined in %s", c.PeerChannel, c.PeerConfig)
+	}
+	if c.PeerChaincode == "" {
+		return fmt.Errorf("peer chaincode must be set")
+	}
+	return nil
+}
+
+func oneOf(name, value string, valid ...string) error {
+	for _, v := range valid {
+		if value == v {
+			return nil
+		}
+	}
+	return fmt.Errorf("invalid %s %q, should be one of %v", name, value, valid)
+}
+
+type stringValue string
+
+func (v *stringValue) Set(s string) error { *v = stringValue(s); return nil }
+func (v *stringValue) String() string     { return string(*v) }
+
+type boolValue bool
+
+func (v *boolValue) Set(s string) error {
+	b, err := strconv.ParseBool(s)
+	*v = boolValue(b)
+	return err
+}
+func (v *boolValue) String() string   { return strconv.FormatBool(bool(*v)) }
+func (v *boolValue) IsBoolFlag() bool { return true }
+
+type intValue int
+
+func (v *intValue) Set(s string) error {
+	i, err := strconv.Atoi(s)
+	*v = intValue(i)
+	return err
+}
+func (v *intValue) String() string { return strconv.Itoa(int(*v)) }
+
+type durationValue time.Duration
+
+func (v *durationValue) Set(s string) error {
+	d, err := time.ParseDuration(s)
+	*v = durationValue(d)
+	return err
+}
+func (v *durationValue) String() string { return time.Duration(*v).String() }
+
+type floatsValue []float64
+
+func (v *floatsValue) Set(s string) error {
+	*v = nil
+	for _, field := range strings.Split(s, ",") {
+		if field = strings.TrimSpace(field); field == "" {
+			continue
+		}
+		f, err := strconv.ParseFloat(field, 64)
+		if err != nil {
+			return err
+		}
+		*v = append(*v, f)
+	}
+	return nil
+}
+func (v *floatsValue) String() string {
+	fields := make([]string, len(*v))
+	for i, f := range *v {
+		fields[i] = strconv.FormatFloat(f, 'g', -1, 64)
+	}
+	return strings.Join(fields, ",")
+}
@@ -0,0 +1,34 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"log"
+	"path/filepath"
+
+	"github.com/MorpheoOrg/morpheo-devenv/tests/fixtures/hdf5"
+	"github.com/MorpheoOrg/morpheo-devenv/tests/localcompute"
+)
+
+// useDataset makes the local compute worker learn on a synthetic dataset
+// written by `fixtures generate`: the problem detargets its test files and
+// checks the predictions with its checksum manifest, and the algo predicts in
+// hash mode as many values as its pred files hold.
+func useDataset(w *localcompute.Worker, dir string) error {
+	w.ProblemFixtures = dir
+
+	preds, err := ioutil.ReadDir(filepath.Join(dir, "pred"))
+	if err != nil || len(preds) == 0 {
+		// Raw datasets can be posted and registered, but not scored
+		log.Printf("[compute] Dataset %s has no predictions, its learnuplets will fail", dir)
+		w.AlgoEnv = []string{"FASTEST_MODE=hash"}
+		return nil
+	}
+	values, err := hdf5.ReadFloat64s(filepath.Join(dir, "pred", preds[0].Name()), perfTarget)
+	if err != nil {
+		return fmt.Errorf("Error reading the predictions of dataset %s: %s", dir, err)
+	}
+	w.AlgoEnv = []string{"FASTEST_MODE=hash", fmt.Sprintf("FASTEST_PRED_SIZE=%d", len(values))}
+	log.Printf("[compute] Learning on dataset %s, predicting %d values per file", dir, len(values))
+	return nil
+}
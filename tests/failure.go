@@ -0,0 +1,181 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"strings"
+
+	"github.com/MorpheoOrg/morpheo-go-packages/common"
+
+	"github.com/MorpheoOrg/morpheo-devenv/tests/localcompute"
+	"github.com/MorpheoOrg/morpheo-devenv/tests/report"
+)
+
+// testsWorker is the worker ID of the learnuplets the tests take and report
+// themselves
+const testsWorker = "integration-tests"
+
+// brokenAlgoEnv makes the fastest algo exit with status 3 when training
+var brokenAlgoEnv = []string{"FASTEST_FAULT=exit", "FASTEST_FAULT_CODE=3"}
+
+// transition is a chaincode call, which must be rejected
+type transition struct {
+	name string
+	call func() error
+}
+
+// testLearnFailed checks failed learnuplets end to end: a broken algo makes
+// its learnuplets fail, and failures reported directly to the chaincode
+// break the learnuplet chain. It then checks the chaincode rejects the
+// transitions out of final statuses.
+func testLearnFailed(suite *report.Suite, fixtures *common.DataParser, registration *Registration) {
+	var brokenKey, failedKey, doneKey string
+
+	suite.Run("register algos", func() (err error) {
+		if _, brokenKey, err = registerFixtureAlgo(fixtures, registration, "broken", localcompute.Algo{Env: brokenAlgoEnv}); err != nil {
+			return err
+		}
+		// The tests take and report the learnuplets of these algos
+		if _, failedKey, err = registerFixtureAlgo(fixtures, registration, "reported failed", localcompute.Algo{Skip: true}); err != nil {
+			return err
+		}
+		_, doneKey, err = registerFixtureAlgo(fixtures, registration, "reported done", localcompute.Algo{Skip: true})
+		return err
+	})
+
+	// The worker reports the learnuplet of the broken algo as failed
+	suite.Run("wait broken algo failed", func() error {
+		learnuplets, err := getAlgoLearnuplets(brokenKey)
+		if err != nil {
+			return err
+		}
+		if len(learnuplets) == 0 {
+			return fmt.Errorf("no learnuplet for algo %s", brokenKey)
+		}
+		if err := waitUpletStatus("learnuplet", learnuplets[0].Key, "failed"); err != nil {
+			return err
+		}
+		log.Printf("[learn] SUCCESSFUL! Learnuplet %s of the broken algo is failed.", learnuplets[0].Key)
+		return checkChainFailed(brokenKey)
+	})
+
+	suite.Run("report learnuplet failed", func() error {
+		learnuplet, err := takeFirstLearnuplet(failedKey)
+		if err != nil {
+			return err
+		}
+		if err := testReportLearnFailed(learnuplet.Key); err != nil {
+			return err
+		}
+		return checkChainFailed(failedKey)
+	})
+
+	suite.Run("report learnuplet done", func() error {
+		learnuplet, err := takeFirstLearnuplet(doneKey)
+		if err != nil {
+			return err
+		}
+		if err := testReportLearnDone(learnuplet.Key); err != nil {
+			return err
+		}
+		learnuplets, err := getAlgoLearnuplets(doneKey)
+		if err != nil {
+			return err
+		}
+		if learnuplets[0].Status != "done" || learnuplets[0].Perf != 0.5 {
+			return fmt.Errorf("learnuplet %s has status %s and perf %g, expected done and 0.5", learnuplets[0].Key, learnuplets[0].Status, learnuplets[0].Perf)
+		}
+		if len(learnuplets) > 1 && learnuplets[1].Status != "todo" {
+			return fmt.Errorf("learnuplet %s following a done learnuplet has status %s, expected todo", learnuplets[1].Key, learnuplets[1].Status)
+		}
+		return nil
+	})
+
+	suite.Run("check rejected transitions", func() error {
+		failed, err := getAlgoLearnuplets(failedKey)
+		if err != nil {
+			return err
+		}
+		done, err := getAlgoLearnuplets(doneKey)
+		if err != nil {
+			return err
+		}
+		failedKey, doneKey := failed[0].Key, done[0].Key
+		transitions := []transition{
+			{"report done on a failed learnuplet", func() error { return testReportLearnDone(failedKey) }},
+			{"report failed on a failed learnuplet", func() error { return testReportLearnFailed(failedKey) }},
+			{"take a failed learnuplet", func() error { return takeLearnuplet(failedKey) }},
+			{"report done on a done learnuplet", func() error { return testReportLearnDone(doneKey) }},
+			{"report failed on a done learnuplet", func() error { return testReportLearnFailed(doneKey) }},
+			{"take a done learnuplet", func() error { return takeLearnuplet(doneKey) }},
+		}
+		if len(done) > 1 {
+			todoKey := done[1].Key
+			transitions = append(transitions, transition{"report done on a todo learnuplet", func() error { return testReportLearnDone(todoKey) }})
+		}
+
+		var accepted []string
+		for _, t := range transitions {
+			if err := t.call(); err != nil {
+				log.Printf("[peer-API] Rejected as expected: %s: %s", t.name, err)
+				continue
+			}
+			accepted = append(accepted, t.name)
+		}
+		if len(accepted) > 0 {
+			return fmt.Errorf("the chaincode accepted: %s", strings.Join(accepted, ", "))
+		}
+
+		// Rejected transitions must leave the learnuplets unchanged
+		if err := checkChainFailed(failedKey); err != nil {
+			return err
+		}
+		learnuplet, err := getLearnuplet(doneKey)
+		if err != nil {
+			return err
+		}
+		if learnuplet.Status != "done" || learnuplet.Perf != 0.5 {
+			return fmt.Errorf("learnuplet %s changed to status %s and perf %g after rejected transitions", learnuplet.Key, learnuplet.Status, learnuplet.Perf)
+		}
+		log.Println("[learn] SUCCESSFUL! The chaincode rejects the transitions out of final statuses.")
+		return nil
+	})
+}
+
+// checkChainFailed checks all the learnuplets of an algo are failed, without
+// perf: a failed learnuplet breaks the rest of its chain
+func checkChainFailed(algoKey string) error {
+	learnuplets, err := getAlgoLearnuplets(algoKey)
+	if err != nil {
+		return err
+	}
+	for _, learnuplet := range learnuplets {
+		if learnuplet.Status != "failed" {
+			return fmt.Errorf("learnuplet %s of rank %d has status %s, expected failed", learnuplet.Key, learnuplet.Rank, learnuplet.Status)
+		}
+		if learnuplet.Perf != 0 || len(learnuplet.TestPerf) > 0 {
+			return fmt.Errorf("failed learnuplet %s has a perf", learnuplet.Key)
+		}
+	}
+	return nil
+}
+
+// takeFirstLearnuplet takes the first learnuplet of an algo, as a worker
+func takeFirstLearnuplet(algoKey string) (*common.LearnupletChaincode, error) {
+	learnuplets, err := getAlgoLearnuplets(algoKey)
+	if err != nil {
+		return nil, err
+	}
+	if len(learnuplets) == 0 || learnuplets[0].Status != "todo" {
+		return nil, fmt.Errorf("no todo learnuplet for algo %s", algoKey)
+	}
+	if err := takeLearnuplet(learnuplets[0].Key); err != nil {
+		return nil, err
+	}
+	return &learnuplets[0], nil
+}
+
+func takeLearnuplet(key string) error {
+	_, _, err := peer.Invoke("setUpletWorker", []string{key, testsWorker})
+	return err
+}
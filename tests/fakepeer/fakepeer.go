@@ -0,0 +1,544 @@
+// Package fakepeer provides an in-memory stand-in for the orchestrator
+// chaincode, reachable through the same calls as client.PeerAPI. It follows
+// the orchestrator rules closely enough to run the integration tests without
+// a Fabric network.
+package fakepeer
+
+import (
+	"crypto/rand"
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/MorpheoOrg/morpheo-go-packages/common"
+
+	"github.com/MorpheoOrg/morpheo-devenv/tests/wait"
+)
+
+// Uplet statuses, in addition to the common.TaskStatus* ones
+const (
+	StatusTodo    = "todo"
+	StatusWaiting = "waiting"
+	StatusPending = "pending"
+	StatusDone    = "done"
+	StatusFailed  = "failed"
+)
+
+// Problem is a problem registered on the fake chaincode
+type Problem struct {
+	Key              string   `json:"key"`
+	StorageAddress   string   `json:"storageAddress"`
+	SizeTrainDataset int      `json:"sizeTrainDataset"`
+	TestData         []string `json:"testData"`
+}
+
+// Item is a data or an algo registered on the fake chaincode
+type Item struct {
+	Key            string   `json:"key"`
+	StorageAddress string   `json:"storageAddress"`
+	ProblemKeys    []string `json:"problemKeys"`
+	Name           string   `json:"name"`
+}
+
+// Preduplet is a prediction request registered on the fake chaincode
+type Preduplet struct {
+	Key        string `json:"key"`
+	Problem    string `json:"problem"`
+	Data       string `json:"data"`
+	Model      string `json:"model"`
+	Prediction string `json:"prediction"`
+	Worker     string `json:"worker"`
+	Status     string `json:"status"`
+}
+
+// Peer is an in-memory fake of the orchestrator chaincode
+type Peer struct {
+	mu          sync.Mutex
+	txCount     int
+	problems    map[string]*Problem
+	data        map[string]*Item
+	algos       map[string]*Item
+	learnuplets map[string]*common.LearnupletChaincode
+	preduplets  map[string]*Preduplet
+	// order keeps registration order, used to build deterministic train sets
+	order []string
+	// assigned tracks, per algo, the train data already part of a learnuplet
+	assigned map[string]map[string]bool
+
+	subscribers map[chan wait.Event]bool
+}
+
+// NewPeer returns an empty fake chaincode
+func NewPeer() *Peer {
+	return &Peer{
+		problems:    make(map[string]*Problem),
+		data:        make(map[string]*Item),
+		algos:       make(map[string]*Item),
+		learnuplets: make(map[string]*common.LearnupletChaincode),
+		preduplets:  make(map[string]*Preduplet),
+		assigned:    make(map[string]map[string]bool),
+		subscribers: make(map[chan wait.Event]bool),
+	}
+}
+
+// Subscribe returns a channel receiving an event for each chaincode
+// transaction, as a Fabric peer event source would
+func (p *Peer) Subscribe() (<-chan wait.Event, func(), error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	events := make(chan wait.Event, 16)
+	p.subscribers[events] = true
+	cancel := func() {
+		p.mu.Lock()
+		defer p.mu.Unlock()
+		delete(p.subscribers, events)
+	}
+	return events, cancel, nil
+}
+
+// emit sends an event to the subscribers, dropping it for the subscribers
+// which have not consumed the previous ones yet
+func (p *Peer) emit(name, key string) {
+	for events := range p.subscribers {
+		select {
+		case events <- wait.Event{Name: name, Key: key}:
+		default:
+		}
+	}
+}
+
+// RegisterProblem registers a problem and returns its key
+func (p *Peer) RegisterProblem(storageAddress string, sizeTrainDataset int, testData []string) ([]byte, string, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if sizeTrainDataset < 1 {
+		return nil, "", fmt.Errorf("invalid sizeTrainDataset %d", sizeTrainDataset)
+	}
+	key := "problem_" + storageAddress
+	if _, ok := p.problems[key]; ok {
+		return nil, "", fmt.Errorf("problem %s already exists", key)
+	}
+	p.problems[key] = &Problem{
+		Key:              key,
+		StorageAddress:   storageAddress,
+		SizeTrainDataset: sizeTrainDataset,
+		TestData:         append([]string(nil), testData...),
+	}
+	p.order = append(p.order, key)
+	p.createLearnuplets()
+	p.emit("register", key)
+	return []byte(key), p.newTxID(), nil
+}
+
+// RegisterItem registers a data or an algo and returns its key
+func (p *Peer) RegisterItem(itemType, storageAddress string, problemKeys []string, name string) ([]byte, string, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	var items map[string]*Item
+	switch itemType {
+	case "data":
+		items = p.data
+	case "algo":
+		items = p.algos
+	default:
+		return nil, "", fmt.Errorf("invalid item type %s", itemType)
+	}
+	for _, problemKey := range problemKeys {
+		if _, ok := p.problems[problemKey]; !ok {
+			return nil, "", fmt.Errorf("problem %s does not exist", problemKey)
+		}
+	}
+	key := itemType + "_" + storageAddress
+	if _, ok := items[key]; ok {
+		return nil, "", fmt.Errorf("%s %s already exists", itemType, key)
+	}
+	items[key] = &Item{
+		Key:            key,
+		StorageAddress: storageAddress,
+		ProblemKeys:    append([]string(nil), problemKeys...),
+		Name:           name,
+	}
+	p.order = append(p.order, key)
+	p.createLearnuplets()
+	p.emit("register", key)
+	return []byte(key), p.newTxID(), nil
+}
+
+// QueryStatusLearnuplet returns the JSON list of learnuplets with a given status
+func (p *Peer) QueryStatusLearnuplet(status string) ([]byte, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	learnuplets := []*common.LearnupletChaincode{}
+	for _, key := range p.sortedLearnupletKeys() {
+		if p.learnuplets[key].Status == status {
+			learnuplets = append(learnuplets, p.learnuplets[key])
+		}
+	}
+	return json.Marshal(learnuplets)
+}
+
+// ReportLearn reports the outcome of a pending learnuplet
+func (p *Peer) ReportLearn(key, status string, perf float64, trainPerf, testPerf map[string]float64) ([]byte, string, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	learnuplet, ok := p.learnuplets[key]
+	if !ok {
+		return nil, "", fmt.Errorf("learnuplet %s does not exist", key)
+	}
+	if learnuplet.Status != StatusPending {
+		return nil, "", fmt.Errorf("learnuplet %s has status %s, only pending learnuplets can be reported", key, learnuplet.Status)
+	}
+
+	switch status {
+	case StatusDone:
+		learnuplet.Status = StatusDone
+		learnuplet.Perf = perf
+		learnuplet.TrainPerf = trainPerf
+		learnuplet.TestPerf = testPerf
+		// The next learnuplet of the chain can now start
+		if next := p.nextLearnuplet(learnuplet); next != nil {
+			next.Status = StatusTodo
+		}
+	case StatusFailed:
+		// A failed learnuplet breaks the rest of the chain
+		for next := p.nextLearnuplet(learnuplet); next != nil; next = p.nextLearnuplet(next) {
+			next.Status = StatusFailed
+		}
+		learnuplet.Status = StatusFailed
+	default:
+		return nil, "", fmt.Errorf("invalid status %s, should be %s or %s", status, StatusDone, StatusFailed)
+	}
+	p.emit("reportLearn", key)
+	return []byte(key), p.newTxID(), nil
+}
+
+// Query answers the chaincode read functions
+func (p *Peer) Query(fcn string, args []string) ([]byte, error) {
+	switch fcn {
+	case "queryItem":
+		if len(args) != 1 {
+			return nil, fmt.Errorf("queryItem expects 1 argument, got %d", len(args))
+		}
+		return p.queryItem(args[0])
+	case "queryItems":
+		if len(args) != 1 {
+			return nil, fmt.Errorf("queryItems expects 1 argument, got %d", len(args))
+		}
+		return p.queryItems(args[0])
+	case "queryStatusLearnuplet":
+		if len(args) != 1 {
+			return nil, fmt.Errorf("queryStatusLearnuplet expects 1 argument, got %d", len(args))
+		}
+		return p.QueryStatusLearnuplet(args[0])
+	}
+	return nil, fmt.Errorf("unknown query function %s", fcn)
+}
+
+// Invoke answers the chaincode write functions which have no dedicated method
+func (p *Peer) Invoke(fcn string, args []string) ([]byte, string, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	switch fcn {
+	case "setUpletWorker":
+		if len(args) != 2 {
+			return nil, "", fmt.Errorf("setUpletWorker expects 2 arguments, got %d", len(args))
+		}
+		return p.setUpletWorker(args[0], args[1])
+	case "requestPrediction":
+		if len(args) != 2 {
+			return nil, "", fmt.Errorf("requestPrediction expects 2 arguments, got %d", len(args))
+		}
+		return p.requestPrediction(args[0], args[1])
+	case "reportPrediction":
+		if len(args) != 2 {
+			return nil, "", fmt.Errorf("reportPrediction expects 2 arguments, got %d", len(args))
+		}
+		return p.reportPrediction(args[0], args[1])
+	}
+	return nil, "", fmt.Errorf("unknown invoke function %s", fcn)
+}
+
+func (p *Peer) queryItem(key string) ([]byte, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	var item interface{}
+	var ok bool
+	switch strings.SplitN(key, "_", 2)[0] {
+	case "problem":
+		item, ok = p.problems[key]
+	case "data":
+		item, ok = p.data[key]
+	case "algo":
+		item, ok = p.algos[key]
+	case "learnuplet":
+		item, ok = p.learnuplets[key]
+	case "preduplet":
+		item, ok = p.preduplets[key]
+	}
+	if !ok {
+		return nil, fmt.Errorf("item %s does not exist", key)
+	}
+	return json.Marshal(item)
+}
+
+func (p *Peer) queryItems(itemType string) ([]byte, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	var items []interface{}
+	switch itemType {
+	case "problem":
+		for _, key := range p.order {
+			if problem, ok := p.problems[key]; ok {
+				items = append(items, problem)
+			}
+		}
+	case "data", "algo":
+		for _, key := range p.order {
+			if item, ok := p.data[key]; ok && itemType == "data" {
+				items = append(items, item)
+			}
+			if item, ok := p.algos[key]; ok && itemType == "algo" {
+				items = append(items, item)
+			}
+		}
+	case "learnuplet":
+		for _, key := range p.sortedLearnupletKeys() {
+			items = append(items, p.learnuplets[key])
+		}
+	case "preduplet":
+		keys := make([]string, 0, len(p.preduplets))
+		for key := range p.preduplets {
+			keys = append(keys, key)
+		}
+		sort.Strings(keys)
+		for _, key := range keys {
+			items = append(items, p.preduplets[key])
+		}
+	default:
+		return nil, fmt.Errorf("invalid item type %s", itemType)
+	}
+	if items == nil {
+		items = []interface{}{}
+	}
+	return json.Marshal(items)
+}
+
+func (p *Peer) setUpletWorker(key, worker string) ([]byte, string, error) {
+	if learnuplet, ok := p.learnuplets[key]; ok {
+		if learnuplet.Status != StatusTodo {
+			return nil, "", fmt.Errorf("learnuplet %s has status %s, only todo learnuplets can be assigned", key, learnuplet.Status)
+		}
+		learnuplet.Status = StatusPending
+		learnuplet.Worker = worker
+		p.emit("setUpletWorker", key)
+		return []byte(key), p.newTxID(), nil
+	}
+	if preduplet, ok := p.preduplets[key]; ok {
+		if preduplet.Status != StatusTodo {
+			return nil, "", fmt.Errorf("preduplet %s has status %s, only todo preduplets can be assigned", key, preduplet.Status)
+		}
+		preduplet.Status = StatusPending
+		preduplet.Worker = worker
+		p.emit("setUpletWorker", key)
+		return []byte(key), p.newTxID(), nil
+	}
+	return nil, "", fmt.Errorf("uplet %s does not exist", key)
+}
+
+// requestPrediction creates a preduplet using the best model trained on the
+// problem: the model of the done learnuplet with the highest perf, the latest
+// one on ties
+func (p *Peer) requestPrediction(dataAddress, problemAddress string) ([]byte, string, error) {
+	problemKey := "problem_" + problemAddress
+	if _, ok := p.problems[problemKey]; !ok {
+		return nil, "", fmt.Errorf("problem %s does not exist", problemKey)
+	}
+	if _, ok := p.data["data_"+dataAddress]; !ok {
+		return nil, "", fmt.Errorf("data data_%s does not exist", dataAddress)
+	}
+
+	var model *common.LearnupletChaincode
+	for _, key := range p.sortedLearnupletKeys() {
+		learnuplet := p.learnuplets[key]
+		if learnuplet.Problem == problemKey && learnuplet.Status == StatusDone {
+			if model == nil || learnuplet.Perf > model.Perf || (learnuplet.Perf == model.Perf && learnuplet.Rank >= model.Rank) {
+				model = learnuplet
+			}
+		}
+	}
+	if model == nil {
+		return nil, "", fmt.Errorf("no trained model for problem %s", problemKey)
+	}
+
+	key := "preduplet_" + newUUID()
+	p.preduplets[key] = &Preduplet{
+		Key:        key,
+		Problem:    problemKey,
+		Data:       dataAddress,
+		Model:      model.ModelEnd,
+		Prediction: newUUID(),
+		Status:     StatusTodo,
+	}
+	p.emit("requestPrediction", key)
+	return []byte(key), p.newTxID(), nil
+}
+
+func (p *Peer) reportPrediction(key, status string) ([]byte, string, error) {
+	preduplet, ok := p.preduplets[key]
+	if !ok {
+		return nil, "", fmt.Errorf("preduplet %s does not exist", key)
+	}
+	if preduplet.Status != StatusPending {
+		return nil, "", fmt.Errorf("preduplet %s has status %s, only pending preduplets can be reported", key, preduplet.Status)
+	}
+	if status != StatusDone && status != StatusFailed {
+		return nil, "", fmt.Errorf("invalid status %s, should be %s or %s", status, StatusDone, StatusFailed)
+	}
+	preduplet.Status = status
+	p.emit("reportPrediction", key)
+	return []byte(key), p.newTxID(), nil
+}
+
+// createLearnuplets creates, for every algo, learnuplets on the train data of
+// its problems that are not yet part of a learnuplet. Train data are grouped
+// by batches of sizeTrainDataset, in registration order. The first learnuplet
+// of a chain is "todo", the following ones are "waiting" for the previous one.
+func (p *Peer) createLearnuplets() {
+	for _, algoKey := range p.order {
+		algo, ok := p.algos[algoKey]
+		if !ok {
+			continue
+		}
+		for _, problemKey := range algo.ProblemKeys {
+			problem := p.problems[problemKey]
+			for {
+				batch := p.nextTrainBatch(algo.Key, problem)
+				if batch == nil {
+					break
+				}
+				p.addLearnuplet(algo.Key, problem, batch)
+			}
+		}
+	}
+}
+
+func (p *Peer) nextTrainBatch(algoKey string, problem *Problem) (batch []string) {
+	isTest := make(map[string]bool)
+	for _, address := range problem.TestData {
+		isTest[address] = true
+	}
+	assigned := p.assigned[algoKey+problem.Key]
+	for _, key := range p.order {
+		data, ok := p.data[key]
+		if !ok || isTest[data.StorageAddress] || assigned[data.Key] || !contains(data.ProblemKeys, problem.Key) {
+			continue
+		}
+		batch = append(batch, data.StorageAddress)
+		if len(batch) == problem.SizeTrainDataset {
+			return batch
+		}
+	}
+	return nil
+}
+
+func (p *Peer) addLearnuplet(algoKey string, problem *Problem, trainData []string) {
+	assignedKey := algoKey + problem.Key
+	if p.assigned[assignedKey] == nil {
+		p.assigned[assignedKey] = make(map[string]bool)
+	}
+	for _, address := range trainData {
+		p.assigned[assignedKey]["data_"+address] = true
+	}
+
+	// Chain the new learnuplet after the last one of the same algo and problem
+	var last *common.LearnupletChaincode
+	for _, learnuplet := range p.learnuplets {
+		if learnuplet.Algo == algoKey && learnuplet.Problem == problem.Key {
+			if last == nil || learnuplet.Rank > last.Rank {
+				last = learnuplet
+			}
+		}
+	}
+
+	learnuplet := &common.LearnupletChaincode{
+		Key:        "learnuplet_" + newUUID(),
+		Algo:       algoKey,
+		Problem:    problem.Key,
+		ModelStart: p.algos[algoKey].StorageAddress,
+		ModelEnd:   newUUID(),
+		TrainData:  trainData,
+		TestData:   append([]string(nil), problem.TestData...),
+		Status:     StatusTodo,
+	}
+	if last != nil {
+		learnuplet.Rank = last.Rank + 1
+		learnuplet.ModelStart = last.ModelEnd
+		switch last.Status {
+		case StatusDone:
+		case StatusFailed:
+			learnuplet.Status = StatusFailed
+		default:
+			learnuplet.Status = StatusWaiting
+		}
+	}
+	p.learnuplets[learnuplet.Key] = learnuplet
+}
+
+// nextLearnuplet returns the learnuplet following a given one in its chain
+func (p *Peer) nextLearnuplet(learnuplet *common.LearnupletChaincode) *common.LearnupletChaincode {
+	for _, next := range p.learnuplets {
+		if next.Algo == learnuplet.Algo && next.Problem == learnuplet.Problem && next.Rank == learnuplet.Rank+1 {
+			return next
+		}
+	}
+	return nil
+}
+
+func (p *Peer) sortedLearnupletKeys() []string {
+	keys := make([]string, 0, len(p.learnuplets))
+	for key := range p.learnuplets {
+		keys = append(keys, key)
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		a, b := p.learnuplets[keys[i]], p.learnuplets[keys[j]]
+		if a.Rank != b.Rank {
+			return a.Rank < b.Rank
+		}
+		return a.Key < b.Key
+	})
+	return keys
+}
+
+func (p *Peer) newTxID() string {
+	p.txCount++
+	return fmt.Sprintf("faketx%08d", p.txCount)
+}
+
+func contains(list []string, s string) bool {
+	for _, e := range list {
+		if e == s {
+			return true
+		}
+	}
+	return false
+}
+
+func newUUID() string {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		panic(err)
+	}
+	b[6] = (b[6] & 0x0f) | 0x40
+	b[8] = (b[8] & 0x3f) | 0x80
+	return fmt.Sprintf("%x-%x-%x-%x-%x", b[0:4], b[4:6], b[6:8], b[8:10], b[10:])
+}
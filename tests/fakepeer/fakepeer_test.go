@@ -0,0 +1,193 @@
+package fakepeer
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/MorpheoOrg/morpheo-go-packages/common"
+)
+
+// newTestPeer registers a problem learning on batches of one train data, its
+// test data, the given train data and algos
+func newTestPeer(t *testing.T, trainData []string, algos ...string) *Peer {
+	p := NewPeer()
+	if _, _, err := p.RegisterProblem("p", 1, []string{"test"}); err != nil {
+		t.Fatal(err)
+	}
+	for _, address := range append([]string{"test"}, trainData...) {
+		if _, _, err := p.RegisterItem("data", address, []string{"problem_p"}, ""); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for _, address := range algos {
+		if _, _, err := p.RegisterItem("algo", address, []string{"problem_p"}, address); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return p
+}
+
+// chain returns the learnuplets of an algo, by rank
+func chain(p *Peer, algo string) []*common.LearnupletChaincode {
+	var learnuplets []*common.LearnupletChaincode
+	for _, key := range p.sortedLearnupletKeys() {
+		if p.learnuplets[key].Algo == "algo_"+algo {
+			learnuplets = append(learnuplets, p.learnuplets[key])
+		}
+	}
+	return learnuplets
+}
+
+func checkStatuses(t *testing.T, step string, learnuplets []*common.LearnupletChaincode, expected ...string) {
+	for i, learnuplet := range learnuplets {
+		if learnuplet.Status != expected[i] {
+			t.Errorf("%s: learnuplet of rank %d has status %s, expected %s", step, learnuplet.Rank, learnuplet.Status, expected[i])
+		}
+	}
+}
+
+// learn assigns a learnuplet to a worker and reports its outcome
+func learn(t *testing.T, p *Peer, learnuplet *common.LearnupletChaincode, status string, perf float64) {
+	if _, _, err := p.Invoke("setUpletWorker", []string{learnuplet.Key, "worker"}); err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := p.ReportLearn(learnuplet.Key, status, perf, nil, nil); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestLearnupletChain(t *testing.T) {
+	p := newTestPeer(t, []string{"d1", "d2", "d3"}, "a")
+	learnuplets := chain(p, "a")
+	if len(learnuplets) != 3 {
+		t.Fatalf("%d learnuplets, expected 3", len(learnuplets))
+	}
+	if learnuplets[0].ModelStart != "a" {
+		t.Errorf("first learnuplet starts from model %s, expected the algo a", learnuplets[0].ModelStart)
+	}
+	for i, learnuplet := range learnuplets[1:] {
+		if learnuplet.ModelStart != learnuplets[i].ModelEnd {
+			t.Errorf("learnuplet of rank %d starts from model %s, expected %s", learnuplet.Rank, learnuplet.ModelStart, learnuplets[i].ModelEnd)
+		}
+	}
+	checkStatuses(t, "registered", learnuplets, StatusTodo, StatusWaiting, StatusWaiting)
+
+	if _, _, err := p.Invoke("setUpletWorker", []string{learnuplets[0].Key, "worker"}); err != nil {
+		t.Fatal(err)
+	}
+	checkStatuses(t, "assigned", learnuplets, StatusPending, StatusWaiting, StatusWaiting)
+	if _, _, err := p.ReportLearn(learnuplets[0].Key, StatusDone, 0.5, nil, nil); err != nil {
+		t.Fatal(err)
+	}
+	checkStatuses(t, "done", learnuplets, StatusDone, StatusTodo, StatusWaiting)
+	if learnuplets[0].Perf != 0.5 {
+		t.Errorf("done learnuplet has perf %g, expected 0.5", learnuplets[0].Perf)
+	}
+
+	learn(t, p, learnuplets[1], StatusFailed, 0)
+	checkStatuses(t, "failed", learnuplets, StatusDone, StatusFailed, StatusFailed)
+
+	// A learnuplet added after a failure is failed too
+	if _, _, err := p.RegisterItem("data", "d4", []string{"problem_p"}, ""); err != nil {
+		t.Fatal(err)
+	}
+	learnuplets = chain(p, "a")
+	checkStatuses(t, "added after a failure", learnuplets, StatusDone, StatusFailed, StatusFailed, StatusFailed)
+
+	// Only pending learnuplets can be reported
+	if _, _, err := p.ReportLearn(learnuplets[3].Key, StatusDone, 1, nil, nil); err == nil {
+		t.Error("reporting a failed learnuplet succeeded")
+	}
+}
+
+func TestSetUpletWorkerRejections(t *testing.T) {
+	p := newTestPeer(t, []string{"d1", "d2"}, "a")
+	learnuplets := chain(p, "a")
+	if _, _, err := p.Invoke("setUpletWorker", []string{learnuplets[0].Key, "worker"}); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name string
+		args []string
+		err  string
+	}{
+		{"unknown uplet", []string{"learnuplet_unknown", "worker"}, "does not exist"},
+		{"pending learnuplet", []string{learnuplets[0].Key, "other"}, "has status pending"},
+		{"waiting learnuplet", []string{learnuplets[1].Key, "worker"}, "has status waiting"},
+		{"missing worker", []string{learnuplets[1].Key}, "expects 2 arguments"},
+	}
+	for _, test := range tests {
+		_, _, err := p.Invoke("setUpletWorker", test.args)
+		if err == nil || !strings.Contains(err.Error(), test.err) {
+			t.Errorf("%s: got error %v, expected %q", test.name, err, test.err)
+		}
+	}
+	if learnuplets[0].Worker != "worker" {
+		t.Errorf("pending learnuplet reassigned to %s", learnuplets[0].Worker)
+	}
+
+	// A preduplet is assigned once too
+	if _, _, err := p.ReportLearn(learnuplets[0].Key, StatusDone, 0.5, nil, nil); err != nil {
+		t.Fatal(err)
+	}
+	key, _, err := p.Invoke("requestPrediction", []string{"test", "p"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := p.Invoke("setUpletWorker", []string{string(key), "worker"}); err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := p.Invoke("setUpletWorker", []string{string(key), "worker"}); err == nil || !strings.Contains(err.Error(), "has status pending") {
+		t.Errorf("assigning preduplet %s twice: got error %v", key, err)
+	}
+}
+
+func TestRequestPredictionModel(t *testing.T) {
+	tests := []struct {
+		name string
+		// perfs of the learnuplets of the algos a and b, done in this order
+		perfsA, perfsB []float64
+		// expected model, as the algo and rank of its learnuplet
+		algo string
+		rank int
+	}{
+		{"highest perf", []float64{0.2, 0.9}, []float64{0.5}, "a", 1},
+		{"highest perf in another algo", []float64{0.2}, []float64{0.3, 0.1}, "b", 0},
+		{"latest on ties", []float64{0.4, 0.4}, nil, "a", 1},
+		{"negative perfs", []float64{-0.3}, []float64{-0.1}, "b", 0},
+	}
+	for _, test := range tests {
+		p := newTestPeer(t, []string{"d1", "d2"}, "a", "b")
+		for _, algo := range []string{"a", "b"} {
+			perfs := test.perfsA
+			if algo == "b" {
+				perfs = test.perfsB
+			}
+			for i, perf := range perfs {
+				learn(t, p, chain(p, algo)[i], StatusDone, perf)
+			}
+		}
+
+		key, _, err := p.Invoke("requestPrediction", []string{"test", "p"})
+		if err != nil {
+			t.Errorf("%s: %s", test.name, err)
+			continue
+		}
+		expected := chain(p, test.algo)[test.rank].ModelEnd
+		if model := p.preduplets[string(key)].Model; model != expected {
+			t.Errorf("%s: preduplet uses model %s, expected the model of the learnuplet of rank %d of algo %s", test.name, model, test.rank, test.algo)
+		}
+	}
+
+	p := newTestPeer(t, []string{"d1"}, "a")
+	if _, _, err := p.Invoke("requestPrediction", []string{"test", "p"}); err == nil || !strings.Contains(err.Error(), "no trained model") {
+		t.Errorf("requesting a prediction without any done learnuplet: got error %v", err)
+	}
+	learn(t, p, chain(p, "a")[0], StatusDone, 0.5)
+	for _, args := range [][]string{{"unknown", "p"}, {"test", "unknown"}} {
+		if _, _, err := p.Invoke("requestPrediction", args); err == nil || !strings.Contains(err.Error(), "does not exist") {
+			t.Errorf("requestPrediction(%v): got error %v", args, err)
+		}
+	}
+}
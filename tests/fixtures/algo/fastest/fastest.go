@@ -1,7 +1,6 @@
 package main
 
 import (
-	"crypto/md5"
 	"encoding/json"
 	"flag"
 	"fmt"
@@ -10,25 +9,49 @@ import (
 	"log"
 	"os"
 	"path/filepath"
+	"strconv"
+	"strings"
 	"time"
+
+	"github.com/MorpheoOrg/morpheo-devenv/tests/fixtures/checksums"
+	"github.com/MorpheoOrg/morpheo-devenv/tests/fixtures/hashpred"
+	"github.com/MorpheoOrg/morpheo-devenv/tests/fixtures/hdf5"
+	"github.com/MorpheoOrg/morpheo-devenv/tests/fixtures/scripted"
+)
+
+// predTarget is the dataset of the pred files holding the predictions
+const predTarget = "stages"
+
+// Prediction modes: fixtures only predicts on the fixture files, copying
+// their canned pred file, hash predicts on any file, generating predictions
+// from its hash
+const (
+	modeFixtures = "fixtures"
+	modeHash     = "hash"
 )
 
+// scriptedScore is the score to encode in the pred files, for the fastest
+// problem to report it. It is set at build time with
+// -ldflags "-X main.scriptedScore=0.9", and overridden by $FASTEST_SCORE and
+// by -score.
+var scriptedScore string
+
 var (
-	validHashData = map[string]string{
-		"7182575d2f1fe035c0ce8cea70f93cd7": "af7fcc0f-7a58-4a74-bfa2-8fb6e12008eb",
-		"86564dc69f8c9b081b5174ef562e1ac1": "8bc11648-d983-4a62-9ea2-590901f374ff",
-		"f09058c9de0b55d482f8575f8e8e7628": "48557ec1-3205-403a-b82c-843fd9b03f5b",
-		"ca7a7b23a4d5cb655df97378e571f7c6": "cbddd90c-f574-43d9-8d1f-b4989678a09b",
-		// Detargeted Files
-		"41b26abe9fd63ea31a8ea325bb9fb47c": "48557ec1-3205-403a-b82c-843fd9b03f5b",
-		"de5a7197e3e61c7987d3a64731608187": "cbddd90c-f574-43d9-8d1f-b4989678a09b",
-		// Pred files
-		"3b38668b9e0d1a8931e57d01235de01d": "48557ec1-3205-403a-b82c-843fd9b03f5b",
-		"7be08f2103cc61f50eb485dd5c7ef0df": "8bc11648-d983-4a62-9ea2-590901f374ff",
-		"a479fb72d25cff24112328433e39915f": "af7fcc0f-7a58-4a74-bfa2-8fb6e12008eb",
-		"63f9156ec639f5384c069fe3c7807429": "cbddd90c-f574-43d9-8d1f-b4989678a09b",
-	}
-	pathFixturesPred = "/fixtures/pred"
+	// validChecksums holds the checksums of the valid data files, and of the
+	// fixture files they map to
+	validChecksums   *checksums.Manifest
+	pathFixtures     = "/fixtures"
+	pathFixturesPred string
+
+	// score is the parsed scriptedScore, if set
+	score    float64
+	isScored bool
+
+	// mode is the prediction mode, predSize and predFormat the shape of the
+	// pred files in hash mode
+	mode       string
+	predSize   int
+	predFormat string
 )
 
 type Model struct {
@@ -47,16 +70,62 @@ var (
 
 func main() {
 	// Parse args
-	var task, volume string
+	var task, volume, pathChecksums string
 	flag.StringVar(&task, "T", "", "Task: train/predict")
 	flag.StringVar(&volume, "V", "", "Volume")
+	flag.StringVar(&pathFixtures, "fixtures", pathFixtures, "Fixtures directory")
+	flag.StringVar(&pathChecksums, "checksums", "", "Checksum manifest of the fixtures (default: <volume>/"+checksums.FileName+" if it exists, else <fixtures>/"+checksums.FileName+")")
+	flag.StringVar(&scriptedScore, "score", getenv("FASTEST_SCORE", scriptedScore), "Score to encode in the pred files, reported as is by the fastest problem ($FASTEST_SCORE)")
+	flag.StringVar(&mode, "mode", getenv("FASTEST_MODE", modeFixtures), "Prediction mode: fixtures predicts on the fixture files only, copying their pred file; hash predicts on any file, from its sha256 ($FASTEST_MODE)")
+	flag.IntVar(&predSize, "pred-size", getenvInt("FASTEST_PRED_SIZE", 1000), "Number of predictions per file in hash mode ($FASTEST_PRED_SIZE)")
+	flag.StringVar(&predFormat, "pred-format", getenv("FASTEST_PRED_FORMAT", "hdf5"), "Format of the pred files in hash mode: "+strings.Join(hashpred.Formats, "/")+" ($FASTEST_PRED_FORMAT)")
+	faultFlags()
+	flag.Usage = func() {
+		fmt.Fprintf(os.Stderr, "Usage of %s:\n", os.Args[0])
+		flag.PrintDefaults()
+		fmt.Fprintf(os.Stderr, "\nFaults:\n%s\n", faultsUsage())
+	}
 	flag.Parse()
+	pathFixturesPred = filepath.Join(pathFixtures, "pred")
+	if scriptedScore != "" {
+		var err error
+		score, err = strconv.ParseFloat(scriptedScore, 64)
+		check(err, "Invalid score")
+		isScored = true
+		log.Printf("Encoding score %f in the pred files", score)
+	}
 
 	// Check args are properly set
 	if (task != "train" && task != "predict") || volume == "" {
 		check(fmt.Errorf("task: %s, volume: %s", task, volume), "Missing or invalid arguments")
 	}
-	log.Printf("Starting task '%s' with volume '%s'...", task, volume)
+	switch mode {
+	case modeFixtures:
+	case modeHash:
+		if predSize < 1 {
+			log.Fatalf("[FATAL ERROR] Invalid -pred-size %d, should be at least 1", predSize)
+		}
+		if predFormat != "hdf5" && isScored {
+			log.Fatalf("[FATAL ERROR] Scores can only be encoded in hdf5 pred files, not %s", predFormat)
+		}
+		check(hashpred.CheckFormat(predFormat), "Invalid -pred-format")
+	default:
+		log.Fatalf("[FATAL ERROR] Invalid -mode %q, should be %s or %s", mode, modeFixtures, modeHash)
+	}
+	check(checkFault(task), "Invalid -fault")
+	log.Printf("Starting task '%s' with volume '%s' in %s mode...", task, volume, mode)
+
+	// Load the checksums of the fixtures
+	if mode == modeFixtures {
+		var err error
+		if pathChecksums == "" {
+			validChecksums, pathChecksums, err = checksums.Load(filepath.Join(volume, checksums.FileName), filepath.Join(pathFixtures, checksums.FileName))
+		} else {
+			validChecksums, err = checksums.Read(pathChecksums)
+		}
+		check(err, "Invalid checksum manifest")
+		log.Printf("Loaded %d checksums from %s", len(validChecksums.Entries), pathChecksums)
+	}
 
 	// Set up paths
 	pathTrain = filepath.Join(volume, "train")
@@ -68,25 +137,31 @@ func main() {
 	// Perform training if needed
 	if task == "train" {
 		train()
-		predict(pathTrain, pathTrainPred)
+		predict(pathTrain, pathTrainPred, phasePredictTrain)
 	}
 
 	// Always perform predict test
-	predict(pathTest, pathTestPred)
+	predict(pathTest, pathTestPred, phasePredictTest)
 }
 
 func train() {
+	injectFault(phaseTrain)
+
 	// Check data
 	files := checkData(pathTrain)
 	log.Printf("[train] Starting training with %d data files", len(files))
 
 	// Simulate training
-	updateModel()
+	if !skipModel() {
+		updateModel()
+	}
 }
 
-func predict(srcDir, saveDir string) {
-	// Check model is here
-	if !checkFileExists(pathModel) {
+func predict(srcDir, saveDir, phase string) {
+	injectFault(phase)
+
+	// Check model is here, unless it was deliberately not written
+	if !checkFileExists(pathModel) && fault != faultNoModel {
 		log.Fatalln("Missing model_trained.json file for predicting task")
 	}
 
@@ -97,20 +172,32 @@ func predict(srcDir, saveDir string) {
 		log.Fatalf("[FATAL ERROR] Missing files for predict task in directory %s", srcDir)
 	}
 
-	// Check files and copy predict files
+	// Check files and copy predict files, or generate them in hash mode
 	for _, f := range prevFiles {
 		if f.IsDir() {
 			continue
 		}
 		data, err := ioutil.ReadFile(filepath.Join(srcDir, f.Name()))
 		check(err, "")
-		checksum := fmt.Sprintf("%x", md5.Sum(data))
-		fName, ok := validHashData[checksum]
+		check(os.MkdirAll(saveDir, 0755), fmt.Sprintf("Failed to create directory %s", saveDir))
+		if mode == modeHash {
+			check(writeHashPred(data, filepath.Join(saveDir, f.Name())), "[SCRIPT ERROR] Failed to write predict data")
+			corruptPred(phase, filepath.Join(saveDir, f.Name()))
+			log.Printf("[predict] Sucessfully predicted %d values on data %s", predSize, f.Name())
+			continue
+		}
+
+		checksum := checksums.Sum(data)
+		fName, ok := validChecksums.Lookup(checksum)
 		if !ok {
 			log.Fatalf("[FATAL ERROR] Invalid checksum for file %s (%s)", f.Name(), checksum)
 		}
-		check(os.MkdirAll(saveDir, 0755), fmt.Sprintf("Failed to create directory %s", saveDir))
-		check(copyFile(filepath.Join(pathFixturesPred, fName), filepath.Join(saveDir, f.Name())), "[SCRIPT ERROR] Failed to copy predict data")
+		if isScored {
+			check(writeScoredPred(filepath.Join(pathFixturesPred, fName), filepath.Join(saveDir, f.Name())), "[SCRIPT ERROR] Failed to write scored predict data")
+		} else {
+			check(copyFile(filepath.Join(pathFixturesPred, fName), filepath.Join(saveDir, f.Name())), "[SCRIPT ERROR] Failed to copy predict data")
+		}
+		corruptPred(phase, filepath.Join(saveDir, f.Name()))
 		log.Printf("[predict] Sucessfully predicted on data %s", f.Name())
 	}
 }
@@ -135,6 +222,36 @@ func updateModel() {
 	check(ioutil.WriteFile(pathModel, modelBytes, 0775), "[SCRIPT ERROR] Failed to WriteFile on Model")
 }
 
+// writeScoredPred writes the predictions of a fixture pred file, along with
+// the scripted score
+func writeScoredPred(src, dst string) error {
+	predictions, err := hdf5.ReadFloat64s(src, predTarget)
+	if err != nil {
+		return err
+	}
+	return hdf5.WriteFile(dst, []hdf5.Dataset{
+		{Name: predTarget, Values: predictions},
+		scripted.Encode(score, filepath.Base(dst)),
+	})
+}
+
+// writeHashPred writes predictions generated from the content of a data
+// file, along with the scripted score if any
+func writeHashPred(data []byte, dst string) error {
+	predictions := hashpred.Values(data, predSize)
+	if isScored {
+		return hdf5.WriteFile(dst, []hdf5.Dataset{
+			{Name: predTarget, Values: predictions},
+			scripted.Encode(score, filepath.Base(dst)),
+		})
+	}
+	pred, err := hashpred.Marshal(predFormat, predTarget, predictions)
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(dst, pred, 0644)
+}
+
 func copyFile(src, dst string) (err error) {
 	in, err := os.Open(src)
 	if err != nil {
@@ -158,8 +275,8 @@ func copyFile(src, dst string) (err error) {
 	return
 }
 
-// checkData reads a dir, and for each file verify that checksums is valid
-// it returns the list of files (removing directories)
+// checkData reads a dir, and for each file verify that checksums is valid,
+// unless in hash mode. It returns the list of files (removing directories)
 func checkData(path string) (fileInfos []os.FileInfo) {
 	dirFiles, err := ioutil.ReadDir(path)
 	check(err, "")
@@ -167,10 +284,14 @@ func checkData(path string) (fileInfos []os.FileInfo) {
 		if f.IsDir() {
 			continue
 		}
+		if mode == modeHash {
+			fileInfos = append(fileInfos, f)
+			continue
+		}
 		data, err := ioutil.ReadFile(filepath.Join(path, f.Name()))
 		check(err, "")
-		checksum := fmt.Sprintf("%x", md5.Sum(data))
-		if _, ok := validHashData[checksum]; !ok {
+		checksum := checksums.Sum(data)
+		if _, ok := validChecksums.Lookup(checksum); !ok {
 			log.Fatalf("[FATAL ERROR] Invalid checksum for file %s (%s)", f.Name(), checksum)
 		}
 		fileInfos = append(fileInfos, f)
@@ -181,6 +302,39 @@ func checkData(path string) (fileInfos []os.FileInfo) {
 	return fileInfos
 }
 
+// getenv returns the value of an environment variable, or value if it is not
+// set
+func getenv(name, value string) string {
+	if env := os.Getenv(name); env != "" {
+		return env
+	}
+	return value
+}
+
+// getenvInt returns the integer value of an environment variable, or value
+// if it is not set
+func getenvInt(name string, value int) int {
+	env := os.Getenv(name)
+	if env == "" {
+		return value
+	}
+	i, err := strconv.Atoi(env)
+	check(err, fmt.Sprintf("Invalid $%s", name))
+	return i
+}
+
+// getenvDuration returns the duration value of an environment variable, or
+// value if it is not set
+func getenvDuration(name string, value time.Duration) time.Duration {
+	env := os.Getenv(name)
+	if env == "" {
+		return value
+	}
+	d, err := time.ParseDuration(env)
+	check(err, fmt.Sprintf("Invalid $%s", name))
+	return d
+}
+
 func checkFileExists(path string) bool {
 	if _, err := os.Stat(path); err != nil {
 		return false
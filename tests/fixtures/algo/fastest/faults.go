@@ -0,0 +1,173 @@
+package main
+
+import (
+	"bufio"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"strings"
+	"time"
+)
+
+// Faults injected with -fault, to test how the compute worker and the
+// orchestrator handle misbehaving algos
+const (
+	faultExit      = "exit"
+	faultSleep     = "sleep"
+	faultMemory    = "memory"
+	faultPartial   = "partial-pred"
+	faultMalformed = "malformed-pred"
+	faultNoModel   = "no-model"
+	faultFlood     = "flood"
+)
+
+// Phases of the tasks, at which faults are injected
+const (
+	phaseTrain        = "train"
+	phasePredictTrain = "predict-train"
+	phasePredictTest  = "predict-test"
+)
+
+// taskPhases lists the phases each task runs, in order
+var taskPhases = map[string][]string{
+	"train":   {phaseTrain, phasePredictTrain, phasePredictTest},
+	"predict": {phasePredictTest},
+}
+
+// faults documents the faults in -h, in this order
+var faults = []struct {
+	name, usage string
+	phases      []string
+}{
+	{faultExit, "exit with -fault-code at the start of the phase", []string{phaseTrain, phasePredictTrain, phasePredictTest}},
+	{faultSleep, "sleep -fault-sleep at the start of the phase, e.g. past the worker's -learn-timeout", []string{phaseTrain, phasePredictTrain, phasePredictTest}},
+	{faultMemory, "allocate -fault-memory MB at the start of the phase, e.g. past the container mem_limit", []string{phaseTrain, phasePredictTrain, phasePredictTest}},
+	{faultFlood, "write -fault-flood MB to stdout at the start of the phase", []string{phaseTrain, phasePredictTrain, phasePredictTest}},
+	{faultPartial, "truncate the pred files to half their size", []string{phasePredictTrain, phasePredictTest}},
+	{faultMalformed, "write pred files that are not HDF5", []string{phasePredictTrain, phasePredictTest}},
+	{faultNoModel, "do not write model_trained.json", []string{phaseTrain}},
+}
+
+var (
+	fault         string
+	faultPhase    string
+	faultCode     int
+	faultSleepFor time.Duration
+	faultMemoryMB int
+	faultFloodMB  int
+
+	// ballast keeps the memory allocated by the memory fault until exit
+	ballast [][]byte
+)
+
+// faultFlags defines the failure injection flags
+func faultFlags() {
+	flag.StringVar(&fault, "fault", getenv("FASTEST_FAULT", ""), "Fault to inject, see below ($FASTEST_FAULT)")
+	flag.StringVar(&faultPhase, "fault-phase", getenv("FASTEST_FAULT_PHASE", ""), "Phase to inject the fault at: "+strings.Join([]string{phaseTrain, phasePredictTrain, phasePredictTest}, "/")+", the first phase of the task by default ($FASTEST_FAULT_PHASE)")
+	flag.IntVar(&faultCode, "fault-code", getenvInt("FASTEST_FAULT_CODE", 1), "Exit code of the exit fault ($FASTEST_FAULT_CODE)")
+	flag.DurationVar(&faultSleepFor, "fault-sleep", getenvDuration("FASTEST_FAULT_SLEEP", time.Hour), "Duration of the sleep fault ($FASTEST_FAULT_SLEEP)")
+	flag.IntVar(&faultMemoryMB, "fault-memory", getenvInt("FASTEST_FAULT_MEMORY", 4096), "MB allocated by the memory fault ($FASTEST_FAULT_MEMORY)")
+	flag.IntVar(&faultFloodMB, "fault-flood", getenvInt("FASTEST_FAULT_FLOOD", 100), "MB written to stdout by the flood fault ($FASTEST_FAULT_FLOOD)")
+}
+
+// faultsUsage lists the faults and their phases, for -h
+func faultsUsage() string {
+	var usage []string
+	for _, f := range faults {
+		usage = append(usage, fmt.Sprintf("  %-15s %s (phases: %s)", f.name, f.usage, strings.Join(f.phases, "/")))
+	}
+	return strings.Join(usage, "\n")
+}
+
+// checkFault checks the fault can be injected at its phase, and that the task
+// runs this phase. The phase defaults to the first one of the task.
+func checkFault(task string) error {
+	if fault == "" {
+		return nil
+	}
+	phases := taskPhases[task]
+	if faultPhase == "" {
+		faultPhase = phases[0]
+	}
+	if !contains(phases, faultPhase) {
+		return fmt.Errorf("task %s never reaches phase %q, only %s", task, faultPhase, strings.Join(phases, "/"))
+	}
+	for _, f := range faults {
+		if f.name != fault {
+			continue
+		}
+		if contains(f.phases, faultPhase) {
+			return nil
+		}
+		return fmt.Errorf("fault %s cannot be injected at phase %q, only at %s", fault, faultPhase, strings.Join(f.phases, "/"))
+	}
+	return fmt.Errorf("unknown fault %q", fault)
+}
+
+func contains(values []string, value string) bool {
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
+
+// injectFault injects the faults of the start of a phase
+func injectFault(phase string) {
+	if fault == "" || phase != faultPhase {
+		return
+	}
+	log.Printf("[fault] Injecting fault %s at phase %s", fault, phase)
+	switch fault {
+	case faultExit:
+		os.Exit(faultCode)
+	case faultSleep:
+		time.Sleep(faultSleepFor)
+	case faultMemory:
+		// Touch every page, for the memory to be actually used
+		for i := 0; i < faultMemoryMB; i++ {
+			chunk := make([]byte, 1<<20)
+			for j := 0; j < len(chunk); j += 4096 {
+				chunk[j] = 1
+			}
+			ballast = append(ballast, chunk)
+		}
+		log.Printf("[fault] Allocated %d MB", len(ballast))
+	case faultFlood:
+		out := bufio.NewWriter(os.Stdout)
+		line := strings.Repeat("flood ", 170) + "\n"
+		for written := 0; written < faultFloodMB<<20; written += len(line) {
+			out.WriteString(line)
+		}
+		out.Flush()
+	}
+}
+
+// corruptPred injects the pred file faults of a phase on a written pred file
+func corruptPred(phase, path string) {
+	if phase != faultPhase {
+		return
+	}
+	switch fault {
+	case faultPartial:
+		info, err := os.Stat(path)
+		check(err, "")
+		check(os.Truncate(path, info.Size()/2), "[fault] Failed to truncate pred file")
+		log.Printf("[fault] Truncated pred file %s to %d bytes", path, info.Size()/2)
+	case faultMalformed:
+		check(ioutil.WriteFile(path, []byte("not an hdf5 file\n"), 0644), "[fault] Failed to write malformed pred file")
+		log.Printf("[fault] Wrote malformed pred file %s", path)
+	}
+}
+
+// skipModel tells whether the trained model must not be written
+func skipModel() bool {
+	if fault == faultNoModel {
+		log.Printf("[fault] Not writing %s", pathModel)
+		return true
+	}
+	return false
+}
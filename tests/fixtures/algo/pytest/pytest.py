@@ -8,18 +8,11 @@ import time
 import hashlib
 
 
-VALID_FILE_HASH = [
-    "7182575d2f1fe035c0ce8cea70f93cd7",
-    "86564dc69f8c9b081b5174ef562e1ac1",
-    "f09058c9de0b55d482f8575f8e8e7628",
-    "ca7a7b23a4d5cb655df97378e571f7c6",
-
-    # Detargeted Value
-    "de5a7197e3e61c7987d3a64731608187",
-    "41b26abe9fd63ea31a8ea325bb9fb47c",
-    "225cc8d69add816ca2506ffbf7d37615",
-    "5a95ae04c2f7a6d92435bb0e84a1e170"
-]
+# sha256sum-like manifest of the valid files: "<sha256>  <path>" lines. The
+# one mounted in the volume takes precedence over the one of the image (see
+# tests/fixtures/README.md)
+CHECKSUMS_FILE = "SHA256SUMS"
+FIXTURES_DIR = "/fixtures"
 
 
 class Classifier():
@@ -96,14 +89,30 @@ def read_data(list_data):
         return X, y
 
 
-def check_data(list_data, data_type):
+def load_valid_hashes(volume):
+    """Returns the sha256 of the valid files, from the manifest mounted in the
+    volume if any, from the manifest of the image otherwise"""
+    path = os.path.join(volume, CHECKSUMS_FILE)
+    if not os.path.exists(path):
+        path = os.path.join(FIXTURES_DIR, CHECKSUMS_FILE)
+    try:
+        with open(path) as f:
+            return [line.split()[0].lower() for line in f
+                    if line.strip() and not line.startswith("#")]
+    except IOError as e:
+        print("[ERROR] Missing checksum manifest: %s" % e)
+        sys.exit(2)
+
+
+def check_data(list_data, data_type, volume):
     if len(list_data) == 0:
         print("[ERROR] %s files are missing" % data_type)
         sys.exit(2)
+    valid_hashes = load_valid_hashes(volume)
     for fname in list_data:
         with open(fname, "rb") as f:
-            h = hashlib.md5(f.read()).hexdigest()
-            if h not in VALID_FILE_HASH:
+            h = hashlib.sha256(f.read()).hexdigest()
+            if h not in valid_hashes:
                 print("[ERROR] Invalid hash (%s) for file %s" % (h, fname))
                 sys.exit(2)
 
@@ -136,7 +145,7 @@ def main(argv):
         train_data = [path + f for f in os.listdir(path)
                       if os.path.isfile(os.path.join(path, f))]
         print("training data", train_data)
-        check_data(train_data, "train")
+        check_data(train_data, "train", volume)
 
         # simulate training
         model.load_model()
@@ -151,7 +160,7 @@ def main(argv):
         test_data = [path + f for f in os.listdir(path)
                      if os.path.isfile(os.path.join(path, f))]
         print("test data", test_data)
-        check_data(test_data, "test")
+        check_data(test_data, "test", volume)
 
         # predicting
         model.predict(test_data, model.file_test_pred)
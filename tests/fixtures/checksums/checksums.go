@@ -0,0 +1,193 @@
+// Package checksums reads and writes the checksum manifests of the fixture
+// files. A manifest uses the format of sha256sum, one "<sha256>  <path>" line
+// per file, so it can also be checked with sha256sum -c. The base name of
+// each path is the UUID of the fixture, which the fixture binaries use to find
+// the pred and untargetedTest files of a data file.
+package checksums
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// FileName is the name of the manifests shipped in /fixtures, or mounted in
+// the volumes
+const FileName = "SHA256SUMS"
+
+// Entry is the checksum of a fixture file
+type Entry struct {
+	Sum string
+	// Path is slash-separated, relative to the root of the fixtures
+	Path string
+}
+
+// ID returns the UUID of the fixture, the base name of its path
+func (e Entry) ID() string {
+	return path.Base(e.Path)
+}
+
+// Manifest lists the checksums of the fixture files
+type Manifest struct {
+	Entries []Entry
+}
+
+// Sum returns the hex sha256 of data
+func Sum(data []byte) string {
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:])
+}
+
+// SumFile returns the hex sha256 of a file, reading it as a stream
+func SumFile(path string) (string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	hash := sha256.New()
+	if _, err := io.Copy(hash, f); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(hash.Sum(nil)), nil
+}
+
+// Read parses a manifest file
+func Read(path string) (*Manifest, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	m := &Manifest{}
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	for line := 1; scanner.Scan(); line++ {
+		text := strings.TrimSpace(scanner.Text())
+		if text == "" || strings.HasPrefix(text, "#") {
+			continue
+		}
+		fields := strings.Fields(text)
+		if len(fields) != 2 || len(fields[0]) != 2*sha256.Size {
+			return nil, fmt.Errorf("%s:%d: invalid line %q, should be <sha256>  <path>", path, line, text)
+		}
+		// sha256sum flags binary files with a leading *
+		m.Entries = append(m.Entries, Entry{Sum: strings.ToLower(fields[0]), Path: strings.TrimPrefix(fields[1], "*")})
+	}
+	return m, scanner.Err()
+}
+
+// Load reads the first manifest of paths that exists
+func Load(paths ...string) (*Manifest, string, error) {
+	for _, path := range paths {
+		if _, err := os.Stat(path); os.IsNotExist(err) {
+			continue
+		}
+		m, err := Read(path)
+		return m, path, err
+	}
+	return nil, "", fmt.Errorf("no checksum manifest, looked for %s", strings.Join(paths, ", "))
+}
+
+// Lookup returns the UUID of the fixture file with a given sha256
+func (m *Manifest) Lookup(sum string) (id string, ok bool) {
+	for _, entry := range m.Entries {
+		if entry.Sum == sum {
+			return entry.ID(), true
+		}
+	}
+	return "", false
+}
+
+// Bytes encodes the manifest, sorted by path
+func (m *Manifest) Bytes() []byte {
+	entries := append([]Entry(nil), m.Entries...)
+	sort.Slice(entries, func(i, j int) bool { return entries[i].Path < entries[j].Path })
+	var b bytes.Buffer
+	for _, entry := range entries {
+		fmt.Fprintf(&b, "%s  %s\n", entry.Sum, entry.Path)
+	}
+	return b.Bytes()
+}
+
+// WriteFile writes the manifest to a file
+func (m *Manifest) WriteFile(path string) error {
+	return ioutil.WriteFile(path, m.Bytes(), 0644)
+}
+
+// Generate computes the checksums of all the files under dirs, relative to
+// root
+func Generate(root string, dirs []string) (*Manifest, error) {
+	m := &Manifest{}
+	for _, dir := range dirs {
+		err := filepath.Walk(filepath.Join(root, dir), func(path string, info os.FileInfo, err error) error {
+			if err != nil || info.IsDir() {
+				return err
+			}
+			sum, err := SumFile(path)
+			if err != nil {
+				return err
+			}
+			rel, err := filepath.Rel(root, path)
+			if err != nil {
+				return err
+			}
+			m.Entries = append(m.Entries, Entry{Sum: sum, Path: filepath.ToSlash(rel)})
+			return nil
+		})
+		if err != nil {
+			return nil, err
+		}
+	}
+	return m, nil
+}
+
+// Stale is a difference between a manifest and the fixture files
+type Stale struct {
+	Path   string
+	Reason string
+}
+
+func (s Stale) String() string {
+	return fmt.Sprintf("%s: %s", s.Path, s.Reason)
+}
+
+// Verify compares a manifest to the files under dirs, relative to root. It
+// reports the files whose checksum changed, the files of the manifest that
+// are missing, and the files missing from the manifest.
+func Verify(m *Manifest, root string, dirs []string) ([]Stale, error) {
+	current, err := Generate(root, dirs)
+	if err != nil {
+		return nil, err
+	}
+	sums := make(map[string]string)
+	for _, entry := range current.Entries {
+		sums[entry.Path] = entry.Sum
+	}
+
+	var stale []Stale
+	listed := make(map[string]bool)
+	for _, entry := range m.Entries {
+		listed[entry.Path] = true
+		sum, ok := sums[entry.Path]
+		switch {
+		case !ok:
+			stale = append(stale, Stale{entry.Path, "missing file"})
+		case sum != entry.Sum:
+			stale = append(stale, Stale{entry.Path, fmt.Sprintf("checksum %s, manifest has %s", sum, entry.Sum)})
+		}
+	}
+	for _, entry := range current.Entries {
+		if !listed[entry.Path] {
+			stale = append(stale, Stale{entry.Path, "not in the manifest"})
+		}
+	}
+	return stale, nil
+}
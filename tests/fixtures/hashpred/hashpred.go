@@ -0,0 +1,84 @@
+// Package hashpred generates deterministic predictions from the content of
+// any input file, for the fastest algo to predict on data it has no fixture
+// for. The same input always gives the same predictions, in any format.
+package hashpred
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"math"
+	"strconv"
+
+	"github.com/MorpheoOrg/morpheo-devenv/tests/fixtures/hdf5"
+)
+
+// Formats are the supported output formats
+var Formats = []string{"hdf5", "csv", "json", "raw"}
+
+// CheckFormat returns an error if format is not supported
+func CheckFormat(format string) error {
+	for _, f := range Formats {
+		if format == f {
+			return nil
+		}
+	}
+	return fmt.Errorf("unknown format %q, should be one of %v", format, Formats)
+}
+
+// Values returns n pseudo-random values in [0, 1), derived from the sha256 of
+// input. Each block of 4 values is read from sha256(sha256(input) || i), with
+// i the little-endian uint64 index of the block, so that other languages can
+// reproduce them.
+func Values(input []byte, n int) []float64 {
+	return FromSum(sha256.Sum256(input), n)
+}
+
+// FromSum returns the Values of the input of sha256 seed, for inputs hashed
+// while they are streamed
+func FromSum(seed [sha256.Size]byte, n int) []float64 {
+	block := make([]byte, len(seed)+8)
+	copy(block, seed[:])
+
+	values := make([]float64, 0, n)
+	for i := uint64(0); len(values) < n; i++ {
+		binary.LittleEndian.PutUint64(block[len(seed):], i)
+		sum := sha256.Sum256(block)
+		for j := 0; j < len(sum) && len(values) < n; j += 8 {
+			// 53 bits give every float64 of [0, 1) with a 2^-53 step
+			values = append(values, float64(binary.LittleEndian.Uint64(sum[j:])>>11)/(1<<53))
+		}
+	}
+	return values
+}
+
+// Marshal encodes values in a format:
+//   - hdf5: a float64 dataset named dataset
+//   - csv: one value per line
+//   - json: an array of numbers
+//   - raw: little-endian float64s
+func Marshal(format, dataset string, values []float64) ([]byte, error) {
+	var b bytes.Buffer
+	switch format {
+	case "hdf5":
+		return hdf5.Marshal([]hdf5.Dataset{{Name: dataset, Values: values}})
+	case "csv":
+		for _, v := range values {
+			b.WriteString(strconv.FormatFloat(v, 'g', -1, 64))
+			b.WriteByte('\n')
+		}
+	case "json":
+		return json.Marshal(values)
+	case "raw":
+		buf := make([]byte, 8)
+		for _, v := range values {
+			binary.LittleEndian.PutUint64(buf, math.Float64bits(v))
+			b.Write(buf)
+		}
+	default:
+		return nil, CheckFormat(format)
+	}
+	return b.Bytes(), nil
+}
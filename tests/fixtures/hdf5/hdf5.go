@@ -0,0 +1,533 @@
+// Package hdf5 reads and writes the numeric datasets of the small HDF5 files
+// used as fixtures, such as the "stages" target of the fastest data, without
+// cgo.
+//
+// It only supports what h5py writes by default: version 0 and 1 superblocks,
+// groups stored as symbol tables, version 1 object headers, and compact or
+// contiguous datasets of integers or floats. Chunked, compressed, or
+// variable-length datasets are rejected with an error. Written files hold
+// float64 datasets in the root group.
+package hdf5
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io/ioutil"
+	"math"
+	"strings"
+)
+
+var signature = []byte("\x89HDF\r\n\x1a\n")
+
+// Object header message types
+const (
+	msgDataspace    = 0x01
+	msgDatatype     = 0x03
+	msgFillValue    = 0x05
+	msgLayout       = 0x08
+	msgContinuation = 0x10
+	msgSymbolTable  = 0x11
+)
+
+// Datatype classes
+const (
+	classFixedPoint    = 0
+	classFloatingPoint = 1
+)
+
+// File is an HDF5 file loaded in memory
+type File struct {
+	data        []byte
+	sizeOffsets int
+	sizeLengths int
+	root        uint64
+}
+
+// message is an object header message
+type message struct {
+	kind uint16
+	data []byte
+}
+
+// Open reads and parses an HDF5 file
+func Open(path string) (*File, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	f, err := Parse(data)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %s", path, err)
+	}
+	return f, nil
+}
+
+// ReadFloat64s reads a numeric dataset of an HDF5 file, flattened
+func ReadFloat64s(path, dataset string) ([]float64, error) {
+	f, err := Open(path)
+	if err != nil {
+		return nil, err
+	}
+	values, err := f.Float64s(dataset)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %s", path, err)
+	}
+	return values, nil
+}
+
+// Parse parses an HDF5 file. The superblock is looked for at offset 0, then
+// at every power of two from 512, after a user block. Addresses are relative
+// to the superblock.
+func Parse(data []byte) (*File, error) {
+	for base := 0; base+len(signature) <= len(data); base = nextBase(base) {
+		if bytes.Equal(data[base:base+len(signature)], signature) {
+			f := &File{data: data[base:]}
+			return f, f.parseSuperblock()
+		}
+	}
+	return nil, fmt.Errorf("not an HDF5 file")
+}
+
+func nextBase(base int) int {
+	if base == 0 {
+		return 512
+	}
+	return base * 2
+}
+
+func (f *File) parseSuperblock() error {
+	header, err := f.slice(0, 24)
+	if err != nil {
+		return err
+	}
+	version := header[8]
+	if version > 1 {
+		return fmt.Errorf("unsupported superblock version %d", version)
+	}
+	f.sizeOffsets, f.sizeLengths = int(header[13]), int(header[14])
+	if !validSize(f.sizeOffsets) || !validSize(f.sizeLengths) {
+		return fmt.Errorf("invalid sizes of offsets %d and lengths %d", f.sizeOffsets, f.sizeLengths)
+	}
+
+	// Skip the base, free-space, end of file and driver addresses, to the
+	// root group symbol table entry
+	pos := uint64(24)
+	if version == 1 {
+		pos += 4
+	}
+	f.root, _, err = f.symbolTableEntry(pos + uint64(4*f.sizeOffsets))
+	return err
+}
+
+// Float64s reads a numeric dataset, flattened and converted to float64. The
+// dataset is given by its path from the root group, such as "stages" or
+// "group/dataset".
+func (f *File) Float64s(dataset string) ([]float64, error) {
+	address, err := f.lookup(dataset)
+	if err != nil {
+		return nil, err
+	}
+	messages, err := f.objectHeader(address)
+	if err != nil {
+		return nil, err
+	}
+	var dims, layout, datatype []byte
+	for _, m := range messages {
+		switch m.kind {
+		case msgDataspace:
+			dims = m.data
+		case msgLayout:
+			layout = m.data
+		case msgDatatype:
+			datatype = m.data
+		}
+	}
+	if dims == nil || layout == nil || datatype == nil {
+		return nil, fmt.Errorf("%q is not a dataset", dataset)
+	}
+
+	n, err := f.dataspaceSize(dims)
+	if err != nil {
+		return nil, fmt.Errorf("%q: %s", dataset, err)
+	}
+	convert, size, err := converter(datatype)
+	if err != nil {
+		return nil, fmt.Errorf("%q: %s", dataset, err)
+	}
+	raw, err := f.layoutData(layout, n*uint64(size))
+	if err != nil {
+		return nil, fmt.Errorf("%q: %s", dataset, err)
+	}
+
+	values := make([]float64, n)
+	for i := range values {
+		values[i] = convert(raw[i*size : (i+1)*size])
+	}
+	return values, nil
+}
+
+// Has tells whether the file holds a dataset or a group, given by its path
+// from the root group
+func (f *File) Has(dataset string) bool {
+	_, err := f.lookup(dataset)
+	return err == nil
+}
+
+// lookup returns the object header address of a dataset or a group
+func (f *File) lookup(dataset string) (uint64, error) {
+	address := f.root
+	for _, name := range strings.Split(strings.Trim(dataset, "/"), "/") {
+		entries, err := f.group(address)
+		if err != nil {
+			return 0, err
+		}
+		var ok bool
+		if address, ok = entries[name]; !ok {
+			return 0, fmt.Errorf("no dataset %q", dataset)
+		}
+	}
+	return address, nil
+}
+
+// group returns the object header addresses of the members of a group, by
+// name
+func (f *File) group(address uint64) (map[string]uint64, error) {
+	messages, err := f.objectHeader(address)
+	if err != nil {
+		return nil, err
+	}
+	for _, m := range messages {
+		if m.kind != msgSymbolTable {
+			continue
+		}
+		if len(m.data) < 2*f.sizeOffsets {
+			return nil, fmt.Errorf("truncated symbol table message")
+		}
+		btree := decode(m.data[:f.sizeOffsets])
+		heap, err := f.localHeap(decode(m.data[f.sizeOffsets : 2*f.sizeOffsets]))
+		if err != nil {
+			return nil, err
+		}
+		entries := make(map[string]uint64)
+		return entries, f.groupNodes(btree, heap, entries, 0)
+	}
+	return nil, fmt.Errorf("object at %d is not a group", address)
+}
+
+// groupNodes walks a group B-tree, adding the symbols of its leaves to
+// entries
+func (f *File) groupNodes(address uint64, heap []byte, entries map[string]uint64, depth int) error {
+	if depth > 64 {
+		return fmt.Errorf("group B-tree too deep")
+	}
+	header, err := f.slice(address, 8+2*f.sizeOffsets)
+	if err != nil {
+		return err
+	}
+	if string(header[:4]) != "TREE" || header[4] != 0 {
+		return fmt.Errorf("invalid group B-tree node at %d", address)
+	}
+	level := header[5]
+	used := int(binary.LittleEndian.Uint16(header[6:8]))
+
+	// Keys and children are interleaved, starting and ending with a key
+	pos := address + uint64(len(header)) + uint64(f.sizeLengths)
+	for i := 0; i < used; i++ {
+		b, err := f.slice(pos, f.sizeOffsets)
+		if err != nil {
+			return err
+		}
+		child := decode(b)
+		if level > 0 {
+			err = f.groupNodes(child, heap, entries, depth+1)
+		} else {
+			err = f.symbolTableNode(child, heap, entries)
+		}
+		if err != nil {
+			return err
+		}
+		pos += uint64(f.sizeOffsets + f.sizeLengths)
+	}
+	return nil
+}
+
+func (f *File) symbolTableNode(address uint64, heap []byte, entries map[string]uint64) error {
+	header, err := f.slice(address, 8)
+	if err != nil {
+		return err
+	}
+	if string(header[:4]) != "SNOD" {
+		return fmt.Errorf("invalid symbol table node at %d", address)
+	}
+	n := int(binary.LittleEndian.Uint16(header[6:8]))
+	pos := address + 8
+	for i := 0; i < n; i++ {
+		objectHeader, nameOffset, err := f.symbolTableEntry(pos)
+		if err != nil {
+			return err
+		}
+		if nameOffset >= uint64(len(heap)) {
+			return fmt.Errorf("invalid link name offset %d", nameOffset)
+		}
+		name := heap[nameOffset:]
+		if end := bytes.IndexByte(name, 0); end >= 0 {
+			name = name[:end]
+		}
+		entries[string(name)] = objectHeader
+		pos += uint64(2*f.sizeOffsets + 24)
+	}
+	return nil
+}
+
+// symbolTableEntry returns the object header address and the link name
+// offset of a symbol table entry
+func (f *File) symbolTableEntry(pos uint64) (objectHeader, nameOffset uint64, err error) {
+	b, err := f.slice(pos, 2*f.sizeOffsets)
+	if err != nil {
+		return 0, 0, err
+	}
+	return decode(b[f.sizeOffsets:]), decode(b[:f.sizeOffsets]), nil
+}
+
+// localHeap returns the data segment of a local heap
+func (f *File) localHeap(address uint64) ([]byte, error) {
+	header, err := f.slice(address, 8+2*f.sizeLengths+f.sizeOffsets)
+	if err != nil {
+		return nil, err
+	}
+	if string(header[:4]) != "HEAP" {
+		return nil, fmt.Errorf("invalid local heap at %d", address)
+	}
+	size := decode(header[8 : 8+f.sizeLengths])
+	segment := decode(header[8+2*f.sizeLengths:])
+	return f.slice(segment, int(size))
+}
+
+// objectHeader returns the messages of a version 1 object header, following
+// continuation messages
+func (f *File) objectHeader(address uint64) ([]message, error) {
+	header, err := f.slice(address, 16)
+	if err != nil {
+		return nil, err
+	}
+	if header[0] != 1 {
+		return nil, fmt.Errorf("unsupported object header version %d at %d", header[0], address)
+	}
+	remaining := int(binary.LittleEndian.Uint16(header[2:4]))
+
+	type block struct{ pos, size uint64 }
+	blocks := []block{{address + 16, uint64(binary.LittleEndian.Uint32(header[8:12]))}}
+	var messages []message
+	for len(blocks) > 0 && remaining > 0 {
+		if len(blocks) > 1024 {
+			return nil, fmt.Errorf("too many object header continuations at %d", address)
+		}
+		b := blocks[0]
+		blocks = blocks[1:]
+		data, err := f.slice(b.pos, int(b.size))
+		if err != nil {
+			return nil, err
+		}
+		for len(data) >= 8 && remaining > 0 {
+			kind := binary.LittleEndian.Uint16(data[0:2])
+			size := int(binary.LittleEndian.Uint16(data[2:4]))
+			if 8+size > len(data) {
+				return nil, fmt.Errorf("truncated object header message at %d", address)
+			}
+			m := message{kind, data[8 : 8+size]}
+			if kind == msgContinuation {
+				if size < f.sizeOffsets+f.sizeLengths {
+					return nil, fmt.Errorf("truncated continuation message at %d", address)
+				}
+				blocks = append(blocks, block{
+					decode(m.data[:f.sizeOffsets]),
+					decode(m.data[f.sizeOffsets : f.sizeOffsets+f.sizeLengths]),
+				})
+			}
+			messages = append(messages, m)
+			data = data[8+size:]
+			remaining--
+		}
+	}
+	return messages, nil
+}
+
+// dataspaceSize returns the number of elements of a dataspace
+func (f *File) dataspaceSize(b []byte) (uint64, error) {
+	if len(b) < 4 {
+		return 0, fmt.Errorf("truncated dataspace")
+	}
+	version, rank := b[0], int(b[1])
+	var dims []byte
+	switch version {
+	case 1:
+		dims = b[8:]
+	case 2:
+		if b[3] == 2 {
+			return 0, nil // null dataspace
+		}
+		dims = b[4:]
+	default:
+		return 0, fmt.Errorf("unsupported dataspace version %d", version)
+	}
+	if len(dims) < rank*f.sizeLengths {
+		return 0, fmt.Errorf("truncated dataspace")
+	}
+	n := uint64(1)
+	for i := 0; i < rank; i++ {
+		n *= decode(dims[i*f.sizeLengths : (i+1)*f.sizeLengths])
+	}
+	return n, nil
+}
+
+// layoutData returns the raw data of a compact or contiguous dataset
+func (f *File) layoutData(b []byte, size uint64) ([]byte, error) {
+	if len(b) < 2 {
+		return nil, fmt.Errorf("truncated layout")
+	}
+	var class byte
+	var compact []byte
+	var address uint64
+	switch version := b[0]; version {
+	case 1, 2:
+		if len(b) < 8 {
+			return nil, fmt.Errorf("truncated layout")
+		}
+		rank, pos := int(b[1]), 8
+		class = b[2]
+		if class != 0 {
+			if len(b) < pos+f.sizeOffsets {
+				return nil, fmt.Errorf("truncated layout")
+			}
+			address = decode(b[pos : pos+f.sizeOffsets])
+			pos += f.sizeOffsets
+		}
+		pos += 4 * rank
+		if class == 0 {
+			if len(b) < pos+4 {
+				return nil, fmt.Errorf("truncated layout")
+			}
+			n := int(binary.LittleEndian.Uint32(b[pos : pos+4]))
+			if len(b) < pos+4+n {
+				return nil, fmt.Errorf("truncated layout")
+			}
+			compact = b[pos+4 : pos+4+n]
+		}
+	case 3:
+		class = b[1]
+		switch class {
+		case 0:
+			if len(b) < 4 {
+				return nil, fmt.Errorf("truncated layout")
+			}
+			n := int(binary.LittleEndian.Uint16(b[2:4]))
+			if len(b) < 4+n {
+				return nil, fmt.Errorf("truncated layout")
+			}
+			compact = b[4 : 4+n]
+		case 1:
+			if len(b) < 2+f.sizeOffsets {
+				return nil, fmt.Errorf("truncated layout")
+			}
+			address = decode(b[2 : 2+f.sizeOffsets])
+		}
+	default:
+		return nil, fmt.Errorf("unsupported layout version %d", version)
+	}
+
+	switch class {
+	case 0:
+		if uint64(len(compact)) < size {
+			return nil, fmt.Errorf("compact data of %d bytes, expected %d", len(compact), size)
+		}
+		return compact[:size], nil
+	case 1:
+		if address == undefined(f.sizeOffsets) {
+			return nil, fmt.Errorf("dataset was never written")
+		}
+		return f.slice(address, int(size))
+	default:
+		return nil, fmt.Errorf("unsupported layout class %d, only compact and contiguous datasets are supported", class)
+	}
+}
+
+// converter returns the function converting an element of a datatype to
+// float64, and the size of an element
+func converter(b []byte) (func([]byte) float64, int, error) {
+	if len(b) < 8 {
+		return nil, 0, fmt.Errorf("truncated datatype")
+	}
+	class := b[0] & 0x0f
+	bigEndian := b[1]&0x01 != 0
+	size := int(binary.LittleEndian.Uint32(b[4:8]))
+	var order binary.ByteOrder = binary.LittleEndian
+	if bigEndian {
+		order = binary.BigEndian
+	}
+
+	switch class {
+	case classFixedPoint:
+		signed := b[1]&0x08 != 0
+		switch size {
+		case 1:
+			if signed {
+				return func(b []byte) float64 { return float64(int8(b[0])) }, size, nil
+			}
+			return func(b []byte) float64 { return float64(b[0]) }, size, nil
+		case 2:
+			if signed {
+				return func(b []byte) float64 { return float64(int16(order.Uint16(b))) }, size, nil
+			}
+			return func(b []byte) float64 { return float64(order.Uint16(b)) }, size, nil
+		case 4:
+			if signed {
+				return func(b []byte) float64 { return float64(int32(order.Uint32(b))) }, size, nil
+			}
+			return func(b []byte) float64 { return float64(order.Uint32(b)) }, size, nil
+		case 8:
+			if signed {
+				return func(b []byte) float64 { return float64(int64(order.Uint64(b))) }, size, nil
+			}
+			return func(b []byte) float64 { return float64(order.Uint64(b)) }, size, nil
+		}
+	case classFloatingPoint:
+		switch size {
+		case 4:
+			return func(b []byte) float64 { return float64(math.Float32frombits(order.Uint32(b))) }, size, nil
+		case 8:
+			return func(b []byte) float64 { return math.Float64frombits(order.Uint64(b)) }, size, nil
+		}
+	default:
+		return nil, 0, fmt.Errorf("unsupported datatype class %d, only integers and floats are supported", class)
+	}
+	return nil, 0, fmt.Errorf("unsupported datatype size %d", size)
+}
+
+// slice returns n bytes of the file at an address
+func (f *File) slice(address uint64, n int) ([]byte, error) {
+	if n < 0 || address > uint64(len(f.data)) || uint64(n) > uint64(len(f.data))-address {
+		return nil, fmt.Errorf("truncated file: %d bytes at %d", n, address)
+	}
+	return f.data[address : address+uint64(n)], nil
+}
+
+func validSize(size int) bool {
+	return size == 2 || size == 4 || size == 8
+}
+
+// decode decodes a little-endian unsigned integer of 2, 4 or 8 bytes
+func decode(b []byte) uint64 {
+	switch len(b) {
+	case 2:
+		return uint64(binary.LittleEndian.Uint16(b))
+	case 4:
+		return uint64(binary.LittleEndian.Uint32(b))
+	default:
+		return binary.LittleEndian.Uint64(b)
+	}
+}
+
+func undefined(size int) uint64 {
+	return math.MaxUint64 >> uint(64-8*size)
+}
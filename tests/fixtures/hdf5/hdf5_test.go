@@ -0,0 +1,181 @@
+package hdf5
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// testDatasets returns n datasets of some length, named to cross the 8 byte
+// padding of the local heap
+func testDatasets(n, length int) []Dataset {
+	datasets := make([]Dataset, n)
+	for i := range datasets {
+		values := make([]float64, length)
+		for j := range values {
+			values[j] = float64(i) + float64(j)/3
+		}
+		datasets[i] = Dataset{Name: strings.Repeat("d", 6+i) + fmt.Sprint(i), Values: values}
+	}
+	return datasets
+}
+
+func checkDatasets(t *testing.T, name string, f *File, datasets []Dataset) {
+	for _, dataset := range datasets {
+		values, err := f.Float64s(dataset.Name)
+		if err != nil {
+			t.Errorf("%s: %s", name, err)
+			continue
+		}
+		if len(values) != len(dataset.Values) || (len(values) > 0 && !reflect.DeepEqual(values, dataset.Values)) {
+			t.Errorf("%s: dataset %s has %d values, expected %d equal to the written ones", name, dataset.Name, len(values), len(dataset.Values))
+		}
+	}
+	if f.Has("unknown") {
+		t.Errorf("%s: file has an unknown dataset", name)
+	}
+}
+
+func TestRoundTrip(t *testing.T) {
+	// Lengths around the 4096 bytes buffer of a Writer
+	for _, length := range []int{0, 1, 511, 512, 513, 5000} {
+		for _, n := range []int{1, 2, MaxDatasets} {
+			name := fmt.Sprintf("%d dataset(s) of %d values", n, length)
+			datasets := testDatasets(n, length)
+			data, err := Marshal(datasets)
+			if err != nil {
+				t.Fatalf("%s: %s", name, err)
+			}
+			f, err := Parse(data)
+			if err != nil {
+				t.Fatalf("%s: %s", name, err)
+			}
+			checkDatasets(t, name, f, datasets)
+
+			// The streaming Writer writes the same file, with the values in
+			// the order of the dataset names
+			shapes := make([]Shape, n)
+			for i, dataset := range datasets {
+				shapes[i] = Shape{Name: dataset.Name, Len: length}
+			}
+			size, err := FileSize(shapes)
+			if err != nil {
+				t.Fatalf("%s: %s", name, err)
+			}
+			if size != int64(len(data)) {
+				t.Errorf("%s: file size %d, expected %d", name, size, len(data))
+			}
+			var buf bytes.Buffer
+			w, err := NewWriter(&buf, shapes)
+			if err != nil {
+				t.Fatalf("%s: %s", name, err)
+			}
+			for _, dataset := range datasets {
+				if err := w.Write(dataset.Values...); err != nil {
+					t.Fatalf("%s: %s", name, err)
+				}
+			}
+			if err := w.Flush(); err != nil {
+				t.Fatalf("%s: %s", name, err)
+			}
+			if !bytes.Equal(buf.Bytes(), data) {
+				t.Errorf("%s: Writer and Marshal wrote different files", name)
+			}
+		}
+	}
+}
+
+func TestWriteFile(t *testing.T) {
+	dir, err := ioutil.TempDir("", "hdf5")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "file")
+	datasets := []Dataset{{Name: "stages", Values: []float64{1, 0, 1}}, {Name: "EEG1", Values: []float64{4.5, -5, 6}}}
+	if err := WriteFile(path, datasets); err != nil {
+		t.Fatal(err)
+	}
+	for _, dataset := range datasets {
+		values, err := ReadFloat64s(path, dataset.Name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(values, dataset.Values) {
+			t.Errorf("dataset %s is %v, expected %v", dataset.Name, values, dataset.Values)
+		}
+	}
+}
+
+func TestWriteErrors(t *testing.T) {
+	tests := []struct {
+		name   string
+		shapes []Shape
+	}{
+		{"no dataset", nil},
+		{"too many datasets", make([]Shape, MaxDatasets+1)},
+		{"empty name", []Shape{{Name: "", Len: 1}}},
+		{"duplicate name", []Shape{{Name: "a", Len: 1}, {Name: "a", Len: 2}}},
+		{"negative length", []Shape{{Name: "a", Len: -1}}},
+	}
+	for i := range tests[1].shapes {
+		tests[1].shapes[i] = Shape{Name: fmt.Sprint(i), Len: 1}
+	}
+	for _, test := range tests {
+		if _, err := FileSize(test.shapes); err == nil {
+			t.Errorf("%s: no error", test.name)
+		}
+	}
+
+	shapes := []Shape{{Name: "a", Len: 2}}
+	w, err := NewWriter(ioutil.Discard, shapes)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := w.Write(1); err != nil {
+		t.Fatal(err)
+	}
+	if err := w.Flush(); err == nil {
+		t.Error("flushing a missing value succeeded")
+	}
+	w, err = NewWriter(ioutil.Discard, shapes)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := w.Write(1, 2, 3); err == nil {
+		t.Error("writing an extra value succeeded")
+	}
+}
+
+// TestReadH5py reads fixtures written by h5py
+func TestReadH5py(t *testing.T) {
+	tests := []struct {
+		path     string
+		datasets []Dataset
+	}{
+		{"../data_fastest/test/48557ec1-3205-403a-b82c-843fd9b03f5b", []Dataset{
+			{Name: "EEG1", Values: []float64{4, 5, 6}},
+			{Name: "stages", Values: []float64{1, 0, 1}},
+		}},
+		{"../algo/fastest/fixtures/pred/48557ec1-3205-403a-b82c-843fd9b03f5b", []Dataset{
+			{Name: "stages", Values: []float64{0.5946101025672779, 0.9770598144695829, 0.24647506946726216}},
+		}},
+	}
+	for _, test := range tests {
+		f, err := Open(test.path)
+		if err != nil {
+			t.Errorf("%s: %s", test.path, err)
+			continue
+		}
+		checkDatasets(t, test.path, f, test.datasets)
+	}
+	if _, err := ReadFloat64s(tests[1].path, "EEG1"); err == nil {
+		t.Error("reading a missing dataset succeeded")
+	}
+}
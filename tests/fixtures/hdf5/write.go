@@ -0,0 +1,307 @@
+package hdf5
+
+import (
+	"bufio"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math"
+	"sort"
+)
+
+// Layout of the files written by Marshal, with the B-tree and symbol table
+// node sizes h5py uses by default (group leaf K=4, internal K=16)
+const (
+	groupLeafK     = 4
+	groupInternalK = 16
+
+	superblockSize   = 0x60
+	rootHeaderSize   = 40
+	btreeSize        = 24 + (2*groupInternalK+1)*8 + 2*groupInternalK*8
+	heapHeaderSize   = 32
+	snodSize         = 8 + 2*groupLeafK*40
+	datasetHeaderLen = 16 + (8 + 24) + (8 + 24) + (8 + 8) + (8 + 24)
+
+	// heapFreeNull is the free list offset of a local heap without free
+	// space
+	heapFreeNull = 1
+
+	// msgConstant flags the object header messages that never change
+	msgConstant = 0x01
+)
+
+// MaxDatasets is the maximum number of datasets Marshal can write, all in a
+// single symbol table node
+const MaxDatasets = 2 * groupLeafK
+
+// Dataset is a one-dimensional dataset of float64 to write
+type Dataset struct {
+	Name   string
+	Values []float64
+}
+
+// WriteFile writes datasets as an HDF5 file
+func WriteFile(path string, datasets []Dataset) error {
+	data, err := Marshal(datasets)
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(path, data, 0644)
+}
+
+// Marshal encodes datasets as an HDF5 file, in the layout h5py writes: a
+// version 0 superblock, and a root group holding up to MaxDatasets
+// contiguous little-endian float64 datasets.
+func Marshal(datasets []Dataset) ([]byte, error) {
+	shapes := make([]Shape, len(datasets))
+	for i, dataset := range datasets {
+		shapes[i] = Shape{Name: dataset.Name, Len: len(dataset.Values)}
+	}
+	l, err := newLayout(shapes)
+	if err != nil {
+		return nil, err
+	}
+	b := make([]byte, l.eof)
+	copy(b, l.header)
+	for i, shape := range l.shapes {
+		for _, dataset := range datasets {
+			if dataset.Name != shape.Name {
+				continue
+			}
+			for j, v := range dataset.Values {
+				putUint64(b, l.data[i]+uint64(8*j), math.Float64bits(v))
+			}
+		}
+	}
+	return b, nil
+}
+
+// Shape is the name and the length of a dataset, to write its values with a
+// Writer
+type Shape struct {
+	Name string
+	Len  int
+}
+
+// FileSize returns the size of the file holding datasets of some shapes
+func FileSize(shapes []Shape) (int64, error) {
+	l, err := newLayout(shapes)
+	if err != nil {
+		return 0, err
+	}
+	return int64(l.eof), nil
+}
+
+// Writer streams an HDF5 file in the layout of Marshal, so that the values
+// of large datasets need not be held in memory. The values are written
+// dataset by dataset, in the order of their names.
+type Writer struct {
+	w      *bufio.Writer
+	layout *layout
+	// dataset is the index of the dataset being written, and written the
+	// number of its values written so far
+	dataset int
+	written int
+	buf     [8]byte
+}
+
+// NewWriter writes the header of a file holding datasets of some shapes to w
+func NewWriter(w io.Writer, shapes []Shape) (*Writer, error) {
+	l, err := newLayout(shapes)
+	if err != nil {
+		return nil, err
+	}
+	writer := &Writer{w: bufio.NewWriter(w), layout: l}
+	if _, err := writer.w.Write(l.header); err != nil {
+		return nil, err
+	}
+	return writer, nil
+}
+
+// Write writes the next values of the file
+func (w *Writer) Write(values ...float64) error {
+	for _, v := range values {
+		for w.dataset < len(w.layout.shapes) && w.written == w.layout.shapes[w.dataset].Len {
+			w.dataset, w.written = w.dataset+1, 0
+		}
+		if w.dataset == len(w.layout.shapes) {
+			return fmt.Errorf("too many values for the datasets of the file")
+		}
+		binary.LittleEndian.PutUint64(w.buf[:], math.Float64bits(v))
+		if _, err := w.w.Write(w.buf[:]); err != nil {
+			return err
+		}
+		w.written++
+	}
+	return nil
+}
+
+// Flush checks all the values were written, and flushes them to the
+// underlying writer
+func (w *Writer) Flush() error {
+	for ; w.dataset < len(w.layout.shapes); w.dataset, w.written = w.dataset+1, 0 {
+		if shape := w.layout.shapes[w.dataset]; w.written < shape.Len {
+			return fmt.Errorf("dataset %s has %d values, expected %d", shape.Name, w.written, shape.Len)
+		}
+	}
+	return w.w.Flush()
+}
+
+// layout is the structure of a file: everything but the values of the
+// datasets, which come after the header, in the order of shapes
+type layout struct {
+	shapes []Shape
+	header []byte
+	// data are the addresses of the values of the datasets
+	data []uint64
+	eof  uint64
+}
+
+// newLayout builds the layout of a file holding datasets of some shapes
+func newLayout(shapes []Shape) (*layout, error) {
+	if len(shapes) == 0 || len(shapes) > MaxDatasets {
+		return nil, fmt.Errorf("cannot write %d datasets, should be 1 to %d", len(shapes), MaxDatasets)
+	}
+	// Symbol table entries must be sorted by name
+	sorted := append([]Shape(nil), shapes...)
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i].Name < sorted[j].Name })
+
+	// Local heap of the link names, starting with the empty string
+	heap := make([]byte, 8)
+	nameOffsets := make([]uint64, len(sorted))
+	for i, shape := range sorted {
+		if shape.Name == "" || (i > 0 && shape.Name == sorted[i-1].Name) {
+			return nil, fmt.Errorf("invalid or duplicate dataset name %q", shape.Name)
+		}
+		if shape.Len < 0 {
+			return nil, fmt.Errorf("invalid length %d of dataset %s", shape.Len, shape.Name)
+		}
+		nameOffsets[i] = uint64(len(heap))
+		heap = append(heap, shape.Name...)
+		heap = append(heap, make([]byte, 8-len(shape.Name)%8)...)
+	}
+
+	// Addresses
+	rootHeader := uint64(superblockSize)
+	btree := rootHeader + rootHeaderSize
+	heapHeader := btree + btreeSize
+	heapData := heapHeader + heapHeaderSize
+	snod := heapData + uint64(len(heap))
+	headers := snod + snodSize
+	l := &layout{shapes: sorted, data: make([]uint64, len(sorted))}
+	l.eof = headers + uint64(len(sorted)*datasetHeaderLen)
+	for i, shape := range sorted {
+		l.data[i] = l.eof
+		l.eof += uint64(8 * shape.Len)
+	}
+
+	b := make([]byte, headers+uint64(len(sorted)*datasetHeaderLen))
+
+	// Superblock and root group symbol table entry
+	copy(b, signature)
+	b[13], b[14] = 8, 8
+	binary.LittleEndian.PutUint16(b[16:], groupLeafK)
+	binary.LittleEndian.PutUint16(b[18:], groupInternalK)
+	putUint64(b, 24, 0)
+	putUint64(b, 32, math.MaxUint64)
+	putUint64(b, 40, l.eof)
+	putUint64(b, 48, math.MaxUint64)
+	putSymbolTableEntry(b, 56, 0, rootHeader, 1)
+	putUint64(b, 56+24, btree)
+	putUint64(b, 56+32, heapHeader)
+
+	// Root group object header, with its symbol table message
+	putObjectHeader(b, rootHeader, 1, rootHeaderSize)
+	pos := putMessageHeader(b, rootHeader+16, msgSymbolTable, 16, 0)
+	putUint64(b, pos, btree)
+	putUint64(b, pos+8, heapHeader)
+
+	// Group B-tree, with a single leaf
+	copy(b[btree:], "TREE")
+	binary.LittleEndian.PutUint16(b[btree+6:], 1)
+	putUint64(b, btree+8, math.MaxUint64)
+	putUint64(b, btree+16, math.MaxUint64)
+	putUint64(b, btree+24, 0)
+	putUint64(b, btree+32, snod)
+	putUint64(b, btree+40, nameOffsets[len(nameOffsets)-1])
+
+	// Local heap
+	copy(b[heapHeader:], "HEAP")
+	putUint64(b, heapHeader+8, uint64(len(heap)))
+	putUint64(b, heapHeader+16, heapFreeNull)
+	putUint64(b, heapHeader+24, heapData)
+	copy(b[heapData:], heap)
+
+	// Symbol table node, then the dataset headers
+	copy(b[snod:], "SNOD")
+	b[snod+4] = 1
+	binary.LittleEndian.PutUint16(b[snod+6:], uint16(len(sorted)))
+	for i, shape := range sorted {
+		header := headers + uint64(i*datasetHeaderLen)
+		putSymbolTableEntry(b, snod+8+uint64(i*40), nameOffsets[i], header, 0)
+		putDataset(b, header, l.data[i], shape.Len)
+	}
+	l.header = b
+	return l, nil
+}
+
+// putDataset writes the object header of a dataset of length n, whose
+// values are at address
+func putDataset(b []byte, header, address uint64, length int) {
+	putObjectHeader(b, header, 4, datasetHeaderLen)
+	n := uint64(length)
+
+	// Dataspace: one dimension, with its maximum size
+	pos := putMessageHeader(b, header+16, msgDataspace, 24, 0)
+	b[pos], b[pos+1], b[pos+2] = 1, 1, 1
+	putUint64(b, pos+8, n)
+	putUint64(b, pos+16, n)
+
+	// Datatype: IEEE 754 little-endian double
+	pos = putMessageHeader(b, pos+24, msgDatatype, 24, msgConstant)
+	b[pos] = 0x10 | classFloatingPoint
+	b[pos+1], b[pos+2] = 0x20, 63
+	binary.LittleEndian.PutUint32(b[pos+4:], 8)
+	binary.LittleEndian.PutUint16(b[pos+10:], 64)
+	b[pos+12], b[pos+13], b[pos+15] = 52, 11, 52
+	binary.LittleEndian.PutUint32(b[pos+16:], 1023)
+
+	// Fill value, never written
+	pos = putMessageHeader(b, pos+24, msgFillValue, 8, msgConstant)
+	b[pos], b[pos+1], b[pos+2], b[pos+3] = 2, 2, 2, 1
+
+	// Contiguous layout
+	pos = putMessageHeader(b, pos+8, msgLayout, 24, 0)
+	b[pos], b[pos+1] = 3, 1
+	putUint64(b, pos+2, address)
+	putUint64(b, pos+10, 8*n)
+}
+
+// putObjectHeader writes the prefix of a version 1 object header of a given
+// total size
+func putObjectHeader(b []byte, address uint64, messages, size int) {
+	b[address] = 1
+	binary.LittleEndian.PutUint16(b[address+2:], uint16(messages))
+	binary.LittleEndian.PutUint32(b[address+4:], 1)
+	binary.LittleEndian.PutUint32(b[address+8:], uint32(size-16))
+}
+
+// putMessageHeader writes the header of an object header message, and
+// returns the address of its data
+func putMessageHeader(b []byte, address uint64, kind uint16, size int, flags byte) uint64 {
+	binary.LittleEndian.PutUint16(b[address:], kind)
+	binary.LittleEndian.PutUint16(b[address+2:], uint16(size))
+	b[address+4] = flags
+	return address + 8
+}
+
+func putSymbolTableEntry(b []byte, address, nameOffset, objectHeader uint64, cacheType uint32) {
+	putUint64(b, address, nameOffset)
+	putUint64(b, address+8, objectHeader)
+	binary.LittleEndian.PutUint32(b[address+16:], cacheType)
+}
+
+func putUint64(b []byte, address, v uint64) {
+	binary.LittleEndian.PutUint64(b[address:], v)
+}
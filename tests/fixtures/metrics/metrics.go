@@ -0,0 +1,165 @@
+// Package metrics computes the performance of predictions against true
+// values, for the problem fixtures and for the checks of the integration
+// tests. Metrics are registered by name, so that problems can select them at
+// run time.
+package metrics
+
+import (
+	"fmt"
+	"math"
+	"sort"
+)
+
+// epsilon bounds the probabilities of LogLoss away from 0 and 1
+const epsilon = 1e-15
+
+// MAE returns the mean absolute error of the predictions, like metric() in
+// problem_pytest.py
+func MAE(yTrue, yPred []float64) (float64, error) {
+	if err := checkLengths(yTrue, yPred); err != nil {
+		return 0, err
+	}
+	sum := 0.
+	for i := range yTrue {
+		sum += math.Abs(yPred[i] - yTrue[i])
+	}
+	return sum / float64(len(yTrue)), nil
+}
+
+// Accuracy returns the fraction of predictions that, rounded to the nearest
+// integer, equal the true label
+func Accuracy(yTrue, yPred []float64) (float64, error) {
+	if err := checkLengths(yTrue, yPred); err != nil {
+		return 0, err
+	}
+	correct := 0
+	for i := range yTrue {
+		if math.Floor(yPred[i]+0.5) == yTrue[i] {
+			correct++
+		}
+	}
+	return float64(correct) / float64(len(yTrue)), nil
+}
+
+// RMSE returns the root mean squared error of the predictions
+func RMSE(yTrue, yPred []float64) (float64, error) {
+	if err := checkLengths(yTrue, yPred); err != nil {
+		return 0, err
+	}
+	sum := 0.
+	for i := range yTrue {
+		sum += (yPred[i] - yTrue[i]) * (yPred[i] - yTrue[i])
+	}
+	return math.Sqrt(sum / float64(len(yTrue))), nil
+}
+
+// MacroF1 returns the F1 score of each label, averaged over the labels of the
+// true values and of the predictions rounded to the nearest integer
+func MacroF1(yTrue, yPred []float64) (float64, error) {
+	if err := checkLengths(yTrue, yPred); err != nil {
+		return 0, err
+	}
+	truePositives := make(map[float64]int)
+	falsePositives := make(map[float64]int)
+	falseNegatives := make(map[float64]int)
+	labels := make(map[float64]bool)
+	for i := range yTrue {
+		label, predicted := yTrue[i], math.Floor(yPred[i]+0.5)
+		labels[label], labels[predicted] = true, true
+		if label == predicted {
+			truePositives[label]++
+		} else {
+			falsePositives[predicted]++
+			falseNegatives[label]++
+		}
+	}
+	sum := 0.
+	for label := range labels {
+		if denominator := 2*truePositives[label] + falsePositives[label] + falseNegatives[label]; denominator > 0 {
+			sum += 2 * float64(truePositives[label]) / float64(denominator)
+		}
+	}
+	return sum / float64(len(labels)), nil
+}
+
+// LogLoss returns the binary cross-entropy of the predictions, which are the
+// probabilities of label 1. True values must be 0 or 1.
+func LogLoss(yTrue, yPred []float64) (float64, error) {
+	if err := checkBinary(yTrue, yPred); err != nil {
+		return 0, err
+	}
+	sum := 0.
+	for i := range yTrue {
+		p := math.Min(math.Max(yPred[i], epsilon), 1-epsilon)
+		if yTrue[i] == 1 {
+			sum -= math.Log(p)
+		} else {
+			sum -= math.Log(1 - p)
+		}
+	}
+	return sum / float64(len(yTrue)), nil
+}
+
+// ROCAUC returns the area under the ROC curve of the predictions, which are
+// the scores of label 1. True values must be 0 or 1, with both labels
+// present. Tied scores count as half.
+func ROCAUC(yTrue, yPred []float64) (float64, error) {
+	if err := checkBinary(yTrue, yPred); err != nil {
+		return 0, err
+	}
+
+	// Rank the predictions, tied ones getting their average rank
+	order := make([]int, len(yPred))
+	for i := range order {
+		order[i] = i
+	}
+	sort.SliceStable(order, func(a, b int) bool { return yPred[order[a]] < yPred[order[b]] })
+	ranks := make([]float64, len(yPred))
+	for i := 0; i < len(order); {
+		j := i
+		for j < len(order) && yPred[order[j]] == yPred[order[i]] {
+			j++
+		}
+		for k := i; k < j; k++ {
+			ranks[order[k]] = float64(i+j+1) / 2
+		}
+		i = j
+	}
+
+	// Mann-Whitney U statistic of the positives
+	positives, sumRanks := 0, 0.
+	for i, label := range yTrue {
+		if label == 1 {
+			positives++
+			sumRanks += ranks[i]
+		}
+	}
+	negatives := len(yTrue) - positives
+	if positives == 0 || negatives == 0 {
+		return 0, fmt.Errorf("ROC AUC is undefined with a single label")
+	}
+	u := sumRanks - float64(positives*(positives+1))/2
+	return u / float64(positives*negatives), nil
+}
+
+func checkBinary(yTrue, yPred []float64) error {
+	if err := checkLengths(yTrue, yPred); err != nil {
+		return err
+	}
+	for _, label := range yTrue {
+		if label != 0 && label != 1 {
+			return fmt.Errorf("label %v is not binary", label)
+		}
+	}
+	return nil
+}
+
+func checkLengths(yTrue, yPred []float64) error {
+	if len(yTrue) == 0 {
+		return fmt.Errorf("no true values")
+	}
+	if len(yTrue) != len(yPred) {
+		return fmt.Errorf("%d true values but %d predictions", len(yTrue), len(yPred))
+	}
+	return nil
+}
@@ -0,0 +1,136 @@
+package metrics
+
+import (
+	"math"
+	"testing"
+)
+
+// tolerance absorbs the rounding of the expected values
+const tolerance = 1e-9
+
+func TestMetrics(t *testing.T) {
+	tests := []struct {
+		metric   string
+		yTrue    []float64
+		yPred    []float64
+		expected float64
+		valid    bool
+	}{
+		{"mae", []float64{1, 2, 3}, []float64{2, 2, 5}, 1, true},
+		{"mae", []float64{1, 2}, []float64{1, 2}, 0, true},
+
+		{"rmse", []float64{1, 2, 3}, []float64{2, 2, 5}, math.Sqrt(5. / 3), true},
+		{"rmse", []float64{-1}, []float64{2}, 3, true},
+
+		{"accuracy", []float64{0, 1, 2, 1}, []float64{0.4, 0.5, 2.6, 1.2}, 0.75, true},
+		{"accuracy", []float64{3}, []float64{0}, 0, true},
+
+		{"macro-f1", []float64{0, 0, 1, 1}, []float64{0, 1, 1, 1}, (2./3 + 0.8) / 2, true},
+		// A single class, predicted right or not
+		{"macro-f1", []float64{1, 1}, []float64{1, 1}, 1, true},
+		{"macro-f1", []float64{1, 1}, []float64{0, 1}, 1. / 3, true},
+
+		{"log-loss", []float64{1, 0}, []float64{0.5, 0.5}, math.Log(2), true},
+		// Probabilities of 0 and 1 are bounded by epsilon, 1-epsilon being
+		// rounded to a float64
+		{"log-loss", []float64{1, 0}, []float64{1, 0}, 0, true},
+		{"log-loss", []float64{1}, []float64{0}, -math.Log(epsilon), true},
+		{"log-loss", []float64{0}, []float64{1}, -math.Log(1 - float64(1-epsilon)), true},
+		{"log-loss", []float64{2}, []float64{0.5}, 0, false},
+
+		{"roc-auc", []float64{0, 0, 1, 1}, []float64{0.1, 0.4, 0.35, 0.8}, 0.75, true},
+		{"roc-auc", []float64{0, 1}, []float64{0.9, 0.1}, 0, true},
+		// Ties count as half
+		{"roc-auc", []float64{0, 1}, []float64{0.5, 0.5}, 0.5, true},
+		{"roc-auc", []float64{0, 0, 1, 1}, []float64{0.1, 0.5, 0.5, 0.9}, 0.875, true},
+		{"roc-auc", []float64{1, 1}, []float64{0.2, 0.8}, 0, false},
+		{"roc-auc", []float64{0, 2}, []float64{0.2, 0.8}, 0, false},
+	}
+	for _, test := range tests {
+		m, err := Get(test.metric)
+		if err != nil {
+			t.Fatal(err)
+		}
+		score, err := m.Score(test.yTrue, test.yPred)
+		if (err == nil) != test.valid {
+			t.Errorf("%s(%v, %v): error %v, expected valid %t", test.metric, test.yTrue, test.yPred, err, test.valid)
+			continue
+		}
+		if err == nil && math.Abs(score-test.expected) > tolerance {
+			t.Errorf("%s(%v, %v) is %v, expected %v", test.metric, test.yTrue, test.yPred, score, test.expected)
+		}
+	}
+}
+
+func TestMetricsLengths(t *testing.T) {
+	for _, name := range Names() {
+		m, _ := Get(name)
+		if _, err := m.Score([]float64{0, 1}, []float64{1}); err == nil {
+			t.Errorf("%s: no error with 2 true values and 1 prediction", name)
+		}
+		if _, err := m.Score(nil, nil); err == nil {
+			t.Errorf("%s: no error without any value", name)
+		}
+	}
+}
+
+func TestParseComposite(t *testing.T) {
+	tests := []struct {
+		names    []string
+		expected string
+		valid    bool
+	}{
+		{[]string{"accuracy"}, "accuracy", true},
+		{[]string{"mae", " accuracy", "rmse "}, "mae,accuracy,rmse", true},
+		{nil, "", false},
+		{[]string{"accuracy", "accuracy"}, "", false},
+		{[]string{"accuracy", "unknown"}, "", false},
+	}
+	for _, test := range tests {
+		c, err := ParseComposite(test.names)
+		if (err == nil) != test.valid {
+			t.Errorf("ParseComposite(%q): error %v, expected valid %t", test.names, err, test.valid)
+			continue
+		}
+		if err == nil && c.String() != test.expected {
+			t.Errorf("ParseComposite(%q) is %s, expected %s", test.names, c, test.expected)
+		}
+	}
+}
+
+func TestCompositeScore(t *testing.T) {
+	yTrue := []float64{0, 1, 2, 1}
+	better := []float64{0, 1, 2, 2}
+	worse := []float64{1, 2, 0, 0}
+
+	tests := []struct {
+		names []string
+		// perf of better, and the extra of better
+		perf, extra float64
+	}{
+		{[]string{"accuracy", "mae"}, 0.75, 0.25},
+		// Lower is better for the MAE, reported negated as the perf but not
+		// as an extra
+		{[]string{"mae", "accuracy"}, -0.25, 0.75},
+	}
+	for _, test := range tests {
+		c, err := ParseComposite(test.names)
+		if err != nil {
+			t.Fatal(err)
+		}
+		perf, extras, err := c.Score(yTrue, better)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if math.Abs(perf-test.perf) > tolerance || math.Abs(extras[test.names[1]]-test.extra) > tolerance {
+			t.Errorf("%s: perf %v and %s %v, expected %v and %v", c, perf, test.names[1], extras[test.names[1]], test.perf, test.extra)
+		}
+		worsePerf, err := c.Perf(yTrue, worse)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if worsePerf >= perf {
+			t.Errorf("%s: worse predictions have perf %v, not below %v", c, worsePerf, perf)
+		}
+	}
+}
@@ -0,0 +1,136 @@
+package metrics
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// Metric is a named scoring rule
+type Metric struct {
+	Name           string
+	Description    string
+	HigherIsBetter bool
+	Score          func(yTrue, yPred []float64) (float64, error)
+}
+
+var registry = make(map[string]Metric)
+
+func init() {
+	Register(Metric{"mae", "Mean absolute error", false, MAE})
+	Register(Metric{"rmse", "Root mean squared error", false, RMSE})
+	Register(Metric{"accuracy", "Fraction of predictions equal to the label once rounded", true, Accuracy})
+	Register(Metric{"macro-f1", "F1 score averaged over the labels, predictions being rounded", true, MacroF1})
+	Register(Metric{"log-loss", "Binary cross-entropy, predictions being probabilities of label 1", false, LogLoss})
+	Register(Metric{"roc-auc", "Area under the ROC curve, predictions being scores of label 1", true, ROCAUC})
+}
+
+// Register adds a metric to the registry, replacing any metric with the
+// same name
+func Register(m Metric) {
+	registry[m.Name] = m
+}
+
+// Get returns a registered metric by name
+func Get(name string) (Metric, error) {
+	m, ok := registry[name]
+	if !ok {
+		return Metric{}, fmt.Errorf("unknown metric %q, should be one of %s", name, strings.Join(Names(), ", "))
+	}
+	return m, nil
+}
+
+// Names returns the names of the registered metrics, sorted
+func Names() []string {
+	var names []string
+	for name := range registry {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// Usage describes the registered metrics, one per line
+func Usage() string {
+	var lines []string
+	for _, name := range Names() {
+		m := registry[name]
+		direction := "lower is better"
+		if m.HigherIsBetter {
+			direction = "higher is better"
+		}
+		lines = append(lines, fmt.Sprintf("  %-10s %s (%s)", m.Name, m.Description, direction))
+	}
+	return strings.Join(lines, "\n")
+}
+
+// Composite is a list of metrics: the headline metric is reported as the
+// perf, the others as extras. The orchestrator keeps the model with the
+// highest perf, so a headline metric where lower is better is reported
+// negated.
+type Composite struct {
+	Headline Metric
+	Extras   []Metric
+}
+
+// ParseComposite builds a Composite from metric names, the first one being
+// the headline
+func ParseComposite(names []string) (*Composite, error) {
+	if len(names) == 0 {
+		return nil, fmt.Errorf("no metric")
+	}
+	c := &Composite{}
+	seen := make(map[string]bool)
+	for i, name := range names {
+		name = strings.TrimSpace(name)
+		if seen[name] {
+			return nil, fmt.Errorf("duplicate metric %q", name)
+		}
+		seen[name] = true
+		m, err := Get(name)
+		if err != nil {
+			return nil, err
+		}
+		if i == 0 {
+			c.Headline = m
+		} else {
+			c.Extras = append(c.Extras, m)
+		}
+	}
+	return c, nil
+}
+
+// Perf computes the headline metric, negated if lower is better
+func (c *Composite) Perf(yTrue, yPred []float64) (float64, error) {
+	perf, err := c.Headline.Score(yTrue, yPred)
+	if err != nil {
+		return 0, fmt.Errorf("%s: %s", c.Headline.Name, err)
+	}
+	if !c.Headline.HigherIsBetter {
+		perf = -perf
+	}
+	return perf, nil
+}
+
+// Score computes the perf and the extras. The extras are not negated.
+func (c *Composite) Score(yTrue, yPred []float64) (perf float64, extras map[string]float64, err error) {
+	if perf, err = c.Perf(yTrue, yPred); err != nil {
+		return 0, nil, err
+	}
+	extras = make(map[string]float64)
+	for _, m := range c.Extras {
+		if extras[m.Name], err = m.Score(yTrue, yPred); err != nil {
+			return 0, nil, fmt.Errorf("%s: %s", m.Name, err)
+		}
+	}
+	return perf, extras, nil
+}
+
+// String returns the names of the metrics, comma-separated
+func (c *Composite) String() string {
+	names := []string{c.Headline.Name}
+	for _, m := range c.Extras {
+		names = append(names, m.Name)
+	}
+	return strings.Join(names, ",")
+}
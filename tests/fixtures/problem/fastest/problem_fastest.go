@@ -1,52 +1,92 @@
 package main
 
 import (
-	"crypto/md5"
 	"encoding/json"
 	"flag"
 	"fmt"
 	"io"
 	"io/ioutil"
 	"log"
-	"math/rand"
 	"os"
 	"path/filepath"
-	"time"
+	"strings"
+
+	"github.com/MorpheoOrg/morpheo-devenv/tests/fixtures/checksums"
+	"github.com/MorpheoOrg/morpheo-devenv/tests/fixtures/hdf5"
+	"github.com/MorpheoOrg/morpheo-devenv/tests/fixtures/metrics"
+	"github.com/MorpheoOrg/morpheo-devenv/tests/fixtures/scripted"
 )
 
 var (
-	validHashData = map[string]string{
-		"7182575d2f1fe035c0ce8cea70f93cd7": "af7fcc0f-7a58-4a74-bfa2-8fb6e12008eb",
-		"86564dc69f8c9b081b5174ef562e1ac1": "8bc11648-d983-4a62-9ea2-590901f374ff",
-		"f09058c9de0b55d482f8575f8e8e7628": "48557ec1-3205-403a-b82c-843fd9b03f5b",
-		"ca7a7b23a4d5cb655df97378e571f7c6": "cbddd90c-f574-43d9-8d1f-b4989678a09b",
-		// Detargeted Files
-		"41b26abe9fd63ea31a8ea325bb9fb47c": "48557ec1-3205-403a-b82c-843fd9b03f5b",
-		"de5a7197e3e61c7987d3a64731608187": "cbddd90c-f574-43d9-8d1f-b4989678a09b",
-		// Pred files
-		"3b38668b9e0d1a8931e57d01235de01d": "48557ec1-3205-403a-b82c-843fd9b03f5b",
-		"7be08f2103cc61f50eb485dd5c7ef0df": "8bc11648-d983-4a62-9ea2-590901f374ff",
-		"a479fb72d25cff24112328433e39915f": "af7fcc0f-7a58-4a74-bfa2-8fb6e12008eb",
-		"63f9156ec639f5384c069fe3c7807429": "cbddd90c-f574-43d9-8d1f-b4989678a09b",
-	}
-	pathFixturesUntargeted = "/fixtures/untargetedTest"
-	pathPerf               string
+	// validChecksums holds the checksums of the valid data files, and of the
+	// fixture files they map to
+	validChecksums         *checksums.Manifest
+	pathFixtures           = "/fixtures"
+	pathFixturesUntargeted string
+
+	// target is the dataset of the data files holding the target, and
+	// scoring computes the perf. Both are set by the problem manifest, and
+	// scoring by -m.
+	target  string
+	scoring *metrics.Composite
 )
 
-// Perfuplet describes the performance.json file, an output of learning tasks
+// Manifest describes the problem.json file of the fixtures, defining how
+// predictions are scored
+type Manifest struct {
+	// Target is the dataset of the data files holding the target
+	Target string `json:"target"`
+	// Metrics are the names of the metrics, the first one being the perf
+	Metrics []string `json:"metrics"`
+}
+
+// defaultManifest is used when the fixtures have no problem.json
+var defaultManifest = Manifest{
+	Target:  "stages",
+	Metrics: []string{"accuracy", "mae"},
+}
+
+// Perfuplet describes the performance.json file, an output of learning tasks.
+// Perf is the headline metric on all the test files, negated if lower is
+// better, TrainPerf and TestPerf the same on each file. Extras holds the
+// other metrics on all the test files.
 type Perfuplet struct {
 	Perf      float64            `json:"perf"`
 	TrainPerf map[string]float64 `json:"train_perf"`
 	TestPerf  map[string]float64 `json:"test_perf"`
+	Extras    map[string]float64 `json:"extras,omitempty"`
 }
 
 func main() {
 	// Parse args -T detarget/perf -i /hidden_path -s /submission_path
-	var task, hiddenPath, submissionPath string
+	var task, hiddenPath, submissionPath, metricNames, pathManifest, pathChecksums string
 	flag.StringVar(&task, "T", "", "task: detarget/perf")
 	flag.StringVar(&hiddenPath, "i", "", "hidden_path")
 	flag.StringVar(&submissionPath, "s", "", "submission_path")
+	flag.StringVar(&pathFixtures, "fixtures", pathFixtures, "fixtures directory")
+	flag.StringVar(&metricNames, "m", "", "comma-separated metrics, the first one being reported as perf and the others as extras (default: the metrics of the manifest)")
+	flag.StringVar(&pathManifest, "manifest", "", "problem manifest (default: <fixtures>/problem.json, if it exists)")
+	flag.StringVar(&pathChecksums, "checksums", "", "checksum manifest of the fixtures (default: <hidden_path>/"+checksums.FileName+" if it exists, else <fixtures>/"+checksums.FileName+")")
+	flag.Usage = func() {
+		fmt.Fprintf(os.Stderr, "Usage of %s:\n", os.Args[0])
+		flag.PrintDefaults()
+		fmt.Fprintf(os.Stderr, "\nMetrics:\n%s\n", metrics.Usage())
+	}
 	flag.Parse()
+	pathFixturesUntargeted = filepath.Join(pathFixtures, "untargetedTest")
+
+	// Load the scoring rules
+	if pathManifest == "" {
+		pathManifest = filepath.Join(pathFixtures, "problem.json")
+	}
+	manifest, err := loadManifest(pathManifest)
+	check(err, "Invalid problem manifest")
+	if metricNames != "" {
+		manifest.Metrics = strings.Split(metricNames, ",")
+	}
+	target = manifest.Target
+	scoring, err = metrics.ParseComposite(manifest.Metrics)
+	check(err, "Invalid metrics")
 
 	// Check args are properly set
 	if (task != "detarget" && task != "perf") || hiddenPath == "" || submissionPath == "" {
@@ -54,6 +94,15 @@ func main() {
 	}
 	log.Printf("Starting task '%s' with hidden_path '%s' and submission_path '%s'...", task, hiddenPath, submissionPath)
 
+	// Load the checksums of the fixtures
+	if pathChecksums == "" {
+		validChecksums, pathChecksums, err = checksums.Load(filepath.Join(hiddenPath, checksums.FileName), filepath.Join(pathFixtures, checksums.FileName))
+	} else {
+		validChecksums, err = checksums.Read(pathChecksums)
+	}
+	check(err, "Invalid checksum manifest")
+	log.Printf("Loaded %d checksums from %s", len(validChecksums.Entries), pathChecksums)
+
 	// Setup directory structures
 	dir_true_test_files := filepath.Join(hiddenPath, "/test/")
 	dir_detargeted_test_files := filepath.Join(submissionPath, "/test/")
@@ -93,8 +142,8 @@ func detarget(prevDir, newDir string) {
 		}
 		data, err := ioutil.ReadFile(filepath.Join(prevDir, f.Name()))
 		check(err, "")
-		checksum := fmt.Sprintf("%x", md5.Sum(data))
-		fName, ok := validHashData[checksum]
+		checksum := checksums.Sum(data)
+		fName, ok := validChecksums.Lookup(checksum)
 		if !ok {
 			log.Fatalf("[FATAL ERROR] Invalid checksum for file %s (%s)", f.Name(), checksum)
 		}
@@ -116,25 +165,26 @@ func perf(dirTest, dirTrain, dirTestPred, dirTrainPred, dirPerf, filePerf string
 			len(testFiles), len(testPredFiles), len(trainFiles), len(trainPredFiles))
 	}
 
-	// Generate performance
-	rand.Seed(time.Now().Unix())
+	// Compute performance on each file, and on all the test files
+	testPerf, testTrue, testPred := computePerfFiles(dirTest, dirTestPred, testFiles)
+	trainPerf, _, _ := computePerfFiles(dirTrain, dirTrainPred, trainFiles)
+	perf, extras, err := scoring.Score(testTrue, testPred)
+	check(err, "[SCRIPT ERROR] Failed to compute perf on test files")
+	log.Printf("[perf] %s: %f, extras: %v", scoring.Headline.Name, perf, extras)
 
-	testPerf := make(map[string]float64)
-	trainPerf := make(map[string]float64)
-	for _, f := range testPredFiles {
-		testPerf[f.Name()] = rand.Float64()
-		log.Printf("[perf] Computed perf on %s", f.Name())
-	}
-	for _, f := range trainPredFiles {
-		trainPerf[f.Name()] = rand.Float64()
-		log.Printf("[perf] Computed perf on %s", f.Name())
+	// Scripted predictions dictate the perf, the extras are still computed
+	if score, ok := scriptedPerf(dirTestPred, testFiles, testPerf); ok {
+		scriptedPerf(dirTrainPred, trainFiles, trainPerf)
+		log.Printf("[perf] Reporting the scripted score %f instead of %s %f", score, scoring.Headline.Name, perf)
+		perf = score
 	}
 
 	// Saving performance
 	p := Perfuplet{
-		Perf:      rand.Float64(),
+		Perf:      perf,
 		TrainPerf: trainPerf,
 		TestPerf:  testPerf,
+		Extras:    extras,
 	}
 	perfBytes, err := json.Marshal(p)
 	check(err, "[SCRIPT ERROR] Failed to Marshal perf")
@@ -142,6 +192,72 @@ func perf(dirTest, dirTrain, dirTestPred, dirTrainPred, dirPerf, filePerf string
 	check(ioutil.WriteFile(filepath.Join(dirPerf, filePerf), perfBytes, 0777), "[SCRIPT ERROR] Failed to WriteFile on perf")
 }
 
+// computePerfFiles computes the perf between the target of each true file
+// and of the pred file with the same name. It also returns the targets of all the
+// files, concatenated in the order of files.
+func computePerfFiles(dirTrue, dirPred string, files []os.FileInfo) (perf map[string]float64, yTrue, yPred []float64) {
+	perf = make(map[string]float64)
+	for _, f := range files {
+		trueFile, err := hdf5.ReadFloat64s(filepath.Join(dirTrue, f.Name()), target)
+		check(err, "[SCRIPT ERROR] Failed to read true values")
+		predFile, err := hdf5.ReadFloat64s(filepath.Join(dirPred, f.Name()), target)
+		check(err, "[SCRIPT ERROR] Failed to read predicted values")
+		perf[f.Name()], err = scoring.Perf(trueFile, predFile)
+		check(err, fmt.Sprintf("[SCRIPT ERROR] Failed to compute perf on %s", f.Name()))
+		log.Printf("[perf] Computed perf on %s: %f", f.Name(), perf[f.Name()])
+
+		yTrue = append(yTrue, trueFile...)
+		yPred = append(yPred, predFile...)
+	}
+	return perf, yTrue, yPred
+}
+
+// scriptedPerf replaces the perf on each file by its scripted score, if the
+// pred files are scripted, and returns their target score. Pred files must
+// be either all scripted with the same target score, or not scripted at all.
+func scriptedPerf(dirPred string, files []os.FileInfo, perf map[string]float64) (score float64, ok bool) {
+	for i, f := range files {
+		fileTarget, fileScore, fileOk, err := scripted.Decode(filepath.Join(dirPred, f.Name()))
+		check(err, "[SCRIPT ERROR] Failed to read scripted score")
+		switch {
+		case i > 0 && fileOk != ok:
+			log.Fatalf("[FATAL ERROR] Pred files are not all scripted in %s", dirPred)
+		case i > 0 && ok && fileTarget != score:
+			log.Fatalf("[FATAL ERROR] Scripted scores differ in %s: %f and %f", dirPred, score, fileTarget)
+		}
+		score, ok = fileTarget, fileOk
+		if ok {
+			perf[f.Name()] = fileScore
+		}
+	}
+	return score, ok
+}
+
+// loadManifest reads a problem manifest. Missing settings, or a missing
+// manifest, default to defaultManifest.
+func loadManifest(path string) (*Manifest, error) {
+	manifest := &Manifest{}
+	data, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		*manifest = defaultManifest
+		return manifest, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(data, manifest); err != nil {
+		return nil, fmt.Errorf("Error parsing %s: %s", path, err)
+	}
+	if manifest.Target == "" {
+		manifest.Target = defaultManifest.Target
+	}
+	if len(manifest.Metrics) == 0 {
+		manifest.Metrics = defaultManifest.Metrics
+	}
+	log.Printf("Loaded problem manifest %s: target %q, metrics %v", path, manifest.Target, manifest.Metrics)
+	return manifest, nil
+}
+
 func copyFile(src, dst string) (err error) {
 	in, err := os.Open(src)
 	if err != nil {
@@ -165,8 +281,9 @@ func copyFile(src, dst string) (err error) {
 	return
 }
 
-// checkData reads a dir, and for each file verify that checksums is valid
-// it returns the list of files (removing directories)
+// checkData reads a dir, and for each file verify that checksums is valid, or
+// that it is a scripted pred file. It returns the list of files (removing
+// directories)
 func checkData(path string) (fileInfos []os.FileInfo) {
 	dirFiles, err := ioutil.ReadDir(path)
 	check(err, "")
@@ -176,8 +293,8 @@ func checkData(path string) (fileInfos []os.FileInfo) {
 		}
 		data, err := ioutil.ReadFile(filepath.Join(path, f.Name()))
 		check(err, "")
-		checksum := fmt.Sprintf("%x", md5.Sum(data))
-		if _, ok := validHashData[checksum]; !ok {
+		checksum := checksums.Sum(data)
+		if _, ok := validChecksums.Lookup(checksum); !ok && !isScripted(filepath.Join(path, f.Name())) {
 			log.Fatalf("[FATAL ERROR] Invalid checksum for file %s (%s)", f.Name(), checksum)
 		}
 		fileInfos = append(fileInfos, f)
@@ -188,6 +305,13 @@ func checkData(path string) (fileInfos []os.FileInfo) {
 	return fileInfos
 }
 
+// isScripted tells whether a file is a scripted pred file, whose checksum
+// depends on its score
+func isScripted(path string) bool {
+	_, _, ok, err := scripted.Decode(path)
+	return ok && err == nil
+}
+
 func check(err error, msg string) {
 	if err != nil {
 		if msg == "" {
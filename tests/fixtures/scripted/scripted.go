@@ -0,0 +1,50 @@
+// Package scripted encodes a target score in the prediction files of the
+// fastest algo, for the fastest problem to report it as its perf. It gives
+// algos with known and distinct performances, to test the ranking of the
+// orchestrator.
+package scripted
+
+import (
+	"fmt"
+	"hash/fnv"
+
+	"github.com/MorpheoOrg/morpheo-devenv/tests/fixtures/hdf5"
+)
+
+// Dataset is the dataset of the prediction files holding the target score,
+// and the score of the file
+const Dataset = "scripted_score"
+
+// Variation bounds the difference between the score of a file and the target
+// score
+const Variation = 0.05
+
+// FileScore returns the score reported on a file: the target score, varied
+// deterministically by the file name
+func FileScore(score float64, file string) float64 {
+	h := fnv.New32a()
+	h.Write([]byte(file))
+	return score + Variation*(float64(h.Sum32()%2001)/1000-1)
+}
+
+// Encode returns the dataset encoding the target score in a prediction file
+func Encode(score float64, file string) hdf5.Dataset {
+	return hdf5.Dataset{Name: Dataset, Values: []float64{score, FileScore(score, file)}}
+}
+
+// Decode reads the target score and the score of a prediction file. ok is
+// false if the file is not a scripted prediction.
+func Decode(path string) (score, fileScore float64, ok bool, err error) {
+	f, err := hdf5.Open(path)
+	if err != nil || !f.Has(Dataset) {
+		return 0, 0, false, nil
+	}
+	values, err := f.Float64s(Dataset)
+	if err != nil {
+		return 0, 0, false, err
+	}
+	if len(values) != 2 {
+		return 0, 0, false, fmt.Errorf("%s: %d scripted scores, expected 2", path, len(values))
+	}
+	return values[0], values[1], true, nil
+}
@@ -0,0 +1,430 @@
+// Package synth generates synthetic datasets of any size for the fastest
+// problem, to stress Storage and the compute worker with data between the
+// 16.6 KB fixtures and the 1.6 GB hypnograms. A dataset is a directory
+// holding:
+//
+//	metadata.yaml                       the fixtures of the dataset
+//	data/synthetic/{train,test}/<uuid>  the data files
+//	untargetedTest/<uuid>               the test files without their target
+//	pred/<uuid>                         the predictions of the fastest algo in hash mode
+//	SHA256SUMS                          the checksum manifest of all the above
+//	{problem,algo}/<uuid>               the fastest problem and algo
+//
+// so that the fastest problem can detarget the test files, and score the
+// predictions of the fastest algo run with -mode hash.
+package synth
+
+import (
+	"crypto/sha256"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"gopkg.in/yaml.v2"
+
+	"github.com/MorpheoOrg/morpheo-devenv/tests/fixtures/checksums"
+	"github.com/MorpheoOrg/morpheo-devenv/tests/fixtures/hashpred"
+	"github.com/MorpheoOrg/morpheo-devenv/tests/fixtures/hdf5"
+)
+
+// Formats are the formats of the data files:
+//   - hdf5: a "stages" target of sleep stages 0 to 4, and a "signal" dataset
+//     of noise filling the file up to its size, as the hypnograms
+//   - raw: random bytes, only to stress uploads, as the fastest problem
+//     cannot score them
+var Formats = []string{"hdf5", "raw"}
+
+// Target is the dataset of the targets in the hdf5 data files, and of the
+// predictions of the fastest algo
+const Target = "stages"
+
+// dataDir holds the data files, relative to the dataset directory
+const dataDir = "data/synthetic"
+
+// Options sets the shape of a dataset
+type Options struct {
+	Train int
+	Test  int
+	// Size is the size of each data file, in bytes. hdf5 files are at least
+	// large enough for their Values.
+	Size   int64
+	Format string
+	// Values is the number of targets of each hdf5 data file, which must be
+	// the -pred-size of the fastest algo for the problem to score it
+	Values int
+	// SizeTrainDataset is the number of train data of each learnuplet
+	SizeTrainDataset int
+	// Seed makes the dataset reproducible: the same options and seed give the
+	// same UUIDs and files
+	Seed int64
+
+	// Problem and Algo are the storage uuids of the problem and algo the
+	// data is registered for
+	Problem string
+	Algo    string
+	// Blobs is the pathDataFolder of fixtures holding the problem and algo
+	// files, copied to the dataset so that it can be posted on its own
+	Blobs string
+}
+
+func (o *Options) validate() error {
+	switch {
+	case o.Train < 1 || o.Test < 1:
+		return fmt.Errorf("invalid dataset of %d train and %d test data, should have at least one of each", o.Train, o.Test)
+	case o.Size < 1:
+		return fmt.Errorf("invalid size %d, should be positive", o.Size)
+	case o.Values < 1:
+		return fmt.Errorf("invalid values %d, should be positive", o.Values)
+	case o.Problem == "" || o.Algo == "" || o.Blobs == "":
+		return fmt.Errorf("missing problem, algo or blobs folder to copy them from")
+	case o.SizeTrainDataset < 1 || o.SizeTrainDataset > o.Train:
+		return fmt.Errorf("invalid sizeTrainDataset %d, should be between 1 and the %d train data", o.SizeTrainDataset, o.Train)
+	}
+	for _, format := range Formats {
+		if o.Format == format {
+			return nil
+		}
+	}
+	return fmt.Errorf("unknown format %q, should be one of %v", o.Format, Formats)
+}
+
+// Dataset is a generated dataset
+type Dataset struct {
+	Dir   string
+	Train []string
+	Test  []string
+	// FileSize is the size of each data file
+	FileSize int64
+}
+
+// Generate writes a dataset to dir, which must not exist or be empty
+func Generate(dir string, o Options) (*Dataset, error) {
+	if err := o.validate(); err != nil {
+		return nil, err
+	}
+	if files, err := ioutil.ReadDir(dir); err == nil && len(files) > 0 {
+		return nil, fmt.Errorf("%s is not empty", dir)
+	}
+	dir, err := filepath.Abs(dir)
+	if err != nil {
+		return nil, err
+	}
+
+	g := &generator{rand: rand.New(rand.NewSource(o.Seed)), options: o}
+	if o.Format == "hdf5" {
+		if g.signal, err = signalLength(o.Size, o.Values); err != nil {
+			return nil, err
+		}
+	}
+	d := &Dataset{Dir: dir}
+	for i := 0; i < o.Train; i++ {
+		d.Train = append(d.Train, g.uuid())
+	}
+	for i := 0; i < o.Test; i++ {
+		d.Test = append(d.Test, g.uuid())
+	}
+
+	for _, id := range d.Train {
+		if d.FileSize, err = g.writeData(dir, "train", id); err != nil {
+			return nil, err
+		}
+	}
+	for _, id := range d.Test {
+		if d.FileSize, err = g.writeData(dir, "test", id); err != nil {
+			return nil, err
+		}
+	}
+
+	if err := copyBlob(o.Blobs, dir, "problem", o.Problem); err != nil {
+		return nil, err
+	}
+	if err := copyBlob(o.Blobs, dir, "algo", o.Algo); err != nil {
+		return nil, err
+	}
+
+	dirs := []string{"data"}
+	if o.Format == "hdf5" {
+		dirs = append(dirs, "untargetedTest", "pred")
+	}
+	m, err := checksums.Generate(dir, dirs)
+	if err != nil {
+		return nil, err
+	}
+	if err := m.WriteFile(filepath.Join(dir, checksums.FileName)); err != nil {
+		return nil, err
+	}
+	if err := writeMetadata(dir, d, o); err != nil {
+		return nil, err
+	}
+	return d, nil
+}
+
+type generator struct {
+	rand    *rand.Rand
+	options Options
+	// signal is the length of the signal dataset of the hdf5 files
+	signal int
+}
+
+// uuid returns a random version 4 UUID
+func (g *generator) uuid() string {
+	b := make([]byte, 16)
+	g.rand.Read(b)
+	b[6] = b[6]&0x0f | 0x40
+	b[8] = b[8]&0x3f | 0x80
+	return fmt.Sprintf("%x-%x-%x-%x-%x", b[0:4], b[4:6], b[6:8], b[8:10], b[10:])
+}
+
+// signalChunk is the number of signal values generated at a time, so that
+// the files are written without holding their signal in memory
+const signalChunk = 1 << 16
+
+// writeData writes a data file of a set, and for hdf5 files, its untargeted
+// file if it is a test file, and the prediction of the fastest algo on it. It
+// returns the size of the data file.
+func (g *generator) writeData(dir, set, id string) (int64, error) {
+	data, err := create(filepath.Join(dir, dataDir, set, id))
+	if err != nil {
+		return 0, err
+	}
+	defer data.Close()
+	if g.options.Format == "raw" {
+		if _, err := io.CopyN(data, g.rand, g.options.Size); err != nil {
+			return 0, err
+		}
+		return g.options.Size, data.Close()
+	}
+
+	// The algo predicts on the train files, and on the test files without
+	// their target: hash the one it predicts on while writing it
+	hash := sha256.New()
+	var out io.Writer = data
+	if set == "train" {
+		out = io.MultiWriter(data, hash)
+	}
+	full := []hdf5.Shape{{Name: Target, Len: g.options.Values}, {Name: "signal", Len: g.signal}}
+	dataWriter, err := hdf5.NewWriter(out, full)
+	if err != nil {
+		return 0, err
+	}
+	writers := []*hdf5.Writer{dataWriter}
+	if set == "test" {
+		untargeted, err := create(filepath.Join(dir, "untargetedTest", id))
+		if err != nil {
+			return 0, err
+		}
+		defer untargeted.Close()
+		untargetedWriter, err := hdf5.NewWriter(io.MultiWriter(untargeted, hash), []hdf5.Shape{{Name: "signal", Len: g.signal}})
+		if err != nil {
+			return 0, err
+		}
+		writers = append(writers, untargetedWriter)
+	}
+
+	stages := make([]float64, g.options.Values)
+	for i := range stages {
+		stages[i] = float64(g.rand.Intn(5))
+	}
+	// The datasets are written by name: signal, then stages
+	signal := make([]float64, signalChunk)
+	for n := 0; n < g.signal; n += len(signal) {
+		if g.signal-n < len(signal) {
+			signal = signal[:g.signal-n]
+		}
+		for i := range signal {
+			signal[i] = g.rand.NormFloat64()
+		}
+		for _, w := range writers {
+			if err := w.Write(signal...); err != nil {
+				return 0, err
+			}
+		}
+	}
+	if err := dataWriter.Write(stages...); err != nil {
+		return 0, err
+	}
+	for _, w := range writers {
+		if err := w.Flush(); err != nil {
+			return 0, err
+		}
+	}
+	if err := data.Close(); err != nil {
+		return 0, err
+	}
+
+	var sum [sha256.Size]byte
+	copy(sum[:], hash.Sum(nil))
+	pred, err := hashpred.Marshal("hdf5", Target, hashpred.FromSum(sum, g.options.Values))
+	if err != nil {
+		return 0, err
+	}
+	size, err := hdf5.FileSize(full)
+	if err != nil {
+		return 0, err
+	}
+	return size, writeFile(filepath.Join(dir, "pred", id), pred)
+}
+
+// signalLength returns the length of the signal dataset making hdf5 files of
+// size bytes, at least 1
+func signalLength(size int64, values int) (int, error) {
+	// The layout of the files does not depend on the length of the datasets
+	fileSize, err := hdf5.FileSize([]hdf5.Shape{{Name: Target, Len: values}, {Name: "signal", Len: 1}})
+	if err != nil {
+		return 0, err
+	}
+	overhead := fileSize - 8*int64(values+1)
+	if n := (size-overhead)/8 - int64(values); n > 1 {
+		return int(n), nil
+	}
+	return 1, nil
+}
+
+// copyBlob copies the file of a problem or algo from the blobs folder, found
+// as metadata.yaml files are, by its uuid in the folder of its kind
+func copyBlob(blobs, dir, kind, id string) error {
+	var found string
+	filepath.Walk(filepath.Join(blobs, kind), func(path string, info os.FileInfo, err error) error {
+		if err == nil && !info.IsDir() && info.Name() == id {
+			found = path
+		}
+		return nil
+	})
+	if found == "" {
+		return fmt.Errorf("no %s file %s in %s, build it with make gen-fixtures", kind, id, blobs)
+	}
+	data, err := ioutil.ReadFile(found)
+	if err != nil {
+		return err
+	}
+	return writeFile(filepath.Join(dir, kind, id), data)
+}
+
+// create creates a file, and its directory if needed
+func create(path string) (*os.File, error) {
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return nil, err
+	}
+	return os.Create(path)
+}
+
+func writeFile(path string, data []byte) error {
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return err
+	}
+	return ioutil.WriteFile(path, data, 0644)
+}
+
+// metadata is the layout of metadata.yaml
+type metadata struct {
+	PathDataFolder string `yaml:"pathDataFolder"`
+	Chaincode      struct {
+		Algo       []chaincodeItem       `yaml:"algo"`
+		Data       []chaincodeItem       `yaml:"data"`
+		Prediction []chaincodePrediction `yaml:"prediction"`
+		Problem    []chaincodeProblem    `yaml:"problem"`
+	} `yaml:"chaincode"`
+	Storage struct {
+		Algo    []storageItem `yaml:"algo"`
+		Data    []storageItem `yaml:"data"`
+		Problem []storageItem `yaml:"problem"`
+	} `yaml:"storage"`
+}
+
+type chaincodeItem struct {
+	StorageAddress string   `yaml:"storageAddress"`
+	ProblemKeys    []string `yaml:"problemKeys"`
+	Name           string   `yaml:"name"`
+}
+
+type chaincodePrediction struct {
+	Data    string `yaml:"data"`
+	Problem string `yaml:"problem"`
+}
+
+type chaincodeProblem struct {
+	StorageAddress   string   `yaml:"storageAddress"`
+	SizeTrainDataset int      `yaml:"sizeTrainDataset"`
+	TestData         []string `yaml:"testData"`
+}
+
+type storageItem struct {
+	UUID        string `yaml:"uuid"`
+	Name        string `yaml:"name,omitempty"`
+	Description string `yaml:"description,omitempty"`
+}
+
+// writeMetadata writes the metadata.yaml of a dataset, registering its data
+// for the problem and the algo of the options, with a prediction on the
+// first train data: the algo predicts the test data without their target, so
+// only the predictions of the train data are those of a preduplet
+func writeMetadata(dir string, d *Dataset, o Options) error {
+	m := metadata{PathDataFolder: dir}
+	problemKeys := []string{"problem_" + o.Problem}
+	name := fmt.Sprintf("synthetic %s %s", o.Format, FormatSize(d.FileSize))
+
+	m.Chaincode.Algo = []chaincodeItem{{StorageAddress: o.Algo, ProblemKeys: problemKeys, Name: "fast_test"}}
+	m.Chaincode.Problem = []chaincodeProblem{{StorageAddress: o.Problem, SizeTrainDataset: o.SizeTrainDataset, TestData: d.Test}}
+	m.Chaincode.Prediction = []chaincodePrediction{{Data: d.Train[0], Problem: o.Problem}}
+	m.Storage.Algo = []storageItem{{UUID: o.Algo, Name: "fast_test"}}
+	m.Storage.Problem = []storageItem{{
+		UUID:        o.Problem,
+		Name:        "fast_test_problem",
+		Description: fmt.Sprintf("Fastest problem on %d train and %d test %s data", len(d.Train), len(d.Test), name),
+	}}
+	for _, id := range append(append([]string(nil), d.Train...), d.Test...) {
+		m.Chaincode.Data = append(m.Chaincode.Data, chaincodeItem{StorageAddress: id, ProblemKeys: problemKeys, Name: name})
+		m.Storage.Data = append(m.Storage.Data, storageItem{UUID: id})
+	}
+
+	data, err := yaml.Marshal(&m)
+	if err != nil {
+		return err
+	}
+	header := fmt.Sprintf("# Synthetic dataset: %d train and %d test %s data of %s, %d values, seed %d\n",
+		len(d.Train), len(d.Test), o.Format, FormatSize(d.FileSize), o.Values, o.Seed)
+	return ioutil.WriteFile(filepath.Join(dir, "metadata.yaml"), append([]byte(header), data...), 0644)
+}
+
+var sizeUnits = []struct {
+	suffix string
+	bytes  int64
+}{
+	{"GB", 1 << 30},
+	{"MB", 1 << 20},
+	{"KB", 1 << 10},
+	{"B", 1},
+}
+
+// ParseSize parses a size in bytes, such as 512, 16KB, 1.5MB or 2GB
+func ParseSize(s string) (int64, error) {
+	value, unit := strings.ToUpper(strings.TrimSpace(s)), int64(1)
+	for _, u := range sizeUnits {
+		if strings.HasSuffix(value, u.suffix) {
+			value, unit = strings.TrimSuffix(value, u.suffix), u.bytes
+			break
+		}
+	}
+	f, err := strconv.ParseFloat(strings.TrimSpace(value), 64)
+	if err != nil || f <= 0 {
+		return 0, fmt.Errorf("invalid size %q, should be a positive number of B, KB, MB or GB", s)
+	}
+	return int64(f * float64(unit)), nil
+}
+
+// FormatSize formats a size in bytes in its largest unit, such as 1.5MB,
+// which ParseSize parses back, rounded to 0.1
+func FormatSize(size int64) string {
+	for _, u := range sizeUnits {
+		if size >= u.bytes {
+			value := strconv.FormatFloat(float64(size)/float64(u.bytes), 'f', 1, 64)
+			return strings.TrimSuffix(value, ".0") + u.suffix
+		}
+	}
+	return fmt.Sprintf("%dB", size)
+}
@@ -1,183 +1,512 @@
 package main
 
 import (
+	"bytes"
+	"context"
 	"encoding/json"
+	"flag"
 	"fmt"
+	"io"
+	"io/ioutil"
 	"log"
-	"regexp"
+	"math"
+	"math/rand"
+	"net"
+	"net/http"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
 	"time"
 
 	"github.com/MorpheoOrg/morpheo-go-packages/client"
 	"github.com/MorpheoOrg/morpheo-go-packages/common"
+
+	"github.com/MorpheoOrg/morpheo-devenv/tests/fakepeer"
+	"github.com/MorpheoOrg/morpheo-devenv/tests/fixtures/hdf5"
+	"github.com/MorpheoOrg/morpheo-devenv/tests/fixtures/metrics"
+	"github.com/MorpheoOrg/morpheo-devenv/tests/lint"
+	"github.com/MorpheoOrg/morpheo-devenv/tests/localcompute"
+	"github.com/MorpheoOrg/morpheo-devenv/tests/localstorage"
+	"github.com/MorpheoOrg/morpheo-devenv/tests/pipeline"
+	"github.com/MorpheoOrg/morpheo-devenv/tests/report"
+	"github.com/MorpheoOrg/morpheo-devenv/tests/scenario"
+	"github.com/MorpheoOrg/morpheo-devenv/tests/wait"
 )
 
 var (
-	pathFixturesYAML = "/go/src/github.com/MorpheoOrg/morpheo-devenv/tests/fixtures/metadata.yaml"
-	pathPeerConfig   = "/secrets/config.yaml"
+	cfg              *Config
+	pathFixturesYAML string
+	pathFixturesPred string
+
+	storage *client.StorageAPI
+	compute *client.ComputeAPI
+	peer    Peer
+	worker  *localcompute.Worker
+	err     error
+
+	// ctx bounds the whole run, cfg.WaitTimeout each wait
+	ctx    context.Context
+	waiter *wait.Waiter
+)
+
+// Peer is the part of client.PeerAPI used by the integration tests, so that
+// the Fabric peer can be swapped for the in-memory fakepeer
+type Peer interface {
+	Query(fcn string, args []string) ([]byte, error)
+	Invoke(fcn string, args []string) ([]byte, string, error)
+	RegisterProblem(storageAddress string, sizeTrainDataset int, testData []string) ([]byte, string, error)
+	RegisterItem(itemType, storageAddress string, problemKeys []string, name string) ([]byte, string, error)
+	QueryStatusLearnuplet(status string) ([]byte, error)
+	ReportLearn(key, status string, perf float64, trainPerf, testPerf map[string]float64) ([]byte, string, error)
+}
 
+// PredupletChaincode describes a preduplet as returned by the chaincode
+type PredupletChaincode struct {
+	Key        string `json:"key"`
+	Problem    string `json:"problem"`
+	Data       string `json:"data"`
+	Model      string `json:"model"`
+	Prediction string `json:"prediction"`
+	Status     string `json:"status"`
+}
+
+func main() {
+	cfg, err = loadConfig(flag.CommandLine, os.Args[1:])
+	check(err, "Invalid configuration")
+	// Jitter the retries of concurrent runs differently
+	rand.Seed(time.Now().UnixNano())
+
+	pathFixturesYAML = cfg.FixturesYAML
+	pathFixturesPred = filepath.Join(filepath.Dir(pathFixturesYAML), "algo/fastest/fixtures/pred")
+	if cfg.Dataset != "" {
+		pathFixturesYAML = filepath.Join(cfg.Dataset, "metadata.yaml")
+		pathFixturesPred = filepath.Join(cfg.Dataset, "pred")
+	}
 	storage = &client.StorageAPI{
-		Hostname: "storage",
-		Port:     80,
-		User:     "u",
-		Password: "p",
+		Hostname: cfg.StorageHost,
+		Port:     cfg.StoragePort,
+		User:     cfg.StorageUser,
+		Password: cfg.StoragePassword,
 	}
 	compute = &client.ComputeAPI{
-		Hostname: "compute",
-		Port:     80,
-		// User:     "u",
-		// Password: "p",
+		Hostname: cfg.ComputeHost,
+		Port:     cfg.ComputePort,
+		User:     cfg.ComputeUser,
+		Password: cfg.ComputePassword,
+	}
+
+	var cancel context.CancelFunc
+	ctx, cancel = context.WithTimeout(context.Background(), cfg.Timeout)
+	defer cancel()
+
+	// Commands run instead of the tests
+	switch flag.Arg(0) {
+	case "":
+	case "reconcile":
+		check(setup(), "Setup failed")
+		check(reconcileCommand(flag.Args()[1:]), "[reconcile] Reconciliation failed")
+		return
+	default:
+		log.Fatalf("[FATAL ERROR] Unknown command %q, the only command is reconcile", flag.Arg(0))
 	}
-	peer *client.PeerAPI
-	err  error
-)
 
-func main() {
 	log.Println("Integration Tests Starting!")
 
-	// Connecting to the peer client
-	peer, err = client.NewPeerAPI(pathPeerConfig, "Aphp", "mychannel", "mycc")
-	check(err, "[peer-API] Failed to create peerAPI")
+	// Run the tests as named steps, and always write the reports
+	rep := &report.Report{}
+	suite := rep.NewSuite("learn-pred")
+	ready := suite.Run("lint fixtures", lintFixtures) == nil
+	ready = suite.Run("setup", setup) == nil && ready
+	fixtures, registration := testLearnPred(suite)
+	if cfg.ModelLineage && !suite.Failed() {
+		testModelLineage(rep.NewSuite("model-lineage"), fixtures, registration)
+	}
+	if len(cfg.ScriptedScores) > 0 && !suite.Failed() {
+		testScriptedRanking(rep.NewSuite("scripted-ranking"), fixtures, registration)
+	}
+	if cfg.FailureScenarios && !suite.Failed() {
+		testLearnFailed(rep.NewSuite("learn-failed"), fixtures, registration)
+	}
+	// Scenarios run on their own fixtures, whatever the outcome of the
+	// built-in tests
+	if cfg.Scenarios != "" && ready {
+		runScenarios(rep, cfg.Scenarios)
+	}
 
-	testLearnPred()
+	check(rep.WriteJUnit(cfg.JUnitReport), "Error writing JUnit report")
+	check(rep.WriteJSON(cfg.JSONReport), "Error writing JSON report")
+	log.Printf("Reports written to %s and %s", cfg.JUnitReport, cfg.JSONReport)
+	if rep.Failed() {
+		log.Fatalln("[FATAL ERROR] Integration tests failed")
+	}
 
 	log.Println("GREAT SUCCESS!")
 }
 
-// testLearnPred tests learning and prediction on the devenv
-func testLearnPred() {
-	// Load the fixtures
+// lintFixtures checks metadata.yaml is consistent before using it
+func lintFixtures() error {
 	fixtures, err := common.ParseDataFromFile(pathFixturesYAML)
-	check(err, "Error loading Fixtures")
-
-	// Post the fixtures to Storage
-	check(postFixturesStorage(fixtures), "Error posting Fixtures")
-
-	// Post the fixtures to the Chaincode
-	check(registerFixturesChaincode(fixtures), "[Chaincode] Error posting Fixtures")
-
-	// Wait for the first pending learnuplet
-	var pendingList []string
-	for {
-		time.Sleep(4 * time.Second)
-		pendingList, err = getPendingLearnupletList("pending")
-		check(err, "[peer-api] Error getting pending learnuplets")
+	if err != nil {
+		return fmt.Errorf("Error parsing %s: %s", pathFixturesYAML, err)
+	}
+	violations := lint.Fixtures(fixtures)
+	if len(violations) == 0 {
+		return nil
+	}
+	msg := fmt.Sprintf("%d violation(s) in %s:", len(violations), pathFixturesYAML)
+	for _, violation := range violations {
+		msg += "\n  " + violation.String()
+	}
+	return fmt.Errorf("%s", msg)
+}
 
-		log.Printf("[peer-api] %d learnuplet(s) with status \"pending\" detected", len(pendingList))
-		if len(pendingList) > 0 {
-			break
+// setup connects to, or starts, the peer, Storage and compute worker
+func setup() error {
+	// Starting the local Storage if needed
+	switch cfg.Storage {
+	case "docker":
+	case "local":
+		if err := startLocalStorage(); err != nil {
+			return fmt.Errorf("[storage] Failed to start local Storage: %s", err)
 		}
+	default:
+		return fmt.Errorf("Invalid -storage flag: unknown storage %s", cfg.Storage)
 	}
 
-	// Wait for the learnuplet done status
-	pendingKey := pendingList[0]
-	for {
-		// Get learnuplet Status
-		var learnuplet common.LearnupletChaincode
-		learnupletBytes, err := peer.Query("queryItem", []string{pendingKey})
-		check(err, fmt.Sprintf("[peer-api] Error queryItem %s", pendingKey))
-
-		check(json.Unmarshal(learnupletBytes, &learnuplet), "Error Unmarshalling pending learnuplet")
-
-		if learnuplet.Status == "failed" {
-			check(fmt.Errorf("Error in the worker learning task"), "[integration-tests] Learnuplet status is failed")
-		}
-		if learnuplet.Status == "done" {
-			break
+	// Connecting to the peer client
+	switch cfg.Peer {
+	case "fabric":
+		if peer, err = client.NewPeerAPI(cfg.PeerConfig, cfg.PeerOrg, cfg.PeerChannel, cfg.PeerChaincode); err != nil {
+			return fmt.Errorf("[peer-API] Failed to create peerAPI: %s", err)
 		}
-		log.Printf("[learn] Waiting for learnuplet status \"done\". Last status: %s. Checking again in 20s...", learnuplet.Status)
-		time.Sleep(20 * time.Second)
+	case "fake":
+		log.Println("[peer-API] Using the in-memory fake chaincode")
+		peer = fakepeer.NewPeer()
+	default:
+		return fmt.Errorf("Invalid -peer flag: unknown peer %s", cfg.Peer)
 	}
-	log.Println("[learn] SUCCESSFUL! Learnuplet status is DONE.")
 
-	// // Request prediction to Chaincode
-	// log.Println("[pred][Chaincode] Posting prediction request")
-	// check(requestPredictionsChaincode(fixtures.Chaincode.Prediction), "[Chaincode] Error posting prediction to Chaincode")
+	// Waiting on chaincode events if the peer provides them, polling otherwise.
+	// Only the fake peer does: client.PeerAPI does not expose the chaincode
+	// events of the Fabric SDK, and subscribing to them is left to it.
+	events, ok := peer.(wait.EventSource)
+	if !ok {
+		log.Printf("[wait] The %s peer provides no chaincode events, polling instead", cfg.Peer)
+	}
+	waiter = wait.NewWaiter(events)
+	peer = &RetryPeer{Peer: peer, Ctx: ctx, Attempts: cfg.PeerAttempts, Backoff: cfg.PeerBackoff}
+
+	// Starting the local compute worker if needed
+	switch cfg.Compute {
+	case "docker":
+	case "local":
+		if err := startLocalCompute(); err != nil {
+			return fmt.Errorf("[compute] Failed to start local compute worker: %s", err)
+		}
+	default:
+		return fmt.Errorf("Invalid -compute flag: unknown compute %s", cfg.Compute)
+	}
+	return nil
+}
 
-	// // Wait for prediction to complete
-	// time.Sleep(2 * time.Second)
-	// for {
-	// 	status, err := getLastPredupletStatus()
-	// 	check(err, "[pred][getUpletStatus] Error getting status")
+// testLearnPred tests learning and prediction on the devenv, and returns the
+// fixtures it registered
+func testLearnPred(suite *report.Suite) (*common.DataParser, *Registration) {
+	var (
+		fixtures      *common.DataParser
+		registration  *Registration
+		pendingList   []common.LearnupletChaincode
+		predupletKeys []string
+	)
+
+	suite.Run("load fixtures", func() (err error) {
+		fixtures, err = common.ParseDataFromFile(pathFixturesYAML)
+		if err != nil || !cfg.Isolate {
+			return err
+		}
+		return isolateFixtures(fixtures)
+	})
+
+	suite.Run("post storage fixtures", func() error {
+		return postFixturesStorage(fixtures)
+	})
+
+	suite.Run("register chaincode fixtures", func() (err error) {
+		registration, err = registerFixturesChaincode(fixtures)
+		return err
+	})
+
+	// Wait for the first learnuplet of the algo registered by this run to be
+	// taken by a worker, ignoring the learnuplets of previous runs
+	suite.Run("wait pending", func() error {
+		_, err := waiter.Until(ctx, "a learnuplet of this run to be taken by a worker", cfg.WaitTimeout, func() (string, bool, error) {
+			pendingList = nil
+			for _, status := range []string{"pending", "done"} {
+				learnuplets, err := getLearnuplets(status)
+				if err != nil {
+					return "", false, err
+				}
+				for _, learnuplet := range learnuplets {
+					if registration.owns(learnuplet) {
+						pendingList = append(pendingList, learnuplet)
+					}
+				}
+			}
+			log.Printf("[peer-api] %d learnuplet(s) of this run with status \"pending\" or \"done\" detected", len(pendingList))
+			return fmt.Sprintf("%d learnuplets", len(pendingList)), len(pendingList) > 0, nil
+		})
+		return err
+	})
+
+	// Check the learnuplets train and test on the data set up in metadata.yaml
+	suite.Run("check learnuplets", func() error {
+		for _, learnuplet := range pendingList {
+			if err := registration.checkLearnuplet(learnuplet); err != nil {
+				return fmt.Errorf("[learn] Invalid learnuplet: %s", err)
+			}
+		}
+		return nil
+	})
 
-	// 	if status == "done" {
-	// 		break
-	// 	}
-	// 	if status != "pending" {
-	// 		log.Fatalln("[learn] Error: Learnuplet status is %s, whereas it should be 'pending' or 'done'.\n", status)
-	// 	}
-	// 	log.Printf("[pred] Waiting for preduplet status DONE on Chaincode. Last status: %s. Checking again in 20s...", status)
-	// 	time.Sleep(20 * time.Second)
-	// }
-	// log.Println("[pred] SUCCESSFUL! Preduplet status is DONE.")
-	// log.Println("SUCESSFULLY LEARNED AND PREDICTED!")
+	// Wait for the learnuplet done status
+	suite.Run("wait done", func() error {
+		if err := waitUpletDone("learnuplet", pendingList[0].Key); err != nil {
+			return err
+		}
+		log.Println("[learn] SUCCESSFUL! Learnuplet status is DONE.")
+		return nil
+	})
+
+	// Check the performance on the ledger is computed on the fixture predictions
+	suite.Run("check perf", func() error {
+		if err := checkPerf(fixtures, pendingList[0].Key); err != nil {
+			return fmt.Errorf("[learn] Invalid perf for learnuplet %s: %s", pendingList[0].Key, err)
+		}
+		log.Println("[learn] SUCCESSFUL! Perf matches the fixtures.")
+		return nil
+	})
+
+	suite.Run("request predictions", func() (err error) {
+		log.Println("[pred][Chaincode] Posting prediction requests")
+		predupletKeys, err = requestPredictionsChaincode(fixtures)
+		return err
+	})
+
+	suite.Run("wait predictions", func() error {
+		for _, predupletKey := range predupletKeys {
+			if err := waitUpletDone("preduplet", predupletKey); err != nil {
+				return err
+			}
+			log.Printf("[pred] Preduplet %s status is DONE.", predupletKey)
+		}
+		return nil
+	})
+
+	// Check the predictions stored on Storage
+	suite.Run("check predictions", func() error {
+		for _, predupletKey := range predupletKeys {
+			if err := checkPrediction(predupletKey); err != nil {
+				return fmt.Errorf("[pred] Invalid prediction for preduplet %s: %s", predupletKey, err)
+			}
+		}
+		log.Println("[pred] SUCCESSFUL! Predictions match the fixtures.")
+		return nil
+	})
+	return fixtures, registration
 }
 
 // ================================================================
 // Storage functions
 // ================================================================
 
+// startLocalStorage serves a localstorage in-process, on a random port, and
+// points the storage client to it
+func startLocalStorage() error {
+	dir, err := ioutil.TempDir("", "morpheo-storage-")
+	if err != nil {
+		return err
+	}
+	server, err := localstorage.NewServer(dir, storage.User, storage.Password)
+	if err != nil {
+		return err
+	}
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return err
+	}
+	go func() {
+		check(http.Serve(listener, server), "[storage] Local Storage stopped")
+	}()
+
+	storage.Hostname = "127.0.0.1"
+	storage.Port = listener.Addr().(*net.TCPAddr).Port
+	log.Printf("[storage] Local Storage listening on %s, storing blobs in %s", listener.Addr(), dir)
+	return nil
+}
+
 func postFixturesStorage(fixtures *common.DataParser) error {
+	_, err := postFixtures(fixtures, scenario.Kinds)
+	return err
+}
+
+// postFixtures posts the fixtures of some kinds to Storage, -parallel at a
+// time, and returns their uuids by kind
+func postFixtures(fixtures *common.DataParser, kinds scenario.KindList) (map[string][]string, error) {
+	// Each task sets the uuid of its fixture once posted, so that the uuids
+	// keep the order of metadata.yaml
+	uuids := make(map[string][]string)
+	var problems, data, algos, models []pipeline.Task
 
 	// Post Problems
-	for _, resource := range fixtures.Storage.Problem {
-		log.Printf("[storage] Posting problem/%s...", resource.ID)
-		file, err := fixtures.GetData("problem", resource.ID.String())
-		if err != nil {
-			log.Printf("[storage]%s", err)
-			continue
-		}
-		if err := storage.PostProblem(resource, 666, file); err != nil {
-			if !resourceAlreadyExist(err) {
-				return err
-			}
-			log.Printf("[storage] problem/%s already exists", resource.ID)
+	if kinds.Has("problem") {
+		uuids["problem"] = make([]string, len(fixtures.Storage.Problem))
+		for i, resource := range fixtures.Storage.Problem {
+			resource := resource
+			problems = append(problems, postFixtureTask(fixtures, "problem", resource.ID.String(), &uuids["problem"][i], func(blob io.Reader) error {
+				return storage.PostProblem(resource, 666, blob)
+			}))
 		}
 	}
 	// Post Data
-	for _, resource := range fixtures.Storage.Data {
-		log.Printf("[storage] Posting data/%s...", resource.ID)
-		file, err := fixtures.GetData("data", resource.ID.String())
-		if err != nil {
-			log.Printf("[storage]%s", err)
-			continue
-		}
-		if err := storage.PostData(resource, 666, file); err != nil {
-			if !resourceAlreadyExist(err) {
-				return err
-			}
-			log.Printf("[storage] data/%s already exists", resource.ID)
+	if kinds.Has("data") {
+		uuids["data"] = make([]string, len(fixtures.Storage.Data))
+		for i, resource := range fixtures.Storage.Data {
+			resource := resource
+			data = append(data, postFixtureTask(fixtures, "data", resource.ID.String(), &uuids["data"][i], func(blob io.Reader) error {
+				return storage.PostData(resource, 666, blob)
+			}))
 		}
 	}
 
 	// Post Algo
-	for _, resource := range fixtures.Storage.Algo {
-		log.Printf("[storage] Posting algo/%s...", resource.ID)
-		file, err := fixtures.GetData("algo", resource.ID.String())
-		if err != nil {
-			log.Printf("[storage]%s", err)
-			continue
+	if kinds.Has("algo") {
+		uuids["algo"] = make([]string, len(fixtures.Storage.Algo))
+		for i, resource := range fixtures.Storage.Algo {
+			resource := resource
+			algos = append(algos, postFixtureTask(fixtures, "algo", resource.ID.String(), &uuids["algo"][i], func(blob io.Reader) error {
+				return storage.PostAlgo(resource, 666, blob)
+			}))
 		}
-		if err := storage.PostAlgo(resource, 666, file); err != nil {
-			if !resourceAlreadyExist(err) {
-				return err
+	}
+
+	// Post Models, once their algo is posted
+	if kinds.Has("model") {
+		uuids["model"] = make([]string, len(fixtures.Storage.Model))
+		for i, resource := range fixtures.Storage.Model {
+			resource := resource
+			models = append(models, postFixtureTask(fixtures, "model", resource.ID.String(), &uuids["model"][i], func(blob io.Reader) error {
+				return storage.PostModel(resource, 666, blob)
+			}))
+		}
+	}
+
+	// Unlike their registration, the blobs of problems, data and algos do not
+	// reference each other, so they share a stage. Models reference their algo,
+	// and come next.
+	p := pipeline.New("storage", cfg.Parallel)
+	p.Stage(append(append(problems, data...), algos...)...)
+	p.Stage(models...)
+	if err := p.Run(); err != nil {
+		return nil, err
+	}
+
+	posted := make(map[string][]string)
+	for kind, list := range uuids {
+		for _, id := range list {
+			if id != "" {
+				posted[kind] = append(posted[kind], id)
+			}
+		}
+	}
+	return posted, nil
+}
+
+// postFixtureTask returns the task posting the fixture file of a resource
+// with post, setting *posted to its uuid once posted
+func postFixtureTask(fixtures *common.DataParser, resource, id string, posted *string, post func(blob io.Reader) error) pipeline.Task {
+	return pipeline.Task{
+		Name: fmt.Sprintf("post %s/%s", resource, id),
+		Run: func() error {
+			log.Printf("[storage] Posting %s/%s...", resource, id)
+			ok, err := postStorageFixture(fixtures, resource, id, post)
+			if ok {
+				*posted = id
 			}
-			log.Printf("[storage] algo/%s already exists", resource.ID)
+			return err
+		},
+	}
+}
+
+// storageBlobs gives raw access to the Storage blobs to the local compute worker
+type storageBlobs struct{}
+
+func (storageBlobs) GetBlob(resource, id string) (io.ReadCloser, error) {
+	return getStorageBlob(resource, id)
+}
+
+func (storageBlobs) PostBlob(resource, id string, blob []byte) error {
+	return postStorageBlob(resource, id, blob)
+}
+
+// ================================================================
+// Compute functions
+// ================================================================
+
+// startLocalCompute builds the fastest algo and problem and runs them in a
+// local compute worker, in the background
+func startLocalCompute() error {
+	dir, err := ioutil.TempDir("", "morpheo-compute-")
+	if err != nil {
+		return err
+	}
+	// The binaries are built from the fixtures, even when learning on a
+	// dataset. go build reads a relative path without ./ as an import path.
+	pathFixtures, err := filepath.Abs(filepath.Dir(cfg.FixturesYAML))
+	if err != nil {
+		return err
+	}
+	worker = &localcompute.Worker{
+		ID:              "localcompute",
+		WorkDir:         dir,
+		AlgoBin:         filepath.Join(dir, "fastest"),
+		AlgoFixtures:    filepath.Join(pathFixtures, "algo/fastest/fixtures"),
+		ProblemBin:      filepath.Join(dir, "problem_fastest"),
+		ProblemFixtures: filepath.Join(pathFixtures, "problem/fastest/fixtures"),
+		TaskTimeout:     5 * time.Minute,
+		Peer:            peer,
+		Storage:         storageBlobs{},
+	}
+
+	if cfg.Dataset != "" {
+		if err := useDataset(worker, cfg.Dataset); err != nil {
+			return err
 		}
 	}
 
-	// // Post Model
-	// for _, resource := range fixtures.Storage.Model {
-	// 	log.Printf("[storage] POST Model %s", resource.ID)
-	// 	file, err := fixtures.GetData("model", resource.ID.String())
-	// 	if err != nil {
-	// 		log.Printf("[storage]%s", err)
-	//		continue
-	// 	}
-	// 	if err := storage.PostModel(&resource, file, 3933); err != nil {
-	// 		return err
-	// 	}
-	// }
+	for bin, src := range map[string]string{
+		worker.AlgoBin:    filepath.Join(pathFixtures, "algo/fastest"),
+		worker.ProblemBin: filepath.Join(pathFixtures, "problem/fastest"),
+	} {
+		if err := goBuild(bin, src); err != nil {
+			return err
+		}
+	}
 
+	go worker.Run(2*time.Second, nil)
+	log.Printf("[compute] Local compute worker running in %s", dir)
+	return nil
+}
+
+// goBuild builds a fixture binary, with optional go build flags
+func goBuild(bin, src string, flags ...string) error {
+	log.Printf("[compute] Building %s %v...", src, flags)
+	args := append(append([]string{"build"}, flags...), "-o", bin, src)
+	if output, err := exec.Command("go", args...).CombinedOutput(); err != nil {
+		return fmt.Errorf("Error building %s: %s. Output:\n%s", src, err, output)
+	}
 	return nil
 }
 
@@ -185,83 +514,391 @@ func postFixturesStorage(fixtures *common.DataParser) error {
 // Chaincode functions
 // ================================================================
 
-func registerFixturesChaincode(fixtures *common.DataParser) error {
+// registerFixturesChaincode registers the fixtures on the chaincode, and
+// returns the ledger keys it created. The problemKeys of metadata.yaml are
+// translated to the keys of the registered problems.
+func registerFixturesChaincode(fixtures *common.DataParser) (*Registration, error) {
+	registration := newRegistration()
+	if _, err := registerFixtures(registration, fixtures, scenario.Kinds); err != nil {
+		return nil, err
+	}
+	return registration, nil
+}
+
+// registerFixtures registers the fixtures of some kinds on the chaincode,
+// -parallel at a time, adding them to registration, and returns their ledger
+// keys by kind. Problems are registered first, as data and algos reference
+// them, then data, then algos: registering an algo creates its learnuplets on
+// the data of its problems, which must not depend on how the registrations
+// interleave.
+func registerFixtures(registration *Registration, fixtures *common.DataParser, kinds scenario.KindList) (map[string][]string, error) {
+	// Each task sets the key of its fixture, so that the keys keep the order
+	// of metadata.yaml
+	keys := make(map[string][]string)
+	var mu sync.Mutex
+	var problems, data, algos []pipeline.Task
+
 	// Register Problem
-	for _, resource := range fixtures.Chaincode.Problem {
-		log.Printf("[peer-API] Registering problem %s...", resource.StorageAddress)
-		_, _, err := peer.RegisterProblem(resource.StorageAddress, resource.SizeTrainDataset, resource.TestData)
-		if err != nil {
-			return fmt.Errorf("[peer-API] Error registering problem %s: %s", resource.StorageAddress, err)
+	if kinds.Has("problem") {
+		keys["problem"] = make([]string, len(fixtures.Chaincode.Problem))
+		for i, resource := range fixtures.Chaincode.Problem {
+			resource, key := resource, &keys["problem"][i]
+			problems = append(problems, pipeline.Task{
+				Name: "register problem " + resource.StorageAddress,
+				Run: func() error {
+					log.Printf("[peer-API] Registering problem %s...", resource.StorageAddress)
+					keyBytes, _, err := peer.RegisterProblem(resource.StorageAddress, resource.SizeTrainDataset, resource.TestData)
+					if err != nil {
+						return fmt.Errorf("[peer-API] Error registering problem %s: %s", resource.StorageAddress, err)
+					}
+					mu.Lock()
+					defer mu.Unlock()
+					*key = string(keyBytes)
+					registration.Problems[resource.StorageAddress] = &RegisteredProblem{
+						Key:            *key,
+						StorageAddress: resource.StorageAddress,
+						TestData:       resource.TestData,
+					}
+					return nil
+				},
+			})
 		}
 	}
 
 	// Register Data
-	for _, resource := range fixtures.Chaincode.Data {
-		log.Printf("[peer-API] Registering data %s...", resource.StorageAddress)
-		_, _, err := peer.RegisterItem("data", resource.StorageAddress, resource.ProblemKeys, resource.Name)
-		if err != nil {
-			return fmt.Errorf("[peer-API] Error registering data %s: %s", resource.StorageAddress, err)
+	if kinds.Has("data") {
+		keys["data"] = make([]string, len(fixtures.Chaincode.Data))
+		for i, resource := range fixtures.Chaincode.Data {
+			data = append(data, registerItemTask(registration, "data", resource.StorageAddress, resource.ProblemKeys, resource.Name, &keys["data"][i], &mu))
 		}
 	}
 
 	// Register Algo
-	for _, resource := range fixtures.Chaincode.Algo {
-		log.Printf("[peer-API] Registering algo %s...", resource.StorageAddress)
-		_, _, err := peer.RegisterItem("algo", resource.StorageAddress, resource.ProblemKeys, resource.Name)
-		if err != nil {
-			return fmt.Errorf("[peer-API] Error registering algo %s: %s", resource.StorageAddress, err)
+	if kinds.Has("algo") {
+		keys["algo"] = make([]string, len(fixtures.Chaincode.Algo))
+		for i, resource := range fixtures.Chaincode.Algo {
+			algos = append(algos, registerItemTask(registration, "algo", resource.StorageAddress, resource.ProblemKeys, resource.Name, &keys["algo"][i], &mu))
 		}
 	}
 
-	return nil
+	p := pipeline.New("peer-API", cfg.Parallel)
+	p.Stage(problems...)
+	p.Stage(data...)
+	p.Stage(algos...)
+	if err := p.Run(); err != nil {
+		return nil, err
+	}
+	return keys, nil
+}
+
+// registerItemTask returns the task registering a data or an algo fixture,
+// setting *key to its ledger key and adding it to registration under mu.
+// It translates its problem keys when it runs, once the problems are
+// registered.
+func registerItemTask(registration *Registration, itemType, storageAddress string, fixtureProblemKeys []string, name string, key *string, mu *sync.Mutex) pipeline.Task {
+	return pipeline.Task{
+		Name: fmt.Sprintf("register %s %s", itemType, storageAddress),
+		Run: func() error {
+			log.Printf("[peer-API] Registering %s %s...", itemType, storageAddress)
+			mu.Lock()
+			problemKeys := registration.problemKeys(fixtureProblemKeys)
+			mu.Unlock()
+			keyBytes, _, err := peer.RegisterItem(itemType, storageAddress, problemKeys, name)
+			if err != nil {
+				return fmt.Errorf("[peer-API] Error registering %s %s: %s", itemType, storageAddress, err)
+			}
+			*key = string(keyBytes)
+
+			mu.Lock()
+			defer mu.Unlock()
+			items := registration.Data
+			if itemType == "algo" {
+				items = registration.Algos
+			}
+			items[storageAddress] = &RegisteredItem{
+				Key:            *key,
+				StorageAddress: storageAddress,
+				ProblemKeys:    problemKeys,
+			}
+			return nil
+		},
+	}
+}
+
+// registerFixtureAlgo posts the first fixture algo under a new storage
+// address, and registers it on the problems of the fixture algo. The local
+// compute worker runs its learnuplets as set by run.
+func registerFixtureAlgo(fixtures *common.DataParser, registration *Registration, name string, run localcompute.Algo) (address, key string, err error) {
+	if len(fixtures.Storage.Algo) == 0 {
+		return "", "", fmt.Errorf("no fixture algo to register a copy of")
+	}
+	return registerAlgoCopy(fixtures, registration, fixtures.Storage.Algo[0].ID.String(), name, run)
+}
+
+// registerAlgoCopy posts the fixture algo stored at algoAddress under a new
+// storage address, and registers it on the problems of the fixture algo
+func registerAlgoCopy(fixtures *common.DataParser, registration *Registration, algoAddress, name string, run localcompute.Algo) (address, key string, err error) {
+	var resource *common.Algo
+	for _, algo := range fixtures.Storage.Algo {
+		if algo.ID.String() == algoAddress {
+			resource = algo
+		}
+	}
+	var problemKeys []string
+	for _, algo := range fixtures.Chaincode.Algo {
+		if algo.StorageAddress == algoAddress {
+			problemKeys = registration.problemKeys(algo.ProblemKeys)
+		}
+	}
+	if resource == nil || problemKeys == nil {
+		return "", "", fmt.Errorf("no fixture algo %s to register a copy of", algoAddress)
+	}
+	file, err := fixtures.GetData("algo", fixtureID(algoAddress))
+	if err != nil {
+		return "", "", fmt.Errorf("[storage] Error reading fixture algo: %s", err)
+	}
+	blob, err := ioutil.ReadAll(file)
+	if closer, ok := file.(io.Closer); ok {
+		closer.Close()
+	}
+	if err != nil {
+		return "", "", fmt.Errorf("[storage] Error reading fixture algo: %s", err)
+	}
+
+	address = newUUID()
+	log.Printf("[storage] Posting algo/%s (%s %s)...", address, resource.Name, name)
+	if err := postStorageBlob("algo", address, blob); err != nil {
+		return "", "", err
+	}
+
+	// The worker must know how to run the algo before its learnuplets are
+	// created
+	worker.SetAlgo(address, run)
+	keyBytes, _, err := peer.RegisterItem("algo", address, problemKeys, resource.Name+" "+name)
+	if err != nil {
+		return "", "", fmt.Errorf("[peer-API] Error registering algo %s: %s", address, err)
+	}
+	return address, string(keyBytes), nil
 }
 
-func getPendingLearnupletList(status string) (pendingList []string, err error) {
-	learnupletsByte, err := peer.QueryStatusLearnuplet("pending")
+// getLearnuplets returns the learnuplets with a given status
+func getLearnuplets(status string) ([]common.LearnupletChaincode, error) {
+	learnupletsByte, err := peer.QueryStatusLearnuplet(status)
 	if err != nil {
-		return nil, fmt.Errorf("[peer-API] Error getting pending learnpulets: %s", err)
+		return nil, fmt.Errorf("[peer-API] Error getting %s learnpulets: %s", status, err)
 	}
 	var learnuplets []common.LearnupletChaincode
 	err = json.Unmarshal(learnupletsByte, &learnuplets)
 	if err != nil {
-		return nil, fmt.Errorf("[peer-API] Error Unmarshal-ing pendind learnuplets: %s", err)
+		return nil, fmt.Errorf("[peer-API] Error Unmarshal-ing %s learnuplets: %s", status, err)
+	}
+	return learnuplets, nil
+}
+
+func requestPredictionsChaincode(fixtures *common.DataParser) (predupletKeys []string, err error) {
+	for _, prediction := range fixtures.Chaincode.Prediction {
+		log.Printf("[peer-API] Requesting prediction on data %s for problem %s...", prediction.Data, prediction.Problem)
+		key, _, err := peer.Invoke("requestPrediction", []string{prediction.Data, prediction.Problem})
+		if err != nil {
+			return nil, fmt.Errorf("[peer-API] Error requesting prediction on data %s: %s", prediction.Data, err)
+		}
+		predupletKeys = append(predupletKeys, string(key))
+	}
+	return predupletKeys, nil
+}
+
+// waitUpletDone waits for a learnuplet or a preduplet to be done, and fails
+// as soon as it is failed
+func waitUpletDone(kind, key string) error {
+	return waitUpletStatus(kind, key, "done")
+}
+
+// waitUpletStatus waits for a learnuplet or a preduplet to reach a status,
+// and fails as soon as it is "done" or "failed" instead
+func waitUpletStatus(kind, key, final string) error {
+	return waitUpletStatusWithin(kind, key, final, cfg.WaitTimeout)
+}
+
+// waitUpletStatusWithin is waitUpletStatus with a given timeout
+func waitUpletStatusWithin(kind, key, final string, timeout time.Duration) error {
+	_, err := waiter.Until(ctx, fmt.Sprintf("%s %s to be %s", kind, key, final), timeout, func() (string, bool, error) {
+		status, err := getUpletStatus(key)
+		if err != nil {
+			return "", false, err
+		}
+		if status != final && (status == "done" || status == "failed") {
+			return status, false, fmt.Errorf("%s %s status is %s, expected %s", kind, key, status, final)
+		}
+		return status, status == final, nil
+	})
+	return err
+}
+
+// getUpletStatus returns the status of a learnuplet or a preduplet
+func getUpletStatus(key string) (string, error) {
+	upletBytes, err := peer.Query("queryItem", []string{key})
+	if err != nil {
+		return "", fmt.Errorf("[peer-API] Error queryItem %s: %s", key, err)
+	}
+	var uplet struct {
+		Status string `json:"status"`
+	}
+	if err := json.Unmarshal(upletBytes, &uplet); err != nil {
+		return "", fmt.Errorf("[peer-API] Error Unmarshal-ing uplet %s: %s", key, err)
+	}
+	return uplet.Status, nil
+}
+
+// getAlgoLearnuplets returns the learnuplets of an algo, whatever their
+// status, by rank
+func getAlgoLearnuplets(algoKey string) ([]common.LearnupletChaincode, error) {
+	learnupletsBytes, err := peer.Query("queryItems", []string{"learnuplet"})
+	if err != nil {
+		return nil, fmt.Errorf("[peer-API] Error getting learnuplets: %s", err)
+	}
+	var learnuplets, algoLearnuplets []common.LearnupletChaincode
+	if err := json.Unmarshal(learnupletsBytes, &learnuplets); err != nil {
+		return nil, fmt.Errorf("[peer-API] Error Unmarshal-ing learnuplets: %s", err)
 	}
 	for _, learnuplet := range learnuplets {
-		pendingList = append(pendingList, learnuplet.Key)
+		if learnuplet.Algo == algoKey {
+			algoLearnuplets = append(algoLearnuplets, learnuplet)
+		}
+	}
+	sort.Slice(algoLearnuplets, func(i, j int) bool { return algoLearnuplets[i].Rank < algoLearnuplets[j].Rank })
+	return algoLearnuplets, nil
+}
+
+func getLearnuplet(key string) (*common.LearnupletChaincode, error) {
+	learnupletBytes, err := peer.Query("queryItem", []string{key})
+	if err != nil {
+		return nil, fmt.Errorf("[peer-API] Error queryItem %s: %s", key, err)
+	}
+	learnuplet := &common.LearnupletChaincode{}
+	if err := json.Unmarshal(learnupletBytes, learnuplet); err != nil {
+		return nil, fmt.Errorf("[peer-API] Error Unmarshal-ing learnuplet %s: %s", key, err)
+	}
+	return learnuplet, nil
+}
+
+func getPreduplet(key string) (*PredupletChaincode, error) {
+	predupletBytes, err := peer.Query("queryItem", []string{key})
+	if err != nil {
+		return nil, fmt.Errorf("[peer-API] Error queryItem %s: %s", key, err)
 	}
-	return pendingList, nil
+	preduplet := &PredupletChaincode{}
+	if err := json.Unmarshal(predupletBytes, preduplet); err != nil {
+		return nil, fmt.Errorf("[peer-API] Error Unmarshal-ing preduplet %s: %s", key, err)
+	}
+	return preduplet, nil
 }
 
-func getLastPredupletStatus() (string, error) {
-	// body, err := Chaincode.GetList("preduplet")
-	// if err != nil {
-	// 	return "", fmt.Errorf("Error retrieving preduplet list: %s", err)
-	// }
+// ================================================================
+// Performance checks
+// ================================================================
+
+// perfTarget is the dataset of the fixture files scored by problem_fastest
+const perfTarget = "stages"
+
+// perfTolerance absorbs the rounding differences due to the order in which
+// the test files are summed
+const perfTolerance = 1e-9
+
+// checkPerf computes the accuracy of the fastest algo fixture predictions on
+// the test data of a done learnuplet, the headline metric of the fastest
+// problem, and compares it to the perf on the ledger
+func checkPerf(fixtures *common.DataParser, learnupletKey string) error {
+	learnuplet, err := getLearnuplet(learnupletKey)
+	if err != nil {
+		return err
+	}
+
+	var yTrue, yPred []float64
+	for _, address := range learnuplet.TestData {
+		id := address[strings.LastIndex(address, "_")+1:]
+		file, err := fixtures.GetData("data", fixtureID(id))
+		if err != nil {
+			return fmt.Errorf("Error reading test data %s: %s", id, err)
+		}
+		data, err := ioutil.ReadAll(file)
+		if closer, ok := file.(io.Closer); ok {
+			closer.Close()
+		}
+		if err != nil {
+			return fmt.Errorf("Error reading test data %s: %s", id, err)
+		}
+		h5, err := hdf5.Parse(data)
+		if err != nil {
+			return fmt.Errorf("Error parsing test data %s: %s", id, err)
+		}
+		trueFile, err := h5.Float64s(perfTarget)
+		if err != nil {
+			return fmt.Errorf("Error reading test data %s: %s", id, err)
+		}
+		predFile, err := hdf5.ReadFloat64s(filepath.Join(pathFixturesPred, fixtureID(id)), perfTarget)
+		if err != nil {
+			return err
+		}
+
+		expected, err := metrics.Accuracy(trueFile, predFile)
+		if err != nil {
+			return fmt.Errorf("Error computing accuracy on %s: %s", id, err)
+		}
+		if got, ok := learnuplet.TestPerf[id]; !ok || math.Abs(got-expected) > perfTolerance {
+			return fmt.Errorf("test perf on %s is %v, expected %f", id, learnuplet.TestPerf[id], expected)
+		}
+		yTrue = append(yTrue, trueFile...)
+		yPred = append(yPred, predFile...)
+	}
 
-	// // Unmarshal the learnuplet
-	// var preduplets map[string][]common.Preduplet
-	// err = json.NewDecoder(bytes.NewReader(body)).Decode(&preduplets)
-	// if err != nil {
-	// 	return "", fmt.Errorf("Error un-marshaling learnuplet: %s. Body: %s", err, string(body))
-	// }
-	// return preduplets["preduplets"][0].Status, nil
-	return "", nil
+	expected, err := metrics.Accuracy(yTrue, yPred)
+	if err != nil {
+		return fmt.Errorf("Error computing accuracy: %s", err)
+	}
+	if math.Abs(learnuplet.Perf-expected) > perfTolerance {
+		return fmt.Errorf("perf is %f, expected %f", learnuplet.Perf, expected)
+	}
+	log.Printf("[learn] Perf of learnuplet %s is %f, as expected", learnupletKey, learnuplet.Perf)
+	return nil
 }
 
-func getLastLearnupletStatus() (string, error) {
-	// body, err := Chaincode.GetList("learnuplet")
-	// if err != nil {
-	// 	return "", fmt.Errorf("Error retrieving learnuplet list: %s", err)
-	// }
+// ================================================================
+// Prediction checks
+// ================================================================
+
+// checkPrediction downloads the prediction of a done preduplet from Storage
+// and compares it to the fixture file the fastest algo copies from /fixtures/pred
+func checkPrediction(predupletKey string) error {
+	preduplet, err := getPreduplet(predupletKey)
+	if err != nil {
+		return err
+	}
+	if preduplet.Prediction == "" {
+		return fmt.Errorf("preduplet %s has no prediction storage address", predupletKey)
+	}
+
+	expected, err := ioutil.ReadFile(filepath.Join(pathFixturesPred, fixtureID(preduplet.Data)))
+	if err != nil {
+		return fmt.Errorf("Error reading expected prediction for data %s: %s", preduplet.Data, err)
+	}
+
+	log.Printf("[storage] Downloading prediction/%s...", preduplet.Prediction)
+	blob, err := getStorageBlob("prediction", preduplet.Prediction)
+	if err != nil {
+		return err
+	}
+	defer blob.Close()
+	got, err := ioutil.ReadAll(blob)
+	if err != nil {
+		return fmt.Errorf("Error reading prediction/%s: %s", preduplet.Prediction, err)
+	}
 
-	// // Unmarshal the learnuplet
-	// var learnuplets map[string][]common.Learnuplet
-	// err = json.NewDecoder(bytes.NewReader(body)).Decode(&learnuplets)
-	// if err != nil {
-	// 	return "", fmt.Errorf("Error un-marshaling learnuplet: %s. Body: %s", err, string(body))
-	// }
-	// return learnuplets["learnuplets"][0].Status, nil
-	return "", nil
+	if !bytes.Equal(got, expected) {
+		return fmt.Errorf("prediction/%s (%d bytes) differs from fixture %s (%d bytes)",
+			preduplet.Prediction, len(got), preduplet.Data, len(expected))
+	}
+	log.Printf("[pred] Prediction on data %s matches the fixture", preduplet.Data)
+	return nil
 }
 
 // ============================================
@@ -274,29 +911,26 @@ func check(err error, msg string) {
 	}
 }
 
-func resourceAlreadyExist(err error) bool {
-	re := regexp.MustCompile("409 Conflict")
-	return re.MatchString(err.Error())
-}
-
 // ================================================================
 // Client Tests
 // ================================================================
 
-func testReportLearnFailed(learnuplet string) {
+func testReportLearnFailed(learnuplet string) error {
 	var m map[string]float64
 	var f float64
 	_, _, err := peer.ReportLearn(learnuplet, common.TaskStatusFailed, f, m, m)
 	if err != nil {
-		log.Fatalf("[FATAL ERROR] Error in testReportLearn: %s", err)
+		return fmt.Errorf("[peer-API] Error in testReportLearn: %s", err)
 	}
+	return nil
 }
 
-func testReportLearnDone(learnuplet string) {
+func testReportLearnDone(learnuplet string) error {
 	m := map[string]float64{"p": 0.5}
 	f := 0.5
 	_, _, err := peer.ReportLearn(learnuplet, common.TaskStatusDone, f, m, m)
 	if err != nil {
-		log.Fatalf("[FATAL ERROR] Error in testReportLearn: %s", err)
+		return fmt.Errorf("[peer-API] Error in testReportLearn: %s", err)
 	}
+	return nil
 }
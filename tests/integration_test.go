@@ -0,0 +1,163 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strconv"
+	"testing"
+
+	"github.com/MorpheoOrg/morpheo-go-packages/client"
+	"github.com/MorpheoOrg/morpheo-go-packages/common"
+
+	"github.com/MorpheoOrg/morpheo-devenv/tests/localstorage"
+)
+
+const (
+	testProblem = "c89d0eb7-2336-48d7-873b-27073ccd363f"
+	testData    = "8bc11648-d983-4a62-9ea2-590901f374ff"
+	testAlgo    = "8f5c97ff-ee61-4cf1-a0ac-6852bac08408"
+	testModel   = "8ddf97a8-4a18-4449-a70a-cb392173ba31"
+)
+
+// startTestStorage serves a localstorage on an httptest listener, and points
+// the storage client to it
+func startTestStorage(t *testing.T, dir string) *httptest.Server {
+	server, err := localstorage.NewServer(filepath.Join(dir, "storage"), "user", "password")
+	if err != nil {
+		t.Fatal(err)
+	}
+	ts := httptest.NewServer(server)
+	host, port, err := net.SplitHostPort(ts.Listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	portNumber, _ := strconv.Atoi(port)
+	storage = &client.StorageAPI{Hostname: host, Port: portNumber, User: "user", Password: "password"}
+	return ts
+}
+
+// writeTestFixtures writes a problem, a data, an algo and a model fixture,
+// and returns their parsed metadata.yaml
+func writeTestFixtures(t *testing.T, dir string) *common.DataParser {
+	folder := filepath.Join(dir, "fixtures")
+	for kind, id := range map[string]string{"problem": testProblem, "data": testData, "algo": testAlgo, "model": testModel} {
+		if err := os.MkdirAll(filepath.Join(folder, kind), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(filepath.Join(folder, kind, id), []byte(kind+" blob"), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	metadata := fmt.Sprintf(`pathDataFolder: %s
+storage:
+  problem:
+  - uuid: %s
+    name: test_problem
+  data:
+  - uuid: %s
+  algo:
+  - uuid: %s
+    name: test_algo
+  model:
+  - uuid: %s
+    algo: %s
+`, folder, testProblem, testData, testAlgo, testModel, testAlgo)
+	path := filepath.Join(dir, "metadata.yaml")
+	if err := ioutil.WriteFile(path, []byte(metadata), 0644); err != nil {
+		t.Fatal(err)
+	}
+	fixtures, err := common.ParseDataFromFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return fixtures
+}
+
+func TestPostFixturesStorage(t *testing.T) {
+	dir, err := ioutil.TempDir("", "morpheo-tests-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	cfg = defaultConfig()
+	ts := startTestStorage(t, dir)
+	defer ts.Close()
+	fixtures := writeTestFixtures(t, dir)
+
+	// The second run finds the fixtures already posted, with the same content
+	for run := 1; run <= 2; run++ {
+		if err := postFixturesStorage(fixtures); err != nil {
+			t.Fatalf("run %d: %s", run, err)
+		}
+		for _, kind := range []string{"problem", "data", "algo", "model"} {
+			resources, err := listStorage(kind)
+			if err != nil {
+				t.Fatalf("run %d: %s", run, err)
+			}
+			if len(resources) != 1 {
+				t.Errorf("run %d: %d %s resource(s) on Storage, expected 1", run, len(resources), kind)
+			}
+		}
+	}
+
+	err = postStorageBlob("data", testData, []byte("data blob"))
+	if !isStorageStatus(err, http.StatusConflict) {
+		t.Errorf("posting data/%s again: got error %v, expected a %d StorageError", testData, err, http.StatusConflict)
+	}
+}
+
+func TestPostStorageFixtureConcurrently(t *testing.T) {
+	dir, err := ioutil.TempDir("", "morpheo-tests-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	cfg = defaultConfig()
+	ts := startTestStorage(t, dir)
+	defer ts.Close()
+	fixtures := writeTestFixtures(t, dir)
+
+	// Someone else posts the data between the comparison and the post, which
+	// then conflicts
+	data := fixtures.Storage.Data[0]
+	posts := 0
+	post := func(blob io.Reader) error {
+		posts++
+		if posts == 1 {
+			if err := postStorageBlob("data", testData, []byte("data blob")); err != nil {
+				t.Fatal(err)
+			}
+		}
+		return storage.PostData(data, 666, blob)
+	}
+	ok, err := postStorageFixture(fixtures, "data", testData, post)
+	if !ok || err != nil {
+		t.Fatalf("posting data/%s concurrently: %t, %v, expected it posted", testData, ok, err)
+	}
+	if posts != 1 {
+		t.Errorf("%d posts, expected the second comparison to find data/%s with the content of the fixture", posts, testData)
+	}
+
+	// A concurrent post with another content is a drift
+	if err := deleteStorageResource("data", testData); err != nil {
+		t.Fatal(err)
+	}
+	posts = 0
+	post = func(blob io.Reader) error {
+		posts++
+		if err := postStorageBlob("data", testData, []byte("other blob")); err != nil {
+			t.Fatal(err)
+		}
+		return storage.PostData(data, 666, blob)
+	}
+	_, err = postStorageFixture(fixtures, "data", testData, post)
+	if _, ok := err.(*DriftError); !ok {
+		t.Errorf("posting data/%s against another content: got error %v, expected a DriftError", testData, err)
+	}
+}
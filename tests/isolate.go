@@ -0,0 +1,120 @@
+package main
+
+import (
+	"crypto/rand"
+	"fmt"
+	"log"
+	"strings"
+
+	"github.com/MorpheoOrg/morpheo-go-packages/common"
+)
+
+// fixtureIDs maps the UUIDs used in this run to the UUIDs of the fixture
+// files. It is empty unless the run is isolated.
+var fixtureIDs = make(map[string]string)
+
+// fixtureID returns the UUID of the fixture file behind a UUID of this run
+func fixtureID(id string) string {
+	if original, ok := fixtureIDs[id]; ok {
+		return original
+	}
+	return id
+}
+
+// isolateFixtures gives fresh UUIDs to all the fixtures of the run, so that
+// they do not conflict with previous runs on Storage and on the chaincode.
+// Every reference is rewritten consistently: storage uuids, the algos of the
+// models, chaincode storage addresses, problemKeys, testData and predictions.
+//
+// The fixture binaries map data files to their pred and untargetedTest files
+// by checksum, so the files they produce follow the new UUIDs. The harness
+// maps the new UUIDs back to the fixture files through fixtureIDs.
+func isolateFixtures(fixtures *common.DataParser) error {
+	renamed := make(map[string]string)
+	rename := func(id string) string {
+		if id == "" {
+			return id
+		}
+		if newID, ok := renamed[id]; ok {
+			return newID
+		}
+		newID := newUUID()
+		renamed[id] = newID
+		fixtureIDs[newID] = id
+		return newID
+	}
+	// Keys such as problem_<uuid> embed a uuid
+	renameKeys := func(keys []string) {
+		for i, key := range keys {
+			if j := strings.LastIndex(key, "_"); j >= 0 {
+				keys[i] = key[:j+1] + rename(key[j+1:])
+			} else {
+				keys[i] = rename(key)
+			}
+		}
+	}
+
+	// Storage uuids. Going through their text form keeps us independent
+	// of the uuid package vendored by morpheo-go-packages.
+	var ids []textUUID
+	for i := range fixtures.Storage.Problem {
+		ids = append(ids, &fixtures.Storage.Problem[i].ID)
+	}
+	for i := range fixtures.Storage.Data {
+		ids = append(ids, &fixtures.Storage.Data[i].ID)
+	}
+	for i := range fixtures.Storage.Algo {
+		ids = append(ids, &fixtures.Storage.Algo[i].ID)
+	}
+	for i := range fixtures.Storage.Model {
+		ids = append(ids, &fixtures.Storage.Model[i].ID, &fixtures.Storage.Model[i].Algo)
+	}
+	for _, id := range ids {
+		text, err := id.MarshalText()
+		if err != nil {
+			return err
+		}
+		if err := id.UnmarshalText([]byte(rename(string(text)))); err != nil {
+			return err
+		}
+	}
+
+	// Chaincode references
+	problems, data, algos := fixtures.Chaincode.Problem, fixtures.Chaincode.Data, fixtures.Chaincode.Algo
+	for i := range problems {
+		problems[i].StorageAddress = rename(problems[i].StorageAddress)
+		renameKeys(problems[i].TestData)
+	}
+	for i := range data {
+		data[i].StorageAddress = rename(data[i].StorageAddress)
+		renameKeys(data[i].ProblemKeys)
+	}
+	for i := range algos {
+		algos[i].StorageAddress = rename(algos[i].StorageAddress)
+		renameKeys(algos[i].ProblemKeys)
+	}
+	predictions := fixtures.Chaincode.Prediction
+	for i := range predictions {
+		predictions[i].Data = rename(predictions[i].Data)
+		predictions[i].Problem = rename(predictions[i].Problem)
+	}
+
+	log.Printf("[isolate] Renamed %d fixture UUIDs for this run", len(renamed))
+	return nil
+}
+
+// textUUID is the part of uuid.UUID used to rename it
+type textUUID interface {
+	MarshalText() ([]byte, error)
+	UnmarshalText([]byte) error
+}
+
+func newUUID() string {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		log.Fatalf("[FATAL ERROR] Error generating uuid: %s", err)
+	}
+	b[6] = (b[6] & 0x0f) | 0x40
+	b[8] = (b[8] & 0x3f) | 0x80
+	return fmt.Sprintf("%x-%x-%x-%x-%x", b[0:4], b[4:6], b[6:8], b[8:10], b[10:])
+}
@@ -0,0 +1,141 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+
+	"github.com/MorpheoOrg/morpheo-go-packages/common"
+
+	"github.com/MorpheoOrg/morpheo-devenv/tests/report"
+)
+
+// ModelEntry is an entry of the model_trained.json written by the fastest
+// algo, which appends one with an incremented ID each time it trains
+type ModelEntry struct {
+	ID        int    `json:"id"`
+	Msg       string `json:"msg"`
+	Timestamp int    `json:"timestamp"`
+}
+
+// testModelLineage checks the orchestrator chains the models of the
+// learnuplets of an algo: each learnuplet starts from the model the previous
+// one ended with, so that the models trained by the fastest algo have IDs
+// increasing by exactly one along the chain
+func testModelLineage(suite *report.Suite, fixtures *common.DataParser, registration *Registration) {
+	var (
+		algo        *RegisteredItem
+		learnuplets []common.LearnupletChaincode
+	)
+
+	suite.Run("check chained problem", func() error {
+		if len(fixtures.Chaincode.Algo) == 0 {
+			return fmt.Errorf("no fixture algo")
+		}
+		algo = registration.Algos[fixtures.Chaincode.Algo[0].StorageAddress]
+		if algo == nil {
+			return fmt.Errorf("fixture algo %s was not registered", fixtures.Chaincode.Algo[0].StorageAddress)
+		}
+		for _, problem := range fixtures.Chaincode.Problem {
+			registered := registration.Problems[problem.StorageAddress]
+			if registered == nil || !contains(algo.ProblemKeys, registered.Key) {
+				continue
+			}
+			trainSet := 0
+			for _, data := range registration.Data {
+				if contains(data.ProblemKeys, registered.Key) && !contains(problem.TestData, data.StorageAddress) {
+					trainSet++
+				}
+			}
+			if problem.SizeTrainDataset >= trainSet {
+				return fmt.Errorf("problem %s has sizeTrainDataset %d and %d train data, it should be smaller to chain learnuplets", problem.StorageAddress, problem.SizeTrainDataset, trainSet)
+			}
+			log.Printf("[lineage] Problem %s trains on %d data by learnuplet, out of %d", problem.StorageAddress, problem.SizeTrainDataset, trainSet)
+			return nil
+		}
+		return fmt.Errorf("algo %s is not registered on a fixture problem", algo.Key)
+	})
+
+	suite.Run("wait chain done", func() (err error) {
+		if learnuplets, err = getAlgoLearnuplets(algo.Key); err != nil {
+			return err
+		}
+		if len(learnuplets) < 2 {
+			return fmt.Errorf("algo %s has %d learnuplet(s), expected a chain of at least 2", algo.Key, len(learnuplets))
+		}
+		for _, learnuplet := range learnuplets {
+			if err := waitUpletDone("learnuplet", learnuplet.Key); err != nil {
+				return err
+			}
+		}
+		// Get the model ends set when reporting the learnuplets
+		if learnuplets, err = getAlgoLearnuplets(algo.Key); err != nil {
+			return err
+		}
+		log.Printf("[lineage] The %d learnuplets of algo %s are done", len(learnuplets), algo.Key)
+		return nil
+	})
+
+	suite.Run("check model lineage", func() error {
+		var previous []ModelEntry
+		for i, learnuplet := range learnuplets {
+			if learnuplet.Rank != i {
+				return fmt.Errorf("learnuplet %s has rank %d, expected %d", learnuplet.Key, learnuplet.Rank, i)
+			}
+			if i > 0 && learnuplet.ModelStart != learnuplets[i-1].ModelEnd {
+				return fmt.Errorf("learnuplet %s of rank %d starts from model %s, expected model %s of rank %d", learnuplet.Key, i, learnuplet.ModelStart, learnuplets[i-1].ModelEnd, i-1)
+			}
+
+			model, err := getModel(learnuplet.ModelEnd)
+			if err != nil {
+				return err
+			}
+			if err := checkModelEntries(model, previous); err != nil {
+				return fmt.Errorf("model %s of learnuplet %s of rank %d: %s", learnuplet.ModelEnd, learnuplet.Key, i, err)
+			}
+			log.Printf("[lineage] Model %s of rank %d has IDs %d to %d", learnuplet.ModelEnd, i, model[0].ID, model[len(model)-1].ID)
+			previous = model
+		}
+		log.Println("[lineage] SUCCESSFUL! Model IDs increase by one along the chain.")
+		return nil
+	})
+}
+
+// checkModelEntries checks a model extends the previous model of its chain
+// with exactly one entry, with the next ID
+func checkModelEntries(model, previous []ModelEntry) error {
+	if len(model) != len(previous)+1 {
+		return fmt.Errorf("%d entries, expected %d", len(model), len(previous)+1)
+	}
+	for i, entry := range previous {
+		if model[i].ID != entry.ID {
+			return fmt.Errorf("entry %d has ID %d, whereas the previous model has %d", i, model[i].ID, entry.ID)
+		}
+	}
+	for i := 1; i < len(model); i++ {
+		if model[i].ID != model[i-1].ID+1 {
+			return fmt.Errorf("entry %d has ID %d, expected %d", i, model[i].ID, model[i-1].ID+1)
+		}
+	}
+	return nil
+}
+
+// getModel downloads a model from Storage and decodes its entries
+func getModel(id string) ([]ModelEntry, error) {
+	log.Printf("[storage] Downloading model/%s...", id)
+	blob, err := getStorageBlob("model", id)
+	if err != nil {
+		return nil, err
+	}
+	defer blob.Close()
+	data, err := ioutil.ReadAll(blob)
+	if err != nil {
+		return nil, fmt.Errorf("Error reading model/%s: %s", id, err)
+	}
+	var model []ModelEntry
+	if err := json.Unmarshal(data, &model); err != nil {
+		return nil, fmt.Errorf("Error Unmarshal-ing model/%s: %s", id, err)
+	}
+	return model, nil
+}
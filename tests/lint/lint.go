@@ -0,0 +1,206 @@
+// Package lint checks that the chaincode and storage sections of a fixtures
+// metadata.yaml agree with each other, and with the fixture files under its
+// pathDataFolder. Violations are located by their YAML path, such as
+// chaincode.data[2].problemKeys[0].
+package lint
+
+import (
+	"fmt"
+	"io"
+	"strings"
+
+	"github.com/MorpheoOrg/morpheo-go-packages/common"
+)
+
+const nilUUID = "00000000-0000-0000-0000-000000000000"
+
+// Violation is an inconsistency of the fixtures
+type Violation struct {
+	Location string
+	Message  string
+}
+
+func (v Violation) String() string {
+	return fmt.Sprintf("%s: %s", v.Location, v.Message)
+}
+
+// linter accumulates the violations of a DataParser
+type linter struct {
+	fixtures   *common.DataParser
+	violations []Violation
+}
+
+func (l *linter) addf(location, format string, args ...interface{}) {
+	l.violations = append(l.violations, Violation{location, fmt.Sprintf(format, args...)})
+}
+
+// Fixtures returns all the violations of the fixtures, in YAML order
+func Fixtures(fixtures *common.DataParser) []Violation {
+	l := &linter{fixtures: fixtures}
+
+	// Storage resources, and their files under pathDataFolder
+	storageProblems := l.storageIDs("problem", len(fixtures.Storage.Problem), func(i int) string { return fixtures.Storage.Problem[i].ID.String() })
+	storageData := l.storageIDs("data", len(fixtures.Storage.Data), func(i int) string { return fixtures.Storage.Data[i].ID.String() })
+	storageAlgos := l.storageIDs("algo", len(fixtures.Storage.Algo), func(i int) string { return fixtures.Storage.Algo[i].ID.String() })
+	l.storageIDs("model", len(fixtures.Storage.Model), func(i int) string { return fixtures.Storage.Model[i].ID.String() })
+	for i, model := range fixtures.Storage.Model {
+		location := fmt.Sprintf("storage.model[%d].algo", i)
+		switch algo := model.Algo.String(); {
+		case algo == nilUUID:
+			l.addf(location, "missing algo")
+		case !storageAlgos[algo]:
+			l.addf(location, "algo %s is not in storage.algo", algo)
+		}
+	}
+
+	// Chaincode problems, indexed by storage address
+	problems := make(map[string]bool)
+	for i, problem := range fixtures.Chaincode.Problem {
+		location := fmt.Sprintf("chaincode.problem[%d]", i)
+		l.storageAddress(location, problem.StorageAddress, "problem", storageProblems, problems)
+		if problem.SizeTrainDataset < 1 {
+			l.addf(location+".sizeTrainDataset", "invalid size %d, should be at least 1", problem.SizeTrainDataset)
+		}
+		problems[problem.StorageAddress] = true
+	}
+
+	// Chaincode data, indexed by storage address
+	data := make(map[string][]string)
+	for i, item := range fixtures.Chaincode.Data {
+		location := fmt.Sprintf("chaincode.data[%d]", i)
+		l.storageAddress(location, item.StorageAddress, "data", storageData, registered(data))
+		l.problemKeys(location, item.ProblemKeys, problems)
+		data[item.StorageAddress] = item.ProblemKeys
+	}
+
+	// Chaincode algos
+	algos := make(map[string]bool)
+	for i, item := range fixtures.Chaincode.Algo {
+		location := fmt.Sprintf("chaincode.algo[%d]", i)
+		l.storageAddress(location, item.StorageAddress, "algo", storageAlgos, algos)
+		l.problemKeys(location, item.ProblemKeys, problems)
+		if len(item.ProblemKeys) == 0 {
+			l.addf(location+".problemKeys", "no problem, the algo will never be trained")
+		}
+		algos[item.StorageAddress] = true
+	}
+
+	// Test data must be registered data of the problem, and leave enough
+	// train data for a learnuplet
+	for i, problem := range fixtures.Chaincode.Problem {
+		location := fmt.Sprintf("chaincode.problem[%d]", i)
+		problemKey := "problem_" + problem.StorageAddress
+		isTest := make(map[string]bool)
+		for j, address := range problem.TestData {
+			testLocation := fmt.Sprintf("%s.testData[%d]", location, j)
+			problemKeys, ok := data[address]
+			switch {
+			case !ok:
+				l.addf(testLocation, "data %s is not in chaincode.data", address)
+			case !contains(problemKeys, problemKey):
+				l.addf(testLocation, "data %s is not associated to %s in its problemKeys", address, problemKey)
+			case isTest[address]:
+				l.addf(testLocation, "duplicate test data %s", address)
+			}
+			isTest[address] = true
+		}
+		if len(problem.TestData) == 0 {
+			l.addf(location+".testData", "no test data")
+		}
+		train := 0
+		for _, item := range fixtures.Chaincode.Data {
+			if !isTest[item.StorageAddress] && contains(item.ProblemKeys, problemKey) {
+				train++
+			}
+		}
+		if problem.SizeTrainDataset > 0 && train < problem.SizeTrainDataset {
+			l.addf(location+".sizeTrainDataset", "%d train data only, no learnuplet can be created", train)
+		}
+	}
+
+	// Predictions
+	for i, prediction := range fixtures.Chaincode.Prediction {
+		location := fmt.Sprintf("chaincode.prediction[%d]", i)
+		if _, ok := data[prediction.Data]; !ok {
+			l.addf(location+".data", "data %q is not in chaincode.data", prediction.Data)
+		}
+		if !problems[prediction.Problem] {
+			l.addf(location+".problem", "problem %q is not in chaincode.problem", prediction.Problem)
+		}
+	}
+
+	return l.violations
+}
+
+// storageIDs checks the uuids of a storage section are unique and have a
+// fixture file, and returns them
+func (l *linter) storageIDs(resource string, n int, id func(i int) string) map[string]bool {
+	ids := make(map[string]bool)
+	for i := 0; i < n; i++ {
+		location := fmt.Sprintf("storage.%s[%d].uuid", resource, i)
+		uuid := id(i)
+		switch {
+		case uuid == nilUUID:
+			l.addf(location, "missing uuid")
+			continue
+		case ids[uuid]:
+			l.addf(location, "duplicate uuid %s", uuid)
+		}
+		ids[uuid] = true
+
+		file, err := l.fixtures.GetData(resource, uuid)
+		if err != nil {
+			l.addf(location, "no file under %s: %s", l.fixtures.PathDataFolder, err)
+			continue
+		}
+		if closer, ok := file.(io.Closer); ok {
+			closer.Close()
+		}
+	}
+	return ids
+}
+
+// storageAddress checks a chaincode item references a storage resource, and
+// is not registered twice
+func (l *linter) storageAddress(location, address, resource string, storage, registered map[string]bool) {
+	switch {
+	case address == "":
+		l.addf(location+".storageAddress", "missing storageAddress")
+	case !storage[address]:
+		l.addf(location+".storageAddress", "%s is not in storage.%s", address, resource)
+	case registered[address]:
+		l.addf(location+".storageAddress", "%s is already registered", address)
+	}
+}
+
+// problemKeys checks the problemKeys of a chaincode item point to registered
+// problems
+func (l *linter) problemKeys(location string, keys []string, problems map[string]bool) {
+	for j, key := range keys {
+		keyLocation := fmt.Sprintf("%s.problemKeys[%d]", location, j)
+		if !strings.HasPrefix(key, "problem_") {
+			l.addf(keyLocation, "invalid key %q, should be problem_<storageAddress>", key)
+			continue
+		}
+		if !problems[strings.TrimPrefix(key, "problem_")] {
+			l.addf(keyLocation, "%s is not in chaincode.problem", key)
+		}
+	}
+}
+
+func registered(data map[string][]string) map[string]bool {
+	addresses := make(map[string]bool)
+	for address := range data {
+		addresses[address] = true
+	}
+	return addresses
+}
+
+func contains(list []string, s string) bool {
+	for _, e := range list {
+		if e == s {
+			return true
+		}
+	}
+	return false
+}
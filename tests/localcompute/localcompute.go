@@ -0,0 +1,380 @@
+// Package localcompute emulates the compute worker without Docker. It lays
+// out the learn and predict volumes on local disk and runs the fastest algo
+// and problem binaries directly as subprocesses, using the same
+// "-T train/predict -V" and "-T detarget/perf -i -s" contracts as the worker.
+package localcompute
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/MorpheoOrg/morpheo-go-packages/common"
+)
+
+// Peer is the part of the peer API used by the worker
+type Peer interface {
+	Query(fcn string, args []string) ([]byte, error)
+	Invoke(fcn string, args []string) ([]byte, string, error)
+	QueryStatusLearnuplet(status string) ([]byte, error)
+	ReportLearn(key, status string, perf float64, trainPerf, testPerf map[string]float64) ([]byte, string, error)
+}
+
+// Storage is the part of the Storage API used by the worker. Models are
+// stored as the raw model_trained.json file.
+type Storage interface {
+	GetBlob(resource, id string) (io.ReadCloser, error)
+	PostBlob(resource, id string, blob []byte) error
+}
+
+// Perfuplet describes the performance.json file, an output of learning tasks
+type Perfuplet struct {
+	Perf      float64            `json:"perf"`
+	TrainPerf map[string]float64 `json:"train_perf"`
+	TestPerf  map[string]float64 `json:"test_perf"`
+}
+
+// Preduplet is the part of a chaincode preduplet used by the worker
+type Preduplet struct {
+	Key        string `json:"key"`
+	Data       string `json:"data"`
+	Model      string `json:"model"`
+	Prediction string `json:"prediction"`
+	Status     string `json:"status"`
+}
+
+// Worker takes todo uplets on the peer and runs them locally
+type Worker struct {
+	ID      string
+	WorkDir string
+
+	// Fixture binaries, and the directory holding their /fixtures files
+	AlgoBin         string
+	AlgoFixtures    string
+	ProblemBin      string
+	ProblemFixtures string
+	// AlgoEnv is added to the environment of every algo, before its own Env
+	AlgoEnv []string
+
+	// TaskTimeout bounds each subprocess, like the worker's -learn-timeout
+	TaskTimeout time.Duration
+
+	Peer    Peer
+	Storage Storage
+
+	// algos override the defaults for some algos, indexed by storage
+	// address
+	mu    sync.Mutex
+	algos map[string]Algo
+}
+
+// Algo is how the worker runs the learnuplets of an algo, the counterpart of
+// its docker image
+type Algo struct {
+	// Bin replaces AlgoBin, if set
+	Bin string
+	// Env is added to the environment of the algo, such as FASTEST_FAULT
+	Env []string
+	// Skip leaves the learnuplets of the algo to another worker, such as
+	// the tests reporting them directly
+	Skip bool
+	// Model is the storage uuid of a pre-trained model the first learnuplet
+	// of the algo starts from, instead of training from scratch. The
+	// chaincode has no notion of it: it is a side channel of this worker,
+	// which the compute workers do not offer.
+	Model string
+}
+
+// SetAlgo sets how the worker runs the algo stored at address. It should be
+// called before registering the algo on the peer.
+func (w *Worker) SetAlgo(address string, algo Algo) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.algos == nil {
+		w.algos = make(map[string]Algo)
+	}
+	w.algos[address] = algo
+}
+
+// algo returns how to run an algo, referenced by its storage address or by
+// its ledger key algo_<storageAddress>
+func (w *Worker) algo(ref string) Algo {
+	w.mu.Lock()
+	algo, ok := w.algos[ref]
+	if !ok {
+		algo = w.algos[ref[strings.LastIndex(ref, "_")+1:]]
+	}
+	w.mu.Unlock()
+	if algo.Bin == "" {
+		algo.Bin = w.AlgoBin
+	}
+	return algo
+}
+
+// Run processes todo uplets every interval, until stop is closed
+func (w *Worker) Run(interval time.Duration, stop <-chan struct{}) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		if err := w.RunOnce(); err != nil {
+			log.Printf("[localcompute] %s", err)
+		}
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// RunOnce processes all the learnuplets and preduplets with status "todo"
+func (w *Worker) RunOnce() error {
+	learnupletsBytes, err := w.Peer.QueryStatusLearnuplet(common.TaskStatusTodo)
+	if err != nil {
+		return fmt.Errorf("Error getting todo learnuplets: %s", err)
+	}
+	var learnuplets []common.LearnupletChaincode
+	if err := json.Unmarshal(learnupletsBytes, &learnuplets); err != nil {
+		return fmt.Errorf("Error Unmarshal-ing todo learnuplets: %s", err)
+	}
+	for _, learnuplet := range learnuplets {
+		if w.algo(learnuplet.Algo).Skip {
+			continue
+		}
+		if err := w.HandleLearn(learnuplet); err != nil {
+			return err
+		}
+	}
+
+	predupletsBytes, err := w.Peer.Query("queryItems", []string{"preduplet"})
+	if err != nil {
+		return fmt.Errorf("Error getting preduplets: %s", err)
+	}
+	var preduplets []Preduplet
+	if err := json.Unmarshal(predupletsBytes, &preduplets); err != nil {
+		return fmt.Errorf("Error Unmarshal-ing preduplets: %s", err)
+	}
+	for _, preduplet := range preduplets {
+		if preduplet.Status != common.TaskStatusTodo {
+			continue
+		}
+		if err := w.HandlePred(preduplet); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// HandleLearn takes a learnuplet, runs the learn pipeline and reports its
+// outcome. Failures of the pipeline are reported as a failed learnuplet.
+func (w *Worker) HandleLearn(learnuplet common.LearnupletChaincode) error {
+	if _, _, err := w.Peer.Invoke("setUpletWorker", []string{learnuplet.Key, w.ID}); err != nil {
+		return fmt.Errorf("Error taking learnuplet %s: %s", learnuplet.Key, err)
+	}
+	log.Printf("[localcompute] Learning on learnuplet %s (rank %d)", learnuplet.Key, learnuplet.Rank)
+
+	perf, err := w.Learn(learnuplet)
+	if err != nil {
+		log.Printf("[localcompute] Learnuplet %s failed: %s", learnuplet.Key, err)
+		if _, _, err := w.Peer.ReportLearn(learnuplet.Key, common.TaskStatusFailed, 0, nil, nil); err != nil {
+			return fmt.Errorf("Error reporting failed learnuplet %s: %s", learnuplet.Key, err)
+		}
+		return nil
+	}
+
+	if _, _, err := w.Peer.ReportLearn(learnuplet.Key, common.TaskStatusDone, perf.Perf, perf.TrainPerf, perf.TestPerf); err != nil {
+		return fmt.Errorf("Error reporting learnuplet %s: %s", learnuplet.Key, err)
+	}
+	log.Printf("[localcompute] Learnuplet %s done with perf %f", learnuplet.Key, perf.Perf)
+	return nil
+}
+
+// Learn runs detarget, train, predict and perf on a learnuplet, uploads the
+// trained model and returns the computed performance
+func (w *Worker) Learn(learnuplet common.LearnupletChaincode) (*Perfuplet, error) {
+	root := filepath.Join(w.WorkDir, learnuplet.Key)
+	hidden := filepath.Join(root, "hidden")
+	submission := filepath.Join(root, "submission")
+	defer os.RemoveAll(root)
+
+	for _, dir := range []string{
+		filepath.Join(hidden, "test"),
+		filepath.Join(hidden, "perf"),
+		filepath.Join(submission, "train"),
+		filepath.Join(submission, "test"),
+		filepath.Join(submission, "model"),
+	} {
+		if err := os.MkdirAll(dir, 0755); err != nil {
+			return nil, err
+		}
+	}
+
+	// Fetch the data and the starting model
+	for _, id := range learnuplet.TrainData {
+		if err := w.fetch("data", id, filepath.Join(submission, "train", id)); err != nil {
+			return nil, err
+		}
+	}
+	for _, id := range learnuplet.TestData {
+		if err := w.fetch("data", id, filepath.Join(hidden, "test", id)); err != nil {
+			return nil, err
+		}
+	}
+	algo := w.algo(learnuplet.Algo)
+	pathModel := filepath.Join(submission, "model", "model_trained.json")
+	if learnuplet.Rank > 0 {
+		if err := w.fetch("model", learnuplet.ModelStart, pathModel); err != nil {
+			return nil, err
+		}
+	} else if algo.Model != "" {
+		log.Printf("[localcompute] Learnuplet %s starts from pre-trained model %s", learnuplet.Key, algo.Model)
+		if err := w.fetch("model", algo.Model, pathModel); err != nil {
+			return nil, err
+		}
+	}
+
+	// Run the pipeline
+	if err := w.runProblem("detarget", hidden, submission); err != nil {
+		return nil, err
+	}
+	if err := w.runAlgo(algo, "train", submission); err != nil {
+		return nil, err
+	}
+	if err := w.runAlgo(algo, "predict", submission); err != nil {
+		return nil, err
+	}
+	if err := w.runProblem("perf", hidden, submission); err != nil {
+		return nil, err
+	}
+
+	// Save the trained model and read the performance
+	model, err := ioutil.ReadFile(pathModel)
+	if err != nil {
+		return nil, fmt.Errorf("Error reading trained model: %s", err)
+	}
+	if err := w.Storage.PostBlob("model", learnuplet.ModelEnd, model); err != nil {
+		return nil, fmt.Errorf("Error posting model %s: %s", learnuplet.ModelEnd, err)
+	}
+	perfBytes, err := ioutil.ReadFile(filepath.Join(hidden, "perf", "performance.json"))
+	if err != nil {
+		return nil, fmt.Errorf("Error reading performance: %s", err)
+	}
+	perf := &Perfuplet{}
+	if err := json.Unmarshal(perfBytes, perf); err != nil {
+		return nil, fmt.Errorf("Error Unmarshal-ing performance: %s", err)
+	}
+	return perf, nil
+}
+
+// HandlePred takes a preduplet, predicts on its data and uploads the prediction
+func (w *Worker) HandlePred(preduplet Preduplet) error {
+	if _, _, err := w.Peer.Invoke("setUpletWorker", []string{preduplet.Key, w.ID}); err != nil {
+		return fmt.Errorf("Error taking preduplet %s: %s", preduplet.Key, err)
+	}
+	log.Printf("[localcompute] Predicting on preduplet %s", preduplet.Key)
+
+	status := common.TaskStatusDone
+	if err := w.Predict(preduplet); err != nil {
+		log.Printf("[localcompute] Preduplet %s failed: %s", preduplet.Key, err)
+		status = common.TaskStatusFailed
+	}
+	if _, _, err := w.Peer.Invoke("reportPrediction", []string{preduplet.Key, status}); err != nil {
+		return fmt.Errorf("Error reporting preduplet %s: %s", preduplet.Key, err)
+	}
+	return nil
+}
+
+// Predict runs the algo predict task on the preduplet data and uploads the
+// resulting prediction to Storage
+func (w *Worker) Predict(preduplet Preduplet) error {
+	root := filepath.Join(w.WorkDir, preduplet.Key)
+	defer os.RemoveAll(root)
+	for _, dir := range []string{filepath.Join(root, "test"), filepath.Join(root, "model")} {
+		if err := os.MkdirAll(dir, 0755); err != nil {
+			return err
+		}
+	}
+
+	if err := w.fetch("data", preduplet.Data, filepath.Join(root, "test", preduplet.Data)); err != nil {
+		return err
+	}
+	if err := w.fetch("model", preduplet.Model, filepath.Join(root, "model", "model_trained.json")); err != nil {
+		return err
+	}
+	if err := w.runAlgo(Algo{Bin: w.AlgoBin}, "predict", root); err != nil {
+		return err
+	}
+
+	prediction, err := ioutil.ReadFile(filepath.Join(root, "test", "pred", preduplet.Data))
+	if err != nil {
+		return fmt.Errorf("Error reading prediction: %s", err)
+	}
+	return w.Storage.PostBlob("prediction", preduplet.Prediction, prediction)
+}
+
+func (w *Worker) runAlgo(algo Algo, task, volume string) error {
+	env := append(append([]string(nil), w.AlgoEnv...), algo.Env...)
+	return w.run(algo.Bin, env, "-T", task, "-V", volume, "-fixtures", w.AlgoFixtures)
+}
+
+func (w *Worker) runProblem(task, hidden, submission string) error {
+	return w.run(w.ProblemBin, nil, "-T", task, "-i", hidden, "-s", submission, "-fixtures", w.ProblemFixtures)
+}
+
+func (w *Worker) run(bin string, env []string, args ...string) error {
+	var output bytes.Buffer
+	cmd := exec.Command(bin, args...)
+	if len(env) > 0 {
+		cmd.Env = append(os.Environ(), env...)
+	}
+	cmd.Stdout = &output
+	cmd.Stderr = &output
+	if err := cmd.Start(); err != nil {
+		return fmt.Errorf("Error starting %s: %s", bin, err)
+	}
+
+	done := make(chan error, 1)
+	go func() { done <- cmd.Wait() }()
+
+	var timeout <-chan time.Time
+	if w.TaskTimeout > 0 {
+		timeout = time.After(w.TaskTimeout)
+	}
+	select {
+	case err := <-done:
+		if err != nil {
+			return fmt.Errorf("%s %v: %s. Output:\n%s", filepath.Base(bin), args, err, output.String())
+		}
+		return nil
+	case <-timeout:
+		cmd.Process.Kill()
+		<-done
+		return fmt.Errorf("%s %v: timed out after %s", filepath.Base(bin), args, w.TaskTimeout)
+	}
+}
+
+func (w *Worker) fetch(resource, id, dst string) error {
+	blob, err := w.Storage.GetBlob(resource, id)
+	if err != nil {
+		return fmt.Errorf("Error getting %s/%s: %s", resource, id, err)
+	}
+	defer blob.Close()
+	out, err := os.Create(dst)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(out, blob); err != nil {
+		out.Close()
+		return fmt.Errorf("Error downloading %s/%s: %s", resource, id, err)
+	}
+	return out.Close()
+}
@@ -0,0 +1,313 @@
+// Package localstorage provides a stand-in for the Storage API, keeping blobs
+// on local disk. It serves the problem, data, algo, model and prediction
+// endpoints with basic authentication, so that the integration tests can run
+// without docker-compose.
+package localstorage
+
+import (
+	"crypto/sha256"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"mime"
+	"mime/multipart"
+	"net/http"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Resources lists the resource types served by the Storage
+var Resources = []string{"problem", "data", "algo", "model", "prediction"}
+
+var validUUID = regexp.MustCompile("^[0-9a-fA-F]{8}-[0-9a-fA-F]{4}-[0-9a-fA-F]{4}-[0-9a-fA-F]{4}-[0-9a-fA-F]{12}$")
+
+// Resource holds the metadata of a stored blob
+type Resource struct {
+	ID          string `json:"uuid"`
+	Name        string `json:"name,omitempty"`
+	Description string `json:"description,omitempty"`
+	Algo        string `json:"algo,omitempty"`
+	Size        int64  `json:"size"`
+	Checksum    string `json:"checksum"`
+	Timestamp   int64  `json:"timestamp_upload"`
+}
+
+// Server is an HTTP handler implementing the Storage API on local disk
+type Server struct {
+	Dir      string
+	User     string
+	Password string
+
+	mu sync.Mutex
+}
+
+// NewServer creates a Storage server keeping its blobs in dir
+func NewServer(dir, user, password string) (*Server, error) {
+	for _, resource := range Resources {
+		if err := os.MkdirAll(filepath.Join(dir, resource), 0755); err != nil {
+			return nil, fmt.Errorf("Error creating storage directory: %s", err)
+		}
+	}
+	return &Server{Dir: dir, User: user, Password: password}, nil
+}
+
+// ServeHTTP routes the Storage API requests:
+//
+//	GET    /<resource>             lists the resources metadata
+//	POST   /<resource>             uploads a blob and its metadata
+//	GET    /<resource>/<uuid>      returns the metadata of a resource
+//	GET    /<resource>/<uuid>/blob returns the blob of a resource
+//	DELETE /<resource>/<uuid>      deletes a resource
+func (s *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if user, password, ok := r.BasicAuth(); !ok || user != s.User || password != s.Password {
+		w.Header().Set("WWW-Authenticate", `Basic realm="storage"`)
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	parts := strings.Split(strings.Trim(r.URL.Path, "/"), "/")
+	if !isResource(parts[0]) {
+		http.NotFound(w, r)
+		return
+	}
+	resource := parts[0]
+	if len(parts) > 1 && !validUUID.MatchString(parts[1]) {
+		http.Error(w, fmt.Sprintf("Invalid uuid %s", parts[1]), http.StatusBadRequest)
+		return
+	}
+
+	switch {
+	case len(parts) == 1 && r.Method == http.MethodGet:
+		s.list(w, resource)
+	case len(parts) == 1 && r.Method == http.MethodPost:
+		s.post(w, r, resource)
+	case len(parts) == 2 && r.Method == http.MethodGet:
+		s.get(w, resource, parts[1])
+	case len(parts) == 2 && r.Method == http.MethodDelete:
+		s.delete(w, resource, parts[1])
+	case len(parts) == 3 && parts[2] == "blob" && r.Method == http.MethodGet:
+		s.getBlob(w, r, resource, parts[1])
+	default:
+		http.Error(w, "Method Not Allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+func (s *Server) list(w http.ResponseWriter, resource string) {
+	files, err := filepath.Glob(filepath.Join(s.Dir, resource, "*.json"))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	sort.Strings(files)
+	resources := []*Resource{}
+	for _, file := range files {
+		res, err := readMetadata(file)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		resources = append(resources, res)
+	}
+	writeJSON(w, http.StatusOK, resources)
+}
+
+func (s *Server) get(w http.ResponseWriter, resource, id string) {
+	res, err := readMetadata(s.metadataPath(resource, id))
+	if os.IsNotExist(err) {
+		http.Error(w, fmt.Sprintf("%s %s not found", resource, id), http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	writeJSON(w, http.StatusOK, res)
+}
+
+func (s *Server) getBlob(w http.ResponseWriter, r *http.Request, resource, id string) {
+	f, err := os.Open(s.blobPath(resource, id))
+	if os.IsNotExist(err) {
+		http.NotFound(w, r)
+		return
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	defer f.Close()
+	w.Header().Set("Content-Type", "application/octet-stream")
+	if _, err := io.Copy(w, f); err != nil {
+		log.Printf("[localstorage] Error sending %s/%s: %s", resource, id, err)
+	}
+}
+
+func (s *Server) delete(w http.ResponseWriter, resource, id string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if _, err := os.Stat(s.metadataPath(resource, id)); os.IsNotExist(err) {
+		http.Error(w, fmt.Sprintf("%s %s not found", resource, id), http.StatusNotFound)
+		return
+	}
+	for _, path := range []string{s.metadataPath(resource, id), s.blobPath(resource, id)} {
+		if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// post stores a blob sent either as a multipart form (metadata as form
+// fields, blob as the file part) or as a raw body (metadata as URL params)
+func (s *Server) post(w http.ResponseWriter, r *http.Request, resource string) {
+	res := &Resource{Timestamp: time.Now().Unix()}
+
+	tmp, err := ioutil.TempFile(filepath.Join(s.Dir, resource), ".upload-")
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	defer os.Remove(tmp.Name())
+	defer tmp.Close()
+	hash := sha256.New()
+	dst := io.MultiWriter(tmp, hash)
+
+	mediaType, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	if mediaType == "multipart/form-data" {
+		reader, err := r.MultipartReader()
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if res.Size, err = readMultipart(reader, res, dst); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+	} else {
+		setField(res, r.URL.Query())
+		if res.Size, err = io.Copy(dst, r.Body); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+	}
+	res.Checksum = fmt.Sprintf("%x", hash.Sum(nil))
+
+	if !validUUID.MatchString(res.ID) {
+		http.Error(w, fmt.Sprintf("Invalid uuid %q", res.ID), http.StatusBadRequest)
+		return
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, err := os.Stat(s.metadataPath(resource, res.ID)); err == nil {
+		http.Error(w, fmt.Sprintf("%s %s already exists", resource, res.ID), http.StatusConflict)
+		return
+	}
+	if err := tmp.Close(); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if err := os.Rename(tmp.Name(), s.blobPath(resource, res.ID)); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	metadata, err := json.Marshal(res)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if err := ioutil.WriteFile(s.metadataPath(resource, res.ID), metadata, 0644); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	log.Printf("[localstorage] Stored %s/%s (%d bytes)", resource, res.ID, res.Size)
+	writeJSON(w, http.StatusCreated, res)
+}
+
+func readMultipart(reader *multipart.Reader, res *Resource, dst io.Writer) (size int64, err error) {
+	for {
+		part, err := reader.NextPart()
+		if err == io.EOF {
+			return size, nil
+		}
+		if err != nil {
+			return size, err
+		}
+		if part.FileName() != "" {
+			n, err := io.Copy(dst, part)
+			if err != nil {
+				return size, err
+			}
+			size += n
+			continue
+		}
+		value, err := ioutil.ReadAll(io.LimitReader(part, 1<<20))
+		if err != nil {
+			return size, err
+		}
+		setField(res, map[string][]string{part.FormName(): {string(value)}})
+	}
+}
+
+func setField(res *Resource, values map[string][]string) {
+	for key, value := range values {
+		if len(value) == 0 {
+			continue
+		}
+		switch key {
+		case "uuid":
+			res.ID = value[0]
+		case "name":
+			res.Name = value[0]
+		case "description":
+			res.Description = value[0]
+		case "algo":
+			res.Algo = value[0]
+		}
+	}
+}
+
+func (s *Server) blobPath(resource, id string) string {
+	return filepath.Join(s.Dir, resource, id)
+}
+
+func (s *Server) metadataPath(resource, id string) string {
+	return filepath.Join(s.Dir, resource, id+".json")
+}
+
+func readMetadata(path string) (*Resource, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	res := &Resource{}
+	if err := json.Unmarshal(data, res); err != nil {
+		return nil, fmt.Errorf("Error reading metadata %s: %s", path, err)
+	}
+	return res, nil
+}
+
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		log.Printf("[localstorage] Error encoding response: %s", err)
+	}
+}
+
+func isResource(s string) bool {
+	for _, resource := range Resources {
+		if s == resource {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,142 @@
+// Package pipeline runs the setup tasks of the integration tests, such as
+// posting and registering fixtures, with a bounded concurrency. Tasks are
+// grouped in stages run one after the other, so that a stage may depend on
+// the previous ones, and the errors of all the tasks are collected instead of
+// stopping at the first one.
+package pipeline
+
+import (
+	"fmt"
+	"log"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Task is a unit of work of a stage
+type Task struct {
+	Name string
+	Run  func() error
+}
+
+// TaskError is the error of a failed task
+type TaskError struct {
+	Task string
+	Err  error
+}
+
+func (e *TaskError) Error() string {
+	return fmt.Sprintf("%s: %s", e.Task, e.Err)
+}
+
+// Errors aggregates the errors of the failed tasks of a pipeline
+type Errors []*TaskError
+
+func (e Errors) Error() string {
+	msgs := make([]string, len(e))
+	for i, err := range e {
+		msgs[i] = err.Error()
+	}
+	return fmt.Sprintf("%d task(s) failed:\n  %s", len(e), strings.Join(msgs, "\n  "))
+}
+
+// Pipeline runs stages of tasks, up to Parallel tasks at a time
+type Pipeline struct {
+	Name     string
+	Parallel int
+
+	stages [][]Task
+}
+
+// New creates a pipeline running up to parallel tasks at a time, named name
+// in the progress logs
+func New(name string, parallel int) *Pipeline {
+	if parallel < 1 {
+		parallel = 1
+	}
+	return &Pipeline{Name: name, Parallel: parallel}
+}
+
+// Stage adds a stage, whose tasks start once all the tasks of the previous
+// stages are done. Empty stages are skipped.
+func (p *Pipeline) Stage(tasks ...Task) {
+	if len(tasks) > 0 {
+		p.stages = append(p.stages, tasks)
+	}
+}
+
+// Run runs the stages, and returns the Errors of the failed tasks, if any.
+// The stages following a stage with failed tasks are not run, as they may
+// depend on them.
+func (p *Pipeline) Run() error {
+	total := 0
+	for _, stage := range p.stages {
+		total += len(stage)
+	}
+	progress := &progress{name: p.Name, total: total, start: time.Now()}
+
+	for i, stage := range p.stages {
+		if errs := p.runStage(stage, progress); len(errs) > 0 {
+			if skipped := total - progress.done; skipped > 0 {
+				log.Printf("[%s] Stage %d/%d failed, skipping the %d remaining task(s)", p.Name, i+1, len(p.stages), skipped)
+			}
+			return errs
+		}
+	}
+	log.Printf("[%s] %d task(s) done in %s", p.Name, total, time.Since(progress.start).Round(time.Millisecond))
+	return nil
+}
+
+func (p *Pipeline) runStage(stage []Task, progress *progress) Errors {
+	var (
+		mu   sync.Mutex
+		errs Errors
+		wg   sync.WaitGroup
+	)
+	tasks := make(chan Task)
+	workers := p.Parallel
+	if workers > len(stage) {
+		workers = len(stage)
+	}
+	for i := 0; i < workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for task := range tasks {
+				err := task.Run()
+				mu.Lock()
+				if err != nil {
+					errs = append(errs, &TaskError{Task: task.Name, Err: err})
+				}
+				progress.taskDone(err != nil)
+				mu.Unlock()
+			}
+		}()
+	}
+	for _, task := range stage {
+		tasks <- task
+	}
+	close(tasks)
+	wg.Wait()
+	return errs
+}
+
+// progress logs the share of done tasks every 10%, for pipelines of at
+// least 10 tasks
+type progress struct {
+	name   string
+	total  int
+	done   int
+	failed int
+	start  time.Time
+}
+
+func (p *progress) taskDone(failed bool) {
+	p.done++
+	if failed {
+		p.failed++
+	}
+	if p.total >= 10 && p.done*10/p.total != (p.done-1)*10/p.total {
+		log.Printf("[%s] %d/%d task(s) done (%d%%), %d failed, in %s", p.name, p.done, p.total, p.done*100/p.total, p.failed, time.Since(p.start).Round(time.Millisecond))
+	}
+}
@@ -0,0 +1,93 @@
+package pipeline
+
+import (
+	"fmt"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestParallel(t *testing.T) {
+	for _, parallel := range []int{1, 3} {
+		var running, max int32
+		var mu sync.Mutex
+		task := func() error {
+			n := atomic.AddInt32(&running, 1)
+			defer atomic.AddInt32(&running, -1)
+			mu.Lock()
+			if n > max {
+				max = n
+			}
+			mu.Unlock()
+			// Give the other workers the time to start their tasks
+			for deadline := time.Now().Add(100 * time.Millisecond); atomic.LoadInt32(&running) < int32(parallel) && time.Now().Before(deadline); {
+				time.Sleep(time.Millisecond)
+			}
+			return nil
+		}
+
+		p := New("test", parallel)
+		var tasks []Task
+		for i := 0; i < 10; i++ {
+			tasks = append(tasks, Task{Name: fmt.Sprintf("task %d", i), Run: task})
+		}
+		p.Stage(tasks...)
+		if err := p.Run(); err != nil {
+			t.Fatalf("parallel %d: %s", parallel, err)
+		}
+		if max != int32(parallel) {
+			t.Errorf("parallel %d: up to %d task(s) ran at once", parallel, max)
+		}
+	}
+}
+
+func TestErrors(t *testing.T) {
+	var ran, skipped int32
+	p := New("test", 2)
+	var tasks []Task
+	for i := 0; i < 5; i++ {
+		i := i
+		tasks = append(tasks, Task{Name: fmt.Sprintf("task %d", i), Run: func() error {
+			atomic.AddInt32(&ran, 1)
+			if i%2 == 1 {
+				return fmt.Errorf("error %d", i)
+			}
+			return nil
+		}})
+	}
+	p.Stage(tasks...)
+	p.Stage(Task{Name: "later", Run: func() error {
+		atomic.AddInt32(&skipped, 1)
+		return nil
+	}})
+
+	err := p.Run()
+	errs, ok := err.(Errors)
+	if !ok {
+		t.Fatalf("got error %v, expected Errors", err)
+	}
+	var msgs []string
+	for _, taskErr := range errs {
+		msgs = append(msgs, taskErr.Error())
+	}
+	sort.Strings(msgs)
+	if expected := []string{"task 1: error 1", "task 3: error 3"}; fmt.Sprint(msgs) != fmt.Sprint(expected) {
+		t.Errorf("got errors %q, expected %q", msgs, expected)
+	}
+	if ran != 5 {
+		t.Errorf("%d task(s) of the failed stage ran, expected all 5", ran)
+	}
+	if skipped != 0 {
+		t.Error("the stage following a failed stage ran")
+	}
+}
+
+func TestNoTasks(t *testing.T) {
+	p := New("test", 0)
+	p.Stage()
+	if err := p.Run(); err != nil {
+		t.Errorf("empty pipeline failed: %s", err)
+	}
+}
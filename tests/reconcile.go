@@ -0,0 +1,361 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"sort"
+	"strings"
+
+	"github.com/MorpheoOrg/morpheo-go-packages/common"
+
+	"github.com/MorpheoOrg/morpheo-devenv/tests/fixtures/checksums"
+)
+
+// reconcileKinds are the kinds of items both posted to Storage and
+// registered on the ledger, in registration order
+var reconcileKinds = []string{"problem", "data", "algo"}
+
+// ReconcileEntry is a problem, data or algo as seen by Storage, the ledger
+// and metadata.yaml, joined on its storage address
+type ReconcileEntry struct {
+	Kind    string
+	Address string
+
+	// Stored is set if Storage has the item, with the sha256 of its blob
+	Stored   bool
+	Checksum string
+	// LedgerKeys are the keys of the ledger items pointing to the address
+	LedgerKeys []string
+
+	// DeclaredStorage and DeclaredChaincode are set if metadata.yaml declares
+	// the item in its storage and chaincode sections. FixtureChecksum is the
+	// sha256 of the fixture file, if any.
+	DeclaredStorage   bool
+	DeclaredChaincode bool
+	FixtureChecksum   string
+}
+
+// Issues returns what is wrong with the entry:
+//   - missing: the ledger points to it, but Storage does not have it
+//   - orphaned: Storage has it, but no ledger item points to it
+//   - drifted: the blob on Storage differs from the fixture file
+//   - absent: metadata.yaml declares it, but it is on neither side
+func (e *ReconcileEntry) Issues() []string {
+	var issues []string
+	switch {
+	case !e.Stored && len(e.LedgerKeys) > 0:
+		issues = append(issues, "missing")
+	case e.Stored && len(e.LedgerKeys) == 0:
+		issues = append(issues, "orphaned")
+	case !e.Stored && (e.DeclaredStorage || e.DeclaredChaincode):
+		issues = append(issues, "absent")
+	}
+	if e.Stored && e.FixtureChecksum != "" && e.Checksum != e.FixtureChecksum {
+		issues = append(issues, "drifted")
+	}
+	return issues
+}
+
+// HasIssue tells whether the entry has an issue
+func (e *ReconcileEntry) HasIssue(issue string) bool {
+	for _, i := range e.Issues() {
+		if i == issue {
+			return true
+		}
+	}
+	return false
+}
+
+func (e *ReconcileEntry) String() string {
+	var details []string
+	if e.Stored {
+		details = append(details, "stored with sha256 "+e.Checksum)
+	} else {
+		details = append(details, "not on Storage")
+	}
+	if len(e.LedgerKeys) > 0 {
+		details = append(details, "registered as "+strings.Join(e.LedgerKeys, ", "))
+	} else {
+		details = append(details, "not on the ledger")
+	}
+	if e.FixtureChecksum != "" {
+		details = append(details, "fixture sha256 "+e.FixtureChecksum)
+	} else if e.DeclaredStorage || e.DeclaredChaincode {
+		details = append(details, "no fixture file")
+	}
+	return fmt.Sprintf("%s/%s: %s", e.Kind, e.Address, strings.Join(details, ", "))
+}
+
+// reconcileCommand compares the problems, data and algos on Storage, on the
+// ledger and in metadata.yaml, and prints the inconsistent ones. With -fix,
+// it first posts and registers again the items metadata.yaml declares.
+func reconcileCommand(args []string) error {
+	fs := flag.NewFlagSet("reconcile", flag.ExitOnError)
+	fix := fs.Bool("fix", false, "Post the missing blobs and register the missing items from metadata.yaml")
+	fs.Parse(args)
+
+	fixtures, err := common.ParseDataFromFile(pathFixturesYAML)
+	if err != nil {
+		return fmt.Errorf("Error parsing %s: %s", pathFixturesYAML, err)
+	}
+	entries, err := reconcileEntries(fixtures)
+	if err != nil {
+		return err
+	}
+	if *fix {
+		if err := fixReconcile(fixtures, entries); err != nil {
+			return err
+		}
+		if entries, err = reconcileEntries(fixtures); err != nil {
+			return err
+		}
+	}
+
+	counts := make(map[string]int)
+	for _, entry := range entries {
+		for _, issue := range entry.Issues() {
+			fmt.Printf("%-9s %s\n", issue, entry)
+			counts[issue]++
+		}
+	}
+	log.Printf("[reconcile] %d item(s): %d missing, %d orphaned, %d drifted, %d absent",
+		len(entries), counts["missing"], counts["orphaned"], counts["drifted"], counts["absent"])
+	if len(counts) > 0 {
+		return fmt.Errorf("Storage and the ledger are not consistent")
+	}
+	log.Println("[reconcile] Storage and the ledger are consistent")
+	return nil
+}
+
+// reconcileEntries lists the items of Storage, of the ledger and of the
+// fixtures, joined on their storage address, by kind then address
+func reconcileEntries(fixtures *common.DataParser) ([]*ReconcileEntry, error) {
+	byAddress := make(map[string]*ReconcileEntry)
+	entry := func(kind, address string) *ReconcileEntry {
+		key := kind + "/" + address
+		if byAddress[key] == nil {
+			byAddress[key] = &ReconcileEntry{Kind: kind, Address: address}
+		}
+		return byAddress[key]
+	}
+
+	for _, kind := range reconcileKinds {
+		resources, err := listStorage(kind)
+		if err != nil {
+			return nil, err
+		}
+		for _, resource := range resources {
+			e := entry(kind, resource.ID)
+			e.Stored = true
+			// The checksum Storage records is not trusted: a corrupted
+			// blob is exactly what reconcile looks for
+			if e.Checksum, err = hashStorageBlob(kind, resource.ID); err != nil {
+				return nil, err
+			}
+		}
+
+		items, err := listLedger(kind)
+		if err != nil {
+			return nil, err
+		}
+		for _, item := range items {
+			e := entry(kind, item.StorageAddress)
+			e.LedgerKeys = append(e.LedgerKeys, item.Key)
+		}
+	}
+
+	for _, problem := range fixtures.Storage.Problem {
+		entry("problem", problem.ID.String()).DeclaredStorage = true
+	}
+	for _, data := range fixtures.Storage.Data {
+		entry("data", data.ID.String()).DeclaredStorage = true
+	}
+	for _, algo := range fixtures.Storage.Algo {
+		entry("algo", algo.ID.String()).DeclaredStorage = true
+	}
+	for _, problem := range fixtures.Chaincode.Problem {
+		entry("problem", problem.StorageAddress).DeclaredChaincode = true
+	}
+	for _, data := range fixtures.Chaincode.Data {
+		entry("data", data.StorageAddress).DeclaredChaincode = true
+	}
+	for _, algo := range fixtures.Chaincode.Algo {
+		entry("algo", algo.StorageAddress).DeclaredChaincode = true
+	}
+
+	entries := make([]*ReconcileEntry, 0, len(byAddress))
+	for _, e := range byAddress {
+		if e.DeclaredStorage || e.DeclaredChaincode {
+			e.FixtureChecksum = sumFixture(fixtures, e.Kind, e.Address)
+		}
+		entries = append(entries, e)
+	}
+	order := make(map[string]int)
+	for i, kind := range reconcileKinds {
+		order[kind] = i
+	}
+	sort.Slice(entries, func(i, j int) bool {
+		if entries[i].Kind != entries[j].Kind {
+			return order[entries[i].Kind] < order[entries[j].Kind]
+		}
+		return entries[i].Address < entries[j].Address
+	})
+	return entries, nil
+}
+
+// fixReconcile posts the fixture blobs Storage does not have, and replaces the
+// drifted ones with -replace, then registers the fixture items the ledger does
+// not have. It cannot fix orphaned items metadata.yaml does not declare.
+func fixReconcile(fixtures *common.DataParser, entries []*ReconcileEntry) error {
+	registration := newRegistration()
+	for _, e := range entries {
+		if e.Kind == "problem" && len(e.LedgerKeys) > 0 {
+			registration.Problems[e.Address] = &RegisteredProblem{Key: e.LedgerKeys[0], StorageAddress: e.Address}
+		}
+	}
+
+	posted, registered := 0, 0
+	for _, e := range entries {
+		if !e.DeclaredStorage || (e.Stored && !(e.HasIssue("drifted") && cfg.Replace)) {
+			continue
+		}
+		if e.FixtureChecksum == "" {
+			log.Printf("[reconcile] Cannot post %s/%s: no fixture file", e.Kind, e.Address)
+			continue
+		}
+		if err := postFixture(fixtures, e.Kind, e.Address); err != nil {
+			return err
+		}
+		posted++
+	}
+	// Entries are sorted by kind, so that problems are registered before the
+	// data and algos referencing them
+	for _, e := range entries {
+		if len(e.LedgerKeys) > 0 || !e.DeclaredChaincode {
+			continue
+		}
+		if err := registerFixture(registration, fixtures, e.Kind, e.Address); err != nil {
+			return err
+		}
+		registered++
+	}
+	for _, e := range entries {
+		if e.HasIssue("drifted") && !cfg.Replace {
+			log.Printf("[reconcile] Not replacing drifted %s/%s without -replace", e.Kind, e.Address)
+		}
+	}
+	log.Printf("[reconcile] Posted %d blob(s) and registered %d item(s)", posted, registered)
+	return nil
+}
+
+// postFixture posts the fixture blob of an item declared in the storage
+// section of metadata.yaml, replacing it on Storage with -replace
+func postFixture(fixtures *common.DataParser, kind, address string) error {
+	log.Printf("[storage] Posting %s/%s...", kind, address)
+	var post func(blob io.Reader) error
+	switch kind {
+	case "problem":
+		for _, resource := range fixtures.Storage.Problem {
+			if resource.ID.String() == address {
+				post = func(blob io.Reader) error { return storage.PostProblem(resource, 666, blob) }
+				break
+			}
+		}
+	case "data":
+		for _, resource := range fixtures.Storage.Data {
+			if resource.ID.String() == address {
+				post = func(blob io.Reader) error { return storage.PostData(resource, 666, blob) }
+				break
+			}
+		}
+	case "algo":
+		for _, resource := range fixtures.Storage.Algo {
+			if resource.ID.String() == address {
+				post = func(blob io.Reader) error { return storage.PostAlgo(resource, 666, blob) }
+				break
+			}
+		}
+	}
+	if post == nil {
+		return fmt.Errorf("[storage] No fixture %s/%s in metadata.yaml", kind, address)
+	}
+	_, err := postStorageFixture(fixtures, kind, address, post)
+	return err
+}
+
+// registerFixture registers an item declared in the chaincode section of
+// metadata.yaml, translating its problem keys with registration
+func registerFixture(registration *Registration, fixtures *common.DataParser, kind, address string) error {
+	log.Printf("[peer-API] Registering %s %s...", kind, address)
+	var (
+		key []byte
+		err error
+	)
+	switch kind {
+	case "problem":
+		for _, resource := range fixtures.Chaincode.Problem {
+			if resource.StorageAddress == address {
+				key, _, err = peer.RegisterProblem(resource.StorageAddress, resource.SizeTrainDataset, resource.TestData)
+			}
+		}
+		if err == nil {
+			registration.Problems[address] = &RegisteredProblem{Key: string(key), StorageAddress: address}
+		}
+	case "data":
+		for _, resource := range fixtures.Chaincode.Data {
+			if resource.StorageAddress == address {
+				_, _, err = peer.RegisterItem("data", address, registration.problemKeys(resource.ProblemKeys), resource.Name)
+			}
+		}
+	case "algo":
+		for _, resource := range fixtures.Chaincode.Algo {
+			if resource.StorageAddress == address {
+				_, _, err = peer.RegisterItem("algo", address, registration.problemKeys(resource.ProblemKeys), resource.Name)
+			}
+		}
+	}
+	if err != nil {
+		return fmt.Errorf("[peer-API] Error registering %s %s: %s", kind, address, err)
+	}
+	return nil
+}
+
+// LedgerItem is the part of a ledger problem, data or algo pointing to
+// Storage
+type LedgerItem struct {
+	Key            string `json:"key"`
+	StorageAddress string `json:"storageAddress"`
+}
+
+// listLedger returns the ledger items of a kind
+func listLedger(kind string) ([]LedgerItem, error) {
+	itemsBytes, err := peer.Query("queryItems", []string{kind})
+	if err != nil {
+		return nil, fmt.Errorf("[peer-API] Error getting %s items: %s", kind, err)
+	}
+	var items []LedgerItem
+	if err := json.Unmarshal(itemsBytes, &items); err != nil {
+		return nil, fmt.Errorf("[peer-API] Error Unmarshal-ing %s items: %s", kind, err)
+	}
+	return items, nil
+}
+
+// sumFixture returns the sha256 of a fixture file, or "" if there is none
+func sumFixture(fixtures *common.DataParser, kind, address string) string {
+	file, err := fixtures.GetData(kind, fixtureID(address))
+	if err != nil {
+		return ""
+	}
+	if closer, ok := file.(io.Closer); ok {
+		defer closer.Close()
+	}
+	data, err := ioutil.ReadAll(file)
+	if err != nil {
+		return ""
+	}
+	return checksums.Sum(data)
+}
@@ -0,0 +1,147 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/MorpheoOrg/morpheo-go-packages/common"
+)
+
+// Registration holds the ledger keys created when registering the fixtures on
+// the chaincode, indexed by storage address
+type Registration struct {
+	Problems map[string]*RegisteredProblem
+	Data     map[string]*RegisteredItem
+	Algos    map[string]*RegisteredItem
+}
+
+// RegisteredProblem is a problem registered by this run
+type RegisteredProblem struct {
+	Key            string
+	StorageAddress string
+	TestData       []string
+}
+
+// RegisteredItem is a data or an algo registered by this run
+type RegisteredItem struct {
+	Key            string
+	StorageAddress string
+	ProblemKeys    []string
+}
+
+func newRegistration() *Registration {
+	return &Registration{
+		Problems: make(map[string]*RegisteredProblem),
+		Data:     make(map[string]*RegisteredItem),
+		Algos:    make(map[string]*RegisteredItem),
+	}
+}
+
+// problemKey translates a problem key of metadata.yaml, such as
+// problem_<storageAddress>, into the ledger key of the registered problem
+func (r *Registration) problemKey(key string) string {
+	address := key[strings.LastIndex(key, "_")+1:]
+	if problem, ok := r.Problems[address]; ok {
+		return problem.Key
+	}
+	return key
+}
+
+// problemKeys translates problem keys of metadata.yaml into ledger keys
+func (r *Registration) problemKeys(keys []string) []string {
+	ledgerKeys := make([]string, len(keys))
+	for i, key := range keys {
+		ledgerKeys[i] = r.problemKey(key)
+	}
+	return ledgerKeys
+}
+
+// problem returns the registered problem referenced either by its ledger key
+// or by its storage address
+func (r *Registration) problem(ref string) *RegisteredProblem {
+	for _, problem := range r.Problems {
+		if ref == problem.Key || ref == problem.StorageAddress {
+			return problem
+		}
+	}
+	return nil
+}
+
+// item returns the registered item referenced either by its ledger key or by
+// its storage address
+func item(items map[string]*RegisteredItem, ref string) *RegisteredItem {
+	for _, item := range items {
+		if ref == item.Key || ref == item.StorageAddress {
+			return item
+		}
+	}
+	return nil
+}
+
+// owns tells whether a learnuplet was created from the algo, problem and
+// train data registered by this run
+func (r *Registration) owns(learnuplet common.LearnupletChaincode) bool {
+	if r.problem(learnuplet.Problem) == nil || item(r.Algos, learnuplet.Algo) == nil {
+		return false
+	}
+	for _, ref := range learnuplet.TrainData {
+		if item(r.Data, ref) == nil {
+			return false
+		}
+	}
+	return true
+}
+
+// checkLearnuplet asserts a learnuplet of this run is consistent with the
+// registered fixtures: its algo is registered on its problem, its train data
+// are associated to the problem but are not test data, and its test data are
+// exactly the problem's testData
+func (r *Registration) checkLearnuplet(learnuplet common.LearnupletChaincode) error {
+	problem := r.problem(learnuplet.Problem)
+	if problem == nil {
+		return fmt.Errorf("learnuplet %s: problem %s was not registered by this run", learnuplet.Key, learnuplet.Problem)
+	}
+	algo := item(r.Algos, learnuplet.Algo)
+	if algo == nil {
+		return fmt.Errorf("learnuplet %s: algo %s was not registered by this run", learnuplet.Key, learnuplet.Algo)
+	}
+	if !contains(algo.ProblemKeys, problem.Key) {
+		return fmt.Errorf("learnuplet %s: algo %s is not registered on problem %s", learnuplet.Key, algo.Key, problem.Key)
+	}
+
+	if len(learnuplet.TrainData) == 0 {
+		return fmt.Errorf("learnuplet %s: no train data", learnuplet.Key)
+	}
+	for _, ref := range learnuplet.TrainData {
+		data := item(r.Data, ref)
+		if data == nil {
+			return fmt.Errorf("learnuplet %s: train data %s was not registered by this run", learnuplet.Key, ref)
+		}
+		if !contains(data.ProblemKeys, problem.Key) {
+			return fmt.Errorf("learnuplet %s: train data %s is not associated to problem %s", learnuplet.Key, ref, problem.Key)
+		}
+		if contains(problem.TestData, data.StorageAddress) {
+			return fmt.Errorf("learnuplet %s: train data %s is a test data of problem %s", learnuplet.Key, ref, problem.Key)
+		}
+	}
+
+	if len(learnuplet.TestData) != len(problem.TestData) {
+		return fmt.Errorf("learnuplet %s: %d test data, whereas problem %s has %d", learnuplet.Key, len(learnuplet.TestData), problem.Key, len(problem.TestData))
+	}
+	for _, ref := range learnuplet.TestData {
+		data := item(r.Data, ref)
+		if data == nil || !contains(problem.TestData, data.StorageAddress) {
+			return fmt.Errorf("learnuplet %s: test data %s is not a test data of problem %s", learnuplet.Key, ref, problem.Key)
+		}
+	}
+	return nil
+}
+
+func contains(list []string, s string) bool {
+	for _, e := range list {
+		if e == s {
+			return true
+		}
+	}
+	return false
+}
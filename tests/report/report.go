@@ -0,0 +1,212 @@
+// Package report records the steps of the integration tests, with their
+// duration, outcome and error, and writes them as JUnit XML and JSON.
+package report
+
+import (
+	"encoding/json"
+	"encoding/xml"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"runtime/debug"
+	"time"
+)
+
+// Step outcomes
+const (
+	Passed  = "passed"
+	Failed  = "failed"
+	Skipped = "skipped"
+)
+
+// Step is the record of a named step of a Suite
+type Step struct {
+	Name     string        `json:"name"`
+	Start    time.Time     `json:"start"`
+	Duration time.Duration `json:"duration_ns"`
+	Outcome  string        `json:"outcome"`
+	Error    string        `json:"error,omitempty"`
+	// Reason tells why a step was skipped
+	Reason string `json:"reason,omitempty"`
+	// Stack is the stack trace of a step which panicked
+	Stack string `json:"stack,omitempty"`
+}
+
+// Suite is a sequence of steps. Once a step has failed, the following ones
+// are skipped.
+type Suite struct {
+	Name     string        `json:"name"`
+	Start    time.Time     `json:"start"`
+	Duration time.Duration `json:"duration_ns"`
+	Steps    []*Step       `json:"steps"`
+}
+
+// Report gathers the suites of a run
+type Report struct {
+	Suites []*Suite `json:"suites"`
+}
+
+// NewSuite adds a new suite to the report
+func (r *Report) NewSuite(name string) *Suite {
+	suite := &Suite{Name: name, Start: time.Now()}
+	r.Suites = append(r.Suites, suite)
+	return suite
+}
+
+// Failed tells whether a step of a suite failed
+func (r *Report) Failed() bool {
+	for _, suite := range r.Suites {
+		if suite.Failed() {
+			return true
+		}
+	}
+	return false
+}
+
+// Run runs and records a step, unless a previous step failed. It returns the
+// error of the step, if any. A step which panics fails with the panic, so that
+// the following steps are skipped and the report is still written.
+func (s *Suite) Run(name string, fn func() error) error {
+	step := &Step{Name: name, Start: time.Now()}
+	s.Steps = append(s.Steps, step)
+	defer func() {
+		step.Duration = time.Since(step.Start)
+		s.Duration = time.Since(s.Start)
+	}()
+
+	if s.Failed() {
+		step.Outcome = Skipped
+		step.Reason = "a previous step failed"
+		log.Printf("[report][%s] Skipping step %q", s.Name, name)
+		return nil
+	}
+
+	log.Printf("[report][%s] Starting step %q", s.Name, name)
+	if err := step.run(fn); err != nil {
+		step.Outcome = Failed
+		step.Error = err.Error()
+		log.Printf("[report][%s] Step %q FAILED: %s", s.Name, name, err)
+		if step.Stack != "" {
+			log.Printf("[report][%s] Stack of step %q:\n%s", s.Name, name, step.Stack)
+		}
+		return err
+	}
+	step.Outcome = Passed
+	return nil
+}
+
+// Skip records a step as skipped without running it, for a reason such as a
+// missing requirement
+func (s *Suite) Skip(name, reason string) {
+	s.Steps = append(s.Steps, &Step{Name: name, Start: time.Now(), Outcome: Skipped, Reason: reason})
+	s.Duration = time.Since(s.Start)
+	log.Printf("[report][%s] Skipping step %q: %s", s.Name, name, reason)
+}
+
+// run calls fn, turning a panic into an error and recording its stack
+func (step *Step) run(fn func() error) (err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			err = fmt.Errorf("panic: %v", r)
+			step.Stack = string(debug.Stack())
+		}
+	}()
+	return fn()
+}
+
+// Failed tells whether a step of the suite failed
+func (s *Suite) Failed() bool {
+	for _, step := range s.Steps {
+		if step.Outcome == Failed {
+			return true
+		}
+	}
+	return false
+}
+
+func (s *Suite) count(outcome string) (n int) {
+	for _, step := range s.Steps {
+		if step.Outcome == outcome {
+			n++
+		}
+	}
+	return n
+}
+
+// WriteJSON writes the report as a JSON summary
+func (r *Report) WriteJSON(path string) error {
+	data, err := json.MarshalIndent(r, "", "  ")
+	if err != nil {
+		return fmt.Errorf("Error marshalling JSON report: %s", err)
+	}
+	return ioutil.WriteFile(path, data, 0644)
+}
+
+type junitTestSuites struct {
+	XMLName xml.Name         `xml:"testsuites"`
+	Suites  []junitTestSuite `xml:"testsuite"`
+}
+
+type junitTestSuite struct {
+	Name      string          `xml:"name,attr"`
+	Tests     int             `xml:"tests,attr"`
+	Failures  int             `xml:"failures,attr"`
+	Skipped   int             `xml:"skipped,attr"`
+	Time      string          `xml:"time,attr"`
+	Timestamp string          `xml:"timestamp,attr"`
+	Cases     []junitTestCase `xml:"testcase"`
+}
+
+type junitTestCase struct {
+	ClassName string        `xml:"classname,attr"`
+	Name      string        `xml:"name,attr"`
+	Time      string        `xml:"time,attr"`
+	Failure   *junitMessage `xml:"failure,omitempty"`
+	Skipped   *junitMessage `xml:"skipped,omitempty"`
+}
+
+type junitMessage struct {
+	Message string `xml:"message,attr"`
+	Body    string `xml:",chardata"`
+}
+
+// WriteJUnit writes the report as JUnit XML, one testsuite per suite and one
+// testcase per step
+func (r *Report) WriteJUnit(path string) error {
+	out := junitTestSuites{}
+	for _, suite := range r.Suites {
+		ts := junitTestSuite{
+			Name:      suite.Name,
+			Tests:     len(suite.Steps),
+			Failures:  suite.count(Failed),
+			Skipped:   suite.count(Skipped),
+			Time:      seconds(suite.Duration),
+			Timestamp: suite.Start.Format("2006-01-02T15:04:05"),
+		}
+		for _, step := range suite.Steps {
+			tc := junitTestCase{ClassName: suite.Name, Name: step.Name, Time: seconds(step.Duration)}
+			switch step.Outcome {
+			case Failed:
+				body := step.Error
+				if step.Stack != "" {
+					body += "\n" + step.Stack
+				}
+				tc.Failure = &junitMessage{Message: step.Error, Body: body}
+			case Skipped:
+				tc.Skipped = &junitMessage{Message: step.Reason}
+			}
+			ts.Cases = append(ts.Cases, tc)
+		}
+		out.Suites = append(out.Suites, ts)
+	}
+
+	data, err := xml.MarshalIndent(out, "", "  ")
+	if err != nil {
+		return fmt.Errorf("Error marshalling JUnit report: %s", err)
+	}
+	return ioutil.WriteFile(path, append([]byte(xml.Header), data...), 0644)
+}
+
+func seconds(d time.Duration) string {
+	return fmt.Sprintf("%.3f", d.Seconds())
+}
@@ -0,0 +1,213 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"math/rand"
+	"strings"
+	"time"
+)
+
+// transientPeerErrors match, lowercased, the Fabric errors of calls that may
+// succeed when made again:
+//   - timeouts of the peer.timeout.queryResponse and executeTxResponse limits
+//     of the peer SDK config (config_aphp.yaml)
+//   - MVCC read conflicts of concurrent transactions updating the same keys
+//   - mismatching proposal responses, when the peers endorsed different read
+//     sets
+//   - connection refusals of peers or orderers restarting
+//
+// Any other error, such as a chaincode business error or an endorsement
+// policy failure, fails fast.
+var transientPeerErrors = append(append([]string(nil), timeoutPeerErrors...),
+	"mvcc_read_conflict",
+	"proposalresponsepayloads do not match",
+	"connection refused",
+)
+
+// timeoutPeerErrors are the transient errors after which an invoke may still
+// be committed
+var timeoutPeerErrors = []string{
+	"timeout",
+	"timed out",
+	"deadline exceeded",
+}
+
+// isTransientPeerError tells whether a failed peer call is worth retrying
+func isTransientPeerError(err error) bool {
+	return matchesPeerError(err, transientPeerErrors)
+}
+
+// isTimeoutPeerError tells whether a peer call failed on a timeout
+func isTimeoutPeerError(err error) bool {
+	return matchesPeerError(err, timeoutPeerErrors)
+}
+
+func matchesPeerError(err error, errors []string) bool {
+	msg := strings.ToLower(err.Error())
+	for _, e := range errors {
+		if strings.Contains(msg, e) {
+			return true
+		}
+	}
+	return false
+}
+
+// RetryPeer makes the calls of a Peer up to Attempts times while they fail
+// with transient errors, waiting between the attempts for a jittered backoff
+// doubling from Backoff. It logs every attempt of the invokes, and the
+// failed attempts of the queries, with their transaction ID. It stops
+// waiting when Ctx is done.
+//
+// An invoke timing out may still be committed. Before sending them again,
+// the registrations and the learnuplet reports check the ledger, and succeed
+// if their first attempt made it. Other invokes cannot be checked, and are not
+// sent again after a timeout: a second requestPrediction would create a
+// second preduplet.
+type RetryPeer struct {
+	Peer
+	Ctx      context.Context
+	Attempts int
+	Backoff  time.Duration
+}
+
+// maxPeerBackoff caps the wait between two attempts, to the executeTxResponse
+// timeout of config_aphp.yaml
+const maxPeerBackoff = 30 * time.Second
+
+// Query retries Peer.Query
+func (p *RetryPeer) Query(fcn string, args []string) (response []byte, err error) {
+	err = p.retry(fmt.Sprintf("query %s %v", fcn, args), false, func() (string, error) {
+		response, err = p.Peer.Query(fcn, args)
+		return "", err
+	}, nil)
+	return response, err
+}
+
+// Invoke retries Peer.Invoke
+func (p *RetryPeer) Invoke(fcn string, args []string) (response []byte, txID string, err error) {
+	err = p.retry(fmt.Sprintf("invoke %s %v", fcn, args), true, func() (string, error) {
+		response, txID, err = p.Peer.Invoke(fcn, args)
+		return txID, err
+	}, nil)
+	return response, txID, err
+}
+
+// RegisterProblem retries Peer.RegisterProblem
+func (p *RetryPeer) RegisterProblem(storageAddress string, sizeTrainDataset int, testData []string) (key []byte, txID string, err error) {
+	err = p.retry("registerProblem "+storageAddress, true, func() (string, error) {
+		key, txID, err = p.Peer.RegisterProblem(storageAddress, sizeTrainDataset, testData)
+		return txID, err
+	}, func() bool {
+		key = []byte("problem_" + storageAddress)
+		return p.exists(string(key))
+	})
+	return key, txID, err
+}
+
+// RegisterItem retries Peer.RegisterItem
+func (p *RetryPeer) RegisterItem(itemType, storageAddress string, problemKeys []string, name string) (key []byte, txID string, err error) {
+	err = p.retry(fmt.Sprintf("registerItem %s %s", itemType, storageAddress), true, func() (string, error) {
+		key, txID, err = p.Peer.RegisterItem(itemType, storageAddress, problemKeys, name)
+		return txID, err
+	}, func() bool {
+		key = []byte(itemType + "_" + storageAddress)
+		return p.exists(string(key))
+	})
+	return key, txID, err
+}
+
+// QueryStatusLearnuplet retries Peer.QueryStatusLearnuplet
+func (p *RetryPeer) QueryStatusLearnuplet(status string) (response []byte, err error) {
+	err = p.retry("queryStatusLearnuplet "+status, false, func() (string, error) {
+		response, err = p.Peer.QueryStatusLearnuplet(status)
+		return "", err
+	}, nil)
+	return response, err
+}
+
+// ReportLearn retries Peer.ReportLearn
+func (p *RetryPeer) ReportLearn(key, status string, perf float64, trainPerf, testPerf map[string]float64) (response []byte, txID string, err error) {
+	err = p.retry(fmt.Sprintf("reportLearn %s %s", key, status), true, func() (string, error) {
+		response, txID, err = p.Peer.ReportLearn(key, status, perf, trainPerf, testPerf)
+		return txID, err
+	}, func() bool {
+		response = []byte(key)
+		return p.hasStatus(key, status)
+	})
+	return response, txID, err
+}
+
+// retry makes a call, returning the transaction ID of invokes, until it
+// succeeds, fails with a non transient error, or runs out of attempts. After a
+// timeout, committed tells whether the invoke made it to the ledger anyway.
+// Invokes without committed are not retried after a timeout.
+func (p *RetryPeer) retry(call string, invoke bool, fn func() (txID string, err error), committed func() bool) error {
+	for attempt := 1; ; attempt++ {
+		txID, err := fn()
+		tx := "no tx"
+		if txID != "" {
+			tx = "tx " + txID
+		}
+		switch {
+		case err == nil:
+			if invoke || attempt > 1 {
+				log.Printf("[peer-API] %s (%s): attempt %d/%d succeeded", call, tx, attempt, p.Attempts)
+			}
+			return nil
+		case !isTransientPeerError(err):
+			if invoke || attempt > 1 {
+				log.Printf("[peer-API] %s (%s): attempt %d/%d failed, not retrying: %s", call, tx, attempt, p.Attempts, err)
+			}
+			return err
+		case attempt >= p.Attempts:
+			log.Printf("[peer-API] %s (%s): attempt %d/%d failed, giving up: %s", call, tx, attempt, p.Attempts, err)
+			return err
+		case invoke && committed == nil && isTimeoutPeerError(err):
+			log.Printf("[peer-API] %s (%s): attempt %d/%d timed out, not retrying as it may be committed: %s", call, tx, attempt, p.Attempts, err)
+			return err
+		}
+		delay := p.backoff(attempt)
+		log.Printf("[peer-API] %s (%s): attempt %d/%d failed, retrying in %s: %s", call, tx, attempt, p.Attempts, delay, err)
+		select {
+		case <-p.Ctx.Done():
+			log.Printf("[peer-API] %s (%s): giving up: %s", call, tx, p.Ctx.Err())
+			return err
+		case <-time.After(delay):
+		}
+		if committed != nil && isTimeoutPeerError(err) && committed() {
+			log.Printf("[peer-API] %s (%s): attempt %d/%d was committed despite the timeout", call, tx, attempt, p.Attempts)
+			return nil
+		}
+	}
+}
+
+// exists tells whether the ledger has an item
+func (p *RetryPeer) exists(key string) bool {
+	_, err := p.Peer.Query("queryItem", []string{key})
+	return err == nil
+}
+
+// hasStatus tells whether the ledger has a learnuplet with a given status
+func (p *RetryPeer) hasStatus(key, status string) bool {
+	response, err := p.Peer.Query("queryItem", []string{key})
+	if err != nil {
+		return false
+	}
+	var learnuplet struct {
+		Status string `json:"status"`
+	}
+	return json.Unmarshal(response, &learnuplet) == nil && learnuplet.Status == status
+}
+
+// backoff returns the wait after a failed attempt, between half and all of
+// Backoff doubled at each attempt, so that concurrent calls spread out
+func (p *RetryPeer) backoff(attempt int) time.Duration {
+	backoff := p.Backoff << uint(attempt-1)
+	if backoff > maxPeerBackoff || backoff <= 0 {
+		backoff = maxPeerBackoff
+	}
+	return (backoff/2 + time.Duration(rand.Int63n(int64(backoff/2)+1))).Round(time.Millisecond)
+}
@@ -0,0 +1,168 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/MorpheoOrg/morpheo-devenv/tests/fakepeer"
+)
+
+func TestIsTransientPeerError(t *testing.T) {
+	tests := []struct {
+		err       string
+		transient bool
+		timeout   bool
+	}{
+		{"Timeout expired while executing transaction", true, true},
+		{"request timed out or been cancelled", true, true},
+		{"rpc error: code = DeadlineExceeded desc = context deadline exceeded", true, true},
+		{"Transaction invalidated with status (MVCC_READ_CONFLICT)", true, false},
+		{"ProposalResponsePayloads do not match", true, false},
+		{"dial tcp 172.18.0.5:7051: connect: connection refused", true, false},
+		{"Transaction invalidated with status (ENDORSEMENT_POLICY_FAILURE)", false, false},
+		{"learnuplet learnuplet_x has status done, only pending learnuplets can be reported", false, false},
+		{"problem problem_x already exists", false, false},
+	}
+	for _, test := range tests {
+		err := fmt.Errorf("%s", test.err)
+		if transient := isTransientPeerError(err); transient != test.transient {
+			t.Errorf("isTransientPeerError(%q) is %t, expected %t", test.err, transient, test.transient)
+		}
+		if timeout := isTimeoutPeerError(err); timeout != test.timeout {
+			t.Errorf("isTimeoutPeerError(%q) is %t, expected %t", test.err, timeout, test.timeout)
+		}
+	}
+}
+
+// timeoutPeer commits the invokes to a fakepeer, but reports the first
+// failures of each of them as errors
+type timeoutPeer struct {
+	*fakepeer.Peer
+	// failures are the errors reported, in order, after committing the
+	// invokes, or before them if the error is not a timeout
+	failures []error
+	calls    int
+}
+
+func (p *timeoutPeer) fail(commit func() error) error {
+	p.calls++
+	if len(p.failures) == 0 {
+		return commit()
+	}
+	err := p.failures[0]
+	p.failures = p.failures[1:]
+	if isTimeoutPeerError(err) {
+		commit()
+	}
+	return err
+}
+
+func (p *timeoutPeer) RegisterProblem(storageAddress string, sizeTrainDataset int, testData []string) (key []byte, txID string, err error) {
+	err = p.fail(func() (err error) {
+		key, txID, err = p.Peer.RegisterProblem(storageAddress, sizeTrainDataset, testData)
+		return err
+	})
+	return key, txID, err
+}
+
+func (p *timeoutPeer) Invoke(fcn string, args []string) (response []byte, txID string, err error) {
+	err = p.fail(func() (err error) {
+		response, txID, err = p.Peer.Invoke(fcn, args)
+		return err
+	})
+	return response, txID, err
+}
+
+func newTestRetryPeer(peer Peer) *RetryPeer {
+	return &RetryPeer{Peer: peer, Ctx: context.Background(), Attempts: 3, Backoff: time.Millisecond}
+}
+
+func TestRetryPeerCommittedAfterTimeout(t *testing.T) {
+	tests := []struct {
+		name     string
+		failures []error
+		calls    int
+	}{
+		{"no failure", nil, 1},
+		// The problem is registered by the first attempt, so the second one
+		// is not made
+		{"committed despite the timeout", []error{fmt.Errorf("timeout")}, 1},
+		{"conflict", []error{fmt.Errorf("MVCC_READ_CONFLICT")}, 2},
+	}
+	for _, test := range tests {
+		fake := &timeoutPeer{Peer: fakepeer.NewPeer(), failures: test.failures}
+		key, _, err := newTestRetryPeer(fake).RegisterProblem("p", 1, nil)
+		if err != nil {
+			t.Errorf("%s: %s", test.name, err)
+			continue
+		}
+		if string(key) != "problem_p" {
+			t.Errorf("%s: got key %s, expected problem_p", test.name, key)
+		}
+		if fake.calls != test.calls {
+			t.Errorf("%s: %d call(s) to RegisterProblem, expected %d", test.name, fake.calls, test.calls)
+		}
+	}
+}
+
+func TestRetryPeerInvokeTimeout(t *testing.T) {
+	fake := &timeoutPeer{Peer: fakepeer.NewPeer()}
+	if _, _, err := fake.Peer.RegisterProblem("p", 1, []string{"test"}); err != nil {
+		t.Fatal(err)
+	}
+	for _, address := range []string{"test", "train"} {
+		if _, _, err := fake.Peer.RegisterItem("data", address, []string{"problem_p"}, ""); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if _, _, err := fake.Peer.RegisterItem("algo", "a", []string{"problem_p"}, "a"); err != nil {
+		t.Fatal(err)
+	}
+	learnuplets, err := fake.Peer.QueryStatusLearnuplet("todo")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var todo []struct {
+		Key string `json:"key"`
+	}
+	if err := json.Unmarshal(learnuplets, &todo); err != nil || len(todo) != 1 {
+		t.Fatalf("got todo learnuplets %s (%v), expected 1", learnuplets, err)
+	}
+	if _, _, err := fake.Peer.Invoke("setUpletWorker", []string{todo[0].Key, "worker"}); err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := fake.Peer.ReportLearn(todo[0].Key, "done", 0.5, nil, nil); err != nil {
+		t.Fatal(err)
+	}
+
+	// A timed out requestPrediction is not sent again, as it may have
+	// created a preduplet
+	fake.failures = []error{fmt.Errorf("timeout")}
+	if _, _, err := newTestRetryPeer(fake).Invoke("requestPrediction", []string{"test", "p"}); err == nil || !isTimeoutPeerError(err) {
+		t.Errorf("got error %v, expected the timeout", err)
+	}
+	preduplets, err := fake.Query("queryItems", []string{"preduplet"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var items []json.RawMessage
+	if err := json.Unmarshal(preduplets, &items); err != nil {
+		t.Fatal(err)
+	}
+	if fake.calls != 1 || len(items) != 1 {
+		t.Errorf("%d call(s) to requestPrediction created %d preduplet(s), expected 1 and 1", fake.calls, len(items))
+	}
+
+	// It is retried after an error that did not commit it
+	fake.calls = 0
+	fake.failures = []error{fmt.Errorf("connection refused")}
+	if _, _, err := newTestRetryPeer(fake).Invoke("requestPrediction", []string{"test", "p"}); err != nil {
+		t.Error(err)
+	}
+	if fake.calls != 2 {
+		t.Errorf("%d call(s) to requestPrediction, expected 2", fake.calls)
+	}
+}
@@ -0,0 +1,249 @@
+package scenario
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// Vars holds the values saved by the steps of a scenario, referenced in the
+// following steps as ${name}, or ${name<path>} to select part of a value,
+// e.g. ${registered.algo[0]}
+type Vars map[string]interface{}
+
+var reference = regexp.MustCompile(`\$\{([^}]+)\}`)
+
+// Lookup returns the value of a reference, without ${}
+func (v Vars) Lookup(ref string) (interface{}, error) {
+	name := ref
+	if i := strings.IndexAny(ref, ".["); i >= 0 {
+		name = ref[:i]
+	}
+	value, ok := v[name]
+	if !ok {
+		return nil, fmt.Errorf("undefined variable %s", name)
+	}
+	if name == ref {
+		return value, nil
+	}
+	path, err := ParsePath("$" + ref[len(name):])
+	if err != nil {
+		return nil, err
+	}
+	value, err = path.Value(value)
+	if err != nil {
+		return nil, fmt.Errorf("variable %s: %s", name, err)
+	}
+	return value, nil
+}
+
+// Expand replaces the references of s with their value. Non-string values
+// are written as JSON.
+func (v Vars) Expand(s string) (string, error) {
+	var err error
+	expanded := reference.ReplaceAllStringFunc(s, func(match string) string {
+		value, lookupErr := v.Lookup(match[2 : len(match)-1])
+		if lookupErr != nil {
+			err = lookupErr
+			return match
+		}
+		return format(value)
+	})
+	return expanded, err
+}
+
+// ExpandAll expands a list of strings
+func (v Vars) ExpandAll(list []string) ([]string, error) {
+	expanded := make([]string, len(list))
+	for i, s := range list {
+		var err error
+		if expanded[i], err = v.Expand(s); err != nil {
+			return nil, err
+		}
+	}
+	return expanded, nil
+}
+
+// ExpandValue expands the strings of a value decoded from YAML. A string
+// made of a single reference is replaced with the referenced value as is,
+// keeping its type.
+func (v Vars) ExpandValue(value interface{}) (interface{}, error) {
+	switch x := Normalize(value).(type) {
+	case string:
+		if loc := reference.FindStringIndex(x); loc != nil && loc[0] == 0 && loc[1] == len(x) {
+			return v.Lookup(x[2 : len(x)-1])
+		}
+		return v.Expand(x)
+	case []interface{}:
+		for i := range x {
+			var err error
+			if x[i], err = v.ExpandValue(x[i]); err != nil {
+				return nil, err
+			}
+		}
+		return x, nil
+	case map[string]interface{}:
+		for key := range x {
+			var err error
+			if x[key], err = v.ExpandValue(x[key]); err != nil {
+				return nil, err
+			}
+		}
+		return x, nil
+	default:
+		return x, nil
+	}
+}
+
+// Eval expands the references of a path, and returns its value on data
+func (v Vars) Eval(expr string, data interface{}) (interface{}, error) {
+	expanded, err := v.Expand(expr)
+	if err != nil {
+		return nil, err
+	}
+	path, err := ParsePath(expanded)
+	if err != nil {
+		return nil, err
+	}
+	return path.Value(data)
+}
+
+func format(value interface{}) string {
+	switch x := value.(type) {
+	case string:
+		return x
+	case float64:
+		return strconv.FormatFloat(x, 'g', -1, 64)
+	}
+	data, err := json.Marshal(Normalize(value))
+	if err != nil {
+		return fmt.Sprint(value)
+	}
+	return string(data)
+}
+
+// Assertion checks the value at Path of the result of a step. All the set
+// checks must pass.
+type Assertion struct {
+	Path string `yaml:"path"`
+
+	// Equals compares the value, within Tolerance for numbers
+	Equals    interface{} `yaml:"equals"`
+	Tolerance float64     `yaml:"tolerance"`
+	// Exists checks whether the path selects something
+	Exists *bool `yaml:"exists"`
+	// Length checks the number of elements of a list, object or string
+	Length *int `yaml:"length"`
+	// Greater and Less bound a number
+	Greater *float64 `yaml:"greater"`
+	Less    *float64 `yaml:"less"`
+	// Contains checks a list holds an element, or a string a substring
+	Contains interface{} `yaml:"contains"`
+}
+
+// Check runs the assertion on the result of a step
+func (a *Assertion) Check(result interface{}, vars Vars) error {
+	expr, err := vars.Expand(a.Path)
+	if err != nil {
+		return err
+	}
+	path, err := ParsePath(expr)
+	if err != nil {
+		return err
+	}
+	nodes := path.Select(result)
+	if a.Exists != nil {
+		if exists := len(nodes) > 0; exists != *a.Exists {
+			return fmt.Errorf("%s: exists is %t, expected %t", expr, exists, *a.Exists)
+		}
+		if !a.checksValue() {
+			return nil
+		}
+	}
+	value, err := path.Value(result)
+	if err != nil {
+		return err
+	}
+
+	if a.Equals != nil {
+		expected, err := vars.ExpandValue(a.Equals)
+		if err != nil {
+			return err
+		}
+		if !equalWithin(value, expected, a.Tolerance) {
+			return fmt.Errorf("%s is %s, expected %s", expr, format(value), format(expected))
+		}
+	}
+	if a.Length != nil {
+		var length int
+		switch x := value.(type) {
+		case []interface{}:
+			length = len(x)
+		case map[string]interface{}:
+			length = len(x)
+		case string:
+			length = len(x)
+		default:
+			return fmt.Errorf("%s is %s, which has no length", expr, format(value))
+		}
+		if length != *a.Length {
+			return fmt.Errorf("%s has length %d, expected %d", expr, length, *a.Length)
+		}
+	}
+	if a.Greater != nil || a.Less != nil {
+		f, ok := value.(float64)
+		if !ok {
+			return fmt.Errorf("%s is %s, expected a number", expr, format(value))
+		}
+		if a.Greater != nil && f <= *a.Greater {
+			return fmt.Errorf("%s is %g, expected greater than %g", expr, f, *a.Greater)
+		}
+		if a.Less != nil && f >= *a.Less {
+			return fmt.Errorf("%s is %g, expected less than %g", expr, f, *a.Less)
+		}
+	}
+	if a.Contains != nil {
+		expected, err := vars.ExpandValue(a.Contains)
+		if err != nil {
+			return err
+		}
+		if !contains(value, expected) {
+			return fmt.Errorf("%s is %s, expected it to contain %s", expr, format(value), format(expected))
+		}
+	}
+	return nil
+}
+
+// checksValue tells whether the assertion has checks on the value, besides
+// Exists
+func (a *Assertion) checksValue() bool {
+	return a.Equals != nil || a.Length != nil || a.Greater != nil || a.Less != nil || a.Contains != nil
+}
+
+func equalWithin(value, expected interface{}, tolerance float64) bool {
+	if f, ok := value.(float64); ok {
+		if g, ok := Normalize(expected).(float64); ok {
+			return math.Abs(f-g) <= tolerance
+		}
+	}
+	return Equal(value, expected)
+}
+
+func contains(value, element interface{}) bool {
+	switch x := value.(type) {
+	case []interface{}:
+		for _, e := range x {
+			if Equal(e, element) {
+				return true
+			}
+		}
+	case string:
+		if s, ok := element.(string); ok {
+			return strings.Contains(x, s)
+		}
+	}
+	return false
+}
@@ -0,0 +1,39 @@
+package scenario
+
+import "testing"
+
+func TestVarsExpand(t *testing.T) {
+	vars := Vars{
+		"algo":       "algo_x",
+		"perf":       0.25,
+		"learnuplet": []interface{}{"learnuplet_a", "learnuplet_b"},
+		"registered": map[string]interface{}{"data": []interface{}{"data_1", "data_2"}},
+	}
+	tests := []struct {
+		s        string
+		expected string
+		valid    bool
+	}{
+		{"no reference", "no reference", true},
+		{"${algo}", "algo_x", true},
+		{"$[?(@.algo == '${algo}')].key", "$[?(@.algo == 'algo_x')].key", true},
+		{"${perf}", "0.25", true},
+		{"${learnuplet}", `["learnuplet_a","learnuplet_b"]`, true},
+		{"${learnuplet[1]}", "learnuplet_b", true},
+		{"${registered.data[0]} and ${registered.data[-1]}", "data_1 and data_2", true},
+		{"${registered}", `{"data":["data_1","data_2"]}`, true},
+		{"${unknown}", "", false},
+		{"${learnuplet[2]}", "", false},
+		{"${algo.key}", "", false},
+	}
+	for _, test := range tests {
+		expanded, err := vars.Expand(test.s)
+		if (err == nil) != test.valid {
+			t.Errorf("Expand(%q): error %v, expected valid %t", test.s, err, test.valid)
+			continue
+		}
+		if err == nil && expanded != test.expected {
+			t.Errorf("Expand(%q) is %q, expected %q", test.s, expanded, test.expected)
+		}
+	}
+}
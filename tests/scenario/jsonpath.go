@@ -0,0 +1,426 @@
+package scenario
+
+import (
+	"fmt"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// Path is a compiled JSONPath expression. It supports the root $, fields
+// (.name or ['name']), indexes ([0], [-1]), wildcards (.* or [*]) and
+// filters on the elements of a list ([?(@.status == 'done' && @.rank > 0)]),
+// with the operators ==, !=, <, <=, >, >=, or a bare @.field for existence.
+type Path struct {
+	expr     string
+	segments []segment
+}
+
+// segment selects the children of a node
+type segment interface {
+	selectFrom(node interface{}) []interface{}
+	definite() bool
+}
+
+// ParsePath compiles a JSONPath expression
+func ParsePath(expr string) (*Path, error) {
+	s := strings.TrimSpace(expr)
+	if !strings.HasPrefix(s, "$") {
+		return nil, fmt.Errorf("invalid path %q: should start with $", expr)
+	}
+	p := &Path{expr: s}
+	for i := 1; i < len(s); {
+		switch s[i] {
+		case '.':
+			i++
+			if i < len(s) && s[i] == '*' {
+				p.segments = append(p.segments, wildcard{})
+				i++
+				continue
+			}
+			j := i
+			for j < len(s) && isNameChar(s[j]) {
+				j++
+			}
+			if j == i {
+				return nil, fmt.Errorf("invalid path %q: missing field name at %d", expr, i)
+			}
+			p.segments = append(p.segments, field(s[i:j]))
+			i = j
+		case '[':
+			end := closing(s, i)
+			if end < 0 {
+				return nil, fmt.Errorf("invalid path %q: unterminated [ at %d", expr, i)
+			}
+			seg, err := parseBracket(s[i+1 : end])
+			if err != nil {
+				return nil, fmt.Errorf("invalid path %q: %s", expr, err)
+			}
+			p.segments = append(p.segments, seg)
+			i = end + 1
+		default:
+			return nil, fmt.Errorf("invalid path %q: unexpected %q at %d", expr, s[i], i)
+		}
+	}
+	return p, nil
+}
+
+func (p *Path) String() string { return p.expr }
+
+// Definite tells whether the path selects at most one node, i.e. has no
+// wildcard nor filter
+func (p *Path) Definite() bool {
+	for _, seg := range p.segments {
+		if !seg.definite() {
+			return false
+		}
+	}
+	return true
+}
+
+// Select returns the nodes of data selected by the path
+func (p *Path) Select(data interface{}) []interface{} {
+	nodes := []interface{}{data}
+	for _, seg := range p.segments {
+		var next []interface{}
+		for _, node := range nodes {
+			next = append(next, seg.selectFrom(node)...)
+		}
+		nodes = next
+	}
+	return nodes
+}
+
+// Value returns the node selected by a definite path, or the list of the
+// nodes selected by an indefinite one
+func (p *Path) Value(data interface{}) (interface{}, error) {
+	nodes := p.Select(data)
+	if !p.Definite() {
+		if nodes == nil {
+			nodes = []interface{}{}
+		}
+		return nodes, nil
+	}
+	if len(nodes) == 0 {
+		return nil, fmt.Errorf("nothing at %s", p.expr)
+	}
+	return nodes[0], nil
+}
+
+type field string
+
+func (f field) selectFrom(node interface{}) []interface{} {
+	if m, ok := node.(map[string]interface{}); ok {
+		if value, ok := m[string(f)]; ok {
+			return []interface{}{value}
+		}
+	}
+	return nil
+}
+
+func (field) definite() bool { return true }
+
+type index int
+
+func (i index) selectFrom(node interface{}) []interface{} {
+	list, ok := node.([]interface{})
+	if !ok {
+		return nil
+	}
+	j := int(i)
+	if j < 0 {
+		j += len(list)
+	}
+	if j < 0 || j >= len(list) {
+		return nil
+	}
+	return []interface{}{list[j]}
+}
+
+func (index) definite() bool { return true }
+
+type wildcard struct{}
+
+func (wildcard) selectFrom(node interface{}) []interface{} {
+	return children(node)
+}
+
+func (wildcard) definite() bool { return false }
+
+// filter selects the children matching all its conditions
+type filter []condition
+
+func (f filter) selectFrom(node interface{}) (selected []interface{}) {
+	for _, child := range children(node) {
+		matches := true
+		for _, c := range f {
+			if !c.matches(child) {
+				matches = false
+				break
+			}
+		}
+		if matches {
+			selected = append(selected, child)
+		}
+	}
+	return selected
+}
+
+func (filter) definite() bool { return false }
+
+// condition compares a path relative to the filtered element to a literal,
+// or checks it exists if op is empty
+type condition struct {
+	path  *Path
+	op    string
+	value interface{}
+}
+
+var operators = []string{"==", "!=", "<=", ">=", "<", ">"}
+
+func parseCondition(expr string) (condition, error) {
+	expr = strings.TrimSpace(expr)
+	left, op, right := expr, "", ""
+	for _, candidate := range operators {
+		if i := indexUnquoted(expr, candidate); i >= 0 {
+			left, op, right = strings.TrimSpace(expr[:i]), candidate, strings.TrimSpace(expr[i+len(candidate):])
+			break
+		}
+	}
+	if !strings.HasPrefix(left, "@") {
+		return condition{}, fmt.Errorf("filter condition %q should start with @", expr)
+	}
+	path, err := ParsePath("$" + left[1:])
+	if err != nil {
+		return condition{}, err
+	}
+	if !path.Definite() {
+		return condition{}, fmt.Errorf("filter condition %q should select a single value", expr)
+	}
+	c := condition{path: path, op: op}
+	if op != "" {
+		if c.value, err = parseLiteral(right); err != nil {
+			return condition{}, fmt.Errorf("filter condition %q: %s", expr, err)
+		}
+	}
+	return c, nil
+}
+
+func (c condition) matches(node interface{}) bool {
+	values := c.path.Select(node)
+	if len(values) == 0 {
+		return false
+	}
+	if c.op == "" {
+		return true
+	}
+	switch c.op {
+	case "==":
+		return Equal(values[0], c.value)
+	case "!=":
+		return !Equal(values[0], c.value)
+	}
+	cmp, ok := compare(values[0], c.value)
+	if !ok {
+		return false
+	}
+	switch c.op {
+	case "<":
+		return cmp < 0
+	case "<=":
+		return cmp <= 0
+	case ">":
+		return cmp > 0
+	default:
+		return cmp >= 0
+	}
+}
+
+// parseBracket parses the content of a [] segment
+func parseBracket(content string) (segment, error) {
+	content = strings.TrimSpace(content)
+	switch {
+	case content == "*":
+		return wildcard{}, nil
+	case strings.HasPrefix(content, "?(") && strings.HasSuffix(content, ")"):
+		var f filter
+		for _, expr := range splitUnquoted(content[2:len(content)-1], "&&") {
+			c, err := parseCondition(expr)
+			if err != nil {
+				return nil, err
+			}
+			f = append(f, c)
+		}
+		return f, nil
+	case isQuoted(content):
+		return field(content[1 : len(content)-1]), nil
+	}
+	i, err := strconv.Atoi(content)
+	if err != nil {
+		return nil, fmt.Errorf("invalid segment [%s]", content)
+	}
+	return index(i), nil
+}
+
+// parseLiteral parses a quoted string, a number, true, false or null
+func parseLiteral(s string) (interface{}, error) {
+	switch {
+	case isQuoted(s):
+		return s[1 : len(s)-1], nil
+	case s == "true":
+		return true, nil
+	case s == "false":
+		return false, nil
+	case s == "null":
+		return nil, nil
+	}
+	f, err := strconv.ParseFloat(s, 64)
+	if err != nil {
+		return nil, fmt.Errorf("invalid literal %q", s)
+	}
+	return f, nil
+}
+
+// children returns the elements of a list, or the values of an object by key
+func children(node interface{}) []interface{} {
+	switch n := node.(type) {
+	case []interface{}:
+		return n
+	case map[string]interface{}:
+		keys := make([]string, 0, len(n))
+		for key := range n {
+			keys = append(keys, key)
+		}
+		sort.Strings(keys)
+		values := make([]interface{}, len(keys))
+		for i, key := range keys {
+			values[i] = n[key]
+		}
+		return values
+	}
+	return nil
+}
+
+// Equal compares two JSON values, once normalized
+func Equal(a, b interface{}) bool {
+	return reflect.DeepEqual(Normalize(a), Normalize(b))
+}
+
+// compare orders two numbers or two strings
+func compare(a, b interface{}) (int, bool) {
+	a, b = Normalize(a), Normalize(b)
+	switch x := a.(type) {
+	case float64:
+		if y, ok := b.(float64); ok {
+			switch {
+			case x < y:
+				return -1, true
+			case x > y:
+				return 1, true
+			}
+			return 0, true
+		}
+	case string:
+		if y, ok := b.(string); ok {
+			return strings.Compare(x, y), true
+		}
+	}
+	return 0, false
+}
+
+// Normalize converts values decoded from YAML to their JSON form: objects
+// are map[string]interface{} and numbers float64
+func Normalize(value interface{}) interface{} {
+	switch v := value.(type) {
+	case map[interface{}]interface{}:
+		m := make(map[string]interface{}, len(v))
+		for key, value := range v {
+			m[fmt.Sprint(key)] = Normalize(value)
+		}
+		return m
+	case map[string]interface{}:
+		m := make(map[string]interface{}, len(v))
+		for key, value := range v {
+			m[key] = Normalize(value)
+		}
+		return m
+	case []interface{}:
+		list := make([]interface{}, len(v))
+		for i, value := range v {
+			list[i] = Normalize(value)
+		}
+		return list
+	case int:
+		return float64(v)
+	case int64:
+		return float64(v)
+	case uint64:
+		return float64(v)
+	case float32:
+		return float64(v)
+	}
+	return value
+}
+
+func isNameChar(c byte) bool {
+	return c == '_' || c == '-' || c >= '0' && c <= '9' || c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z'
+}
+
+func isQuoted(s string) bool {
+	return len(s) >= 2 && (s[0] == '\'' || s[0] == '"') && s[len(s)-1] == s[0]
+}
+
+// closing returns the index of the ] closing the [ at start, skipping quoted
+// strings and parentheses
+func closing(s string, start int) int {
+	var quote byte
+	depth := 0
+	for i := start + 1; i < len(s); i++ {
+		switch c := s[i]; {
+		case quote != 0:
+			if c == quote {
+				quote = 0
+			}
+		case c == '\'' || c == '"':
+			quote = c
+		case c == '(':
+			depth++
+		case c == ')':
+			depth--
+		case c == ']' && depth == 0:
+			return i
+		}
+	}
+	return -1
+}
+
+// indexUnquoted returns the index of the first sep of s out of quotes, or -1
+func indexUnquoted(s, sep string) int {
+	var quote byte
+	for i := 0; i < len(s); i++ {
+		switch c := s[i]; {
+		case quote != 0:
+			if c == quote {
+				quote = 0
+			}
+		case c == '\'' || c == '"':
+			quote = c
+		case strings.HasPrefix(s[i:], sep):
+			return i
+		}
+	}
+	return -1
+}
+
+// splitUnquoted splits s around the seps out of quotes
+func splitUnquoted(s, sep string) (parts []string) {
+	for {
+		i := indexUnquoted(s, sep)
+		if i < 0 {
+			return append(parts, s)
+		}
+		parts = append(parts, s[:i])
+		s = s[i+len(sep):]
+	}
+}
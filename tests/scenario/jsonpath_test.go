@@ -0,0 +1,84 @@
+package scenario
+
+import (
+	"encoding/json"
+	"testing"
+)
+
+func TestParsePath(t *testing.T) {
+	tests := []struct {
+		expr     string
+		valid    bool
+		definite bool
+	}{
+		{"$", true, true},
+		{"$.algo", true, true},
+		{"$.algo[0]", true, true},
+		{"$['test data'][-1]", true, true},
+		{"$.*", true, false},
+		{"$[*].key", true, false},
+		{"$[?(@.status == 'done' && @.rank > 0)].key", true, false},
+		{"$[?(@.perf)]", true, false},
+		{" $.key ", true, true},
+		{"algo", false, false},
+		{"$.", false, false},
+		{"$[0", false, false},
+		{"$[x]", false, false},
+		{"$key", false, false},
+		{"$[?(status == 'done')]", false, false},
+		{"$[?(@.items[*] == 1)]", false, false},
+		{"$[?(@.rank > two)]", false, false},
+	}
+	for _, test := range tests {
+		path, err := ParsePath(test.expr)
+		if (err == nil) != test.valid {
+			t.Errorf("ParsePath(%q): error %v, expected valid %t", test.expr, err, test.valid)
+			continue
+		}
+		if err == nil && path.Definite() != test.definite {
+			t.Errorf("ParsePath(%q).Definite() is %t, expected %t", test.expr, path.Definite(), test.definite)
+		}
+	}
+}
+
+const testLearnuplets = `[
+  {"key": "learnuplet_a", "status": "done", "rank": 0, "perf": 0.5, "testData": ["d1", "d2"]},
+  {"key": "learnuplet_b", "status": "done", "rank": 1, "perf": 0.8},
+  {"key": "learnuplet_c", "status": "todo", "rank": 2, "algo": "algo_x"}
+]`
+
+func TestSelect(t *testing.T) {
+	var data interface{}
+	if err := json.Unmarshal([]byte(testLearnuplets), &data); err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		expr     string
+		expected string
+	}{
+		{"$[0].key", `["learnuplet_a"]`},
+		{"$[-1].key", `["learnuplet_c"]`},
+		{"$[3].key", `null`},
+		{"$[0]['testData'][1]", `["d2"]`},
+		{"$[*].rank", `[0,1,2]`},
+		{"$[1].*", `["learnuplet_b",0.8,1,"done"]`},
+		{"$[?(@.status == 'done')].key", `["learnuplet_a","learnuplet_b"]`},
+		{"$[?(@.status != 'done')].key", `["learnuplet_c"]`},
+		{"$[?(@.status == 'done' && @.rank >= 1)].key", `["learnuplet_b"]`},
+		{"$[?(@.perf < 0.6)].key", `["learnuplet_a"]`},
+		{"$[?(@.algo)].key", `["learnuplet_c"]`},
+		{"$[?(@.rank > 'one')].key", `null`},
+		{"$.key", `null`},
+	}
+	for _, test := range tests {
+		path, err := ParsePath(test.expr)
+		if err != nil {
+			t.Errorf("ParsePath(%q): %s", test.expr, err)
+			continue
+		}
+		selected, _ := json.Marshal(path.Select(data))
+		if string(selected) != test.expected {
+			t.Errorf("%s selects %s, expected %s", test.expr, selected, test.expected)
+		}
+	}
+}
@@ -0,0 +1,315 @@
+// Package scenario parses the YAML scenario files run by the integration
+// tests. A scenario names a fixture set and lists steps, each doing one
+// action on Storage or on the chaincode, checking its result with JSONPath
+// assertions and saving parts of it for the following steps:
+//
+//	name: learn
+//	fixtures: ../fixtures/metadata.yaml
+//	steps:
+//	  - post: all
+//	  - register: all
+//	    save:
+//	      algo: $.algo[0]
+//	  - query: {fcn: queryItems, args: [learnuplet]}
+//	    assert:
+//	      - path: $[?(@.algo == '${algo}')]
+//	        length: 1
+//	    save:
+//	      learnuplet: $[?(@.algo == '${algo}' && @.rank == 0)].key
+//	  - wait: {key: "${learnuplet[0]}", status: done, timeout: 5m}
+//	    assert:
+//	      - path: $.perf
+//	        less: 1
+package scenario
+
+import (
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"gopkg.in/yaml.v2"
+)
+
+// Kinds are the fixture kinds, posted to Storage and registered on the
+// chaincode in this order. Models are only posted to Storage.
+var Kinds = []string{"problem", "data", "algo", "model"}
+
+// Requirements are the setups a scenario can require. Scenarios whose
+// requirements are not met are skipped.
+var Requirements = []string{RequireLocalCompute}
+
+// RequireLocalCompute requires the local compute worker, e.g. to check the
+// worker of the learnuplets or to learn from a pre-trained model
+const RequireLocalCompute = "local-compute"
+
+// UpletStatuses are the statuses a wait step can wait for
+var UpletStatuses = []string{"todo", "waiting", "pending", "done", "failed"}
+
+// Scenario is a sequence of steps run on a fixture set
+type Scenario struct {
+	Name string `yaml:"name"`
+	// Fixtures is the path of the metadata.yaml of the fixture set, relative
+	// to the scenario file. It defaults to the fixtures of the tests.
+	Fixtures string `yaml:"fixtures"`
+	// Requires lists the Requirements of the scenario
+	Requires []string `yaml:"requires"`
+	Steps    []Step   `yaml:"steps"`
+
+	// File is the path of the scenario file
+	File string `yaml:"-"`
+}
+
+// Step does exactly one action, then checks Assert on its result and saves
+// the values of the Save paths as variables. If Fails is set, the action must
+// fail instead, and its result is neither checked nor saved.
+type Step struct {
+	Name string `yaml:"name"`
+
+	Post     *KindList    `yaml:"post"`
+	Register *KindList    `yaml:"register"`
+	Predict  *Predict     `yaml:"predict"`
+	Wait     *Wait        `yaml:"wait"`
+	Report   *ReportLearn `yaml:"report"`
+	Learn    *Learn       `yaml:"learn"`
+	Query    *Call        `yaml:"query"`
+	Invoke   *Call        `yaml:"invoke"`
+	Download *Download    `yaml:"download"`
+
+	Assert []Assertion       `yaml:"assert"`
+	Save   map[string]string `yaml:"save"`
+	Fails  bool              `yaml:"fails"`
+}
+
+// KindList is a list of fixture kinds, or "all". Post results in the posted
+// storage uuids by kind, and Register in the registered ledger keys by kind.
+type KindList []string
+
+// UnmarshalYAML reads "all" or a list of kinds
+func (k *KindList) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	var all string
+	if err := unmarshal(&all); err == nil {
+		if all != "all" {
+			return fmt.Errorf("invalid fixture kinds %q, should be all or a list of %v", all, Kinds)
+		}
+		*k = Kinds
+		return nil
+	}
+	var kinds []string
+	if err := unmarshal(&kinds); err != nil {
+		return err
+	}
+	for _, kind := range kinds {
+		if !has(Kinds, kind) {
+			return fmt.Errorf("invalid fixture kind %q, should be one of %v", kind, Kinds)
+		}
+	}
+	*k = kinds
+	return nil
+}
+
+// Has tells whether the list holds a kind
+func (k KindList) Has(kind string) bool {
+	return has(k, kind)
+}
+
+func has(list []string, value string) bool {
+	for _, v := range list {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
+
+// Predict requests a prediction on a data for a problem, by storage address.
+// Without them, it requests the predictions of the fixtures. It results in
+// the list of the preduplet keys.
+type Predict struct {
+	Data    string `yaml:"data"`
+	Problem string `yaml:"problem"`
+}
+
+// Wait waits for a learnuplet or a preduplet to reach one of the
+// UpletStatuses, within Timeout if set. It fails as soon as the uplet is done
+// or failed instead. It results in the item.
+type Wait struct {
+	Key     string        `yaml:"key"`
+	Status  string        `yaml:"status"`
+	Timeout time.Duration `yaml:"timeout"`
+}
+
+// ReportLearn reports the outcome of a learnuplet, first taking it as Worker
+// if set. It results in the learnuplet.
+type ReportLearn struct {
+	Key       string             `yaml:"key"`
+	Worker    string             `yaml:"worker"`
+	Status    string             `yaml:"status"`
+	Perf      float64            `yaml:"perf"`
+	TrainPerf map[string]float64 `yaml:"trainPerf"`
+	TestPerf  map[string]float64 `yaml:"testPerf"`
+}
+
+// Learn registers a copy of a fixture algo, whose first learnuplet starts
+// from a pre-trained model, by storage uuid. Algo is the storage address of
+// the fixture algo to copy, defaulting to the algo of the model fixture, or
+// else to the first fixture algo. It results in the key and the
+// storageAddress of the algo.
+//
+// The chaincode cannot start a learnuplet from a given model: the local
+// compute worker fetches it on its own, so Learn is local-only, and skipped
+// along with the following steps without -compute local.
+type Learn struct {
+	Model string `yaml:"model"`
+	Algo  string `yaml:"algo"`
+}
+
+// Download fetches a blob from Storage, such as a model. It results in the
+// decoded JSON blob, or the blob as a string if it is not JSON.
+type Download struct {
+	Resource string `yaml:"resource"`
+	ID       string `yaml:"id"`
+}
+
+// Call is a chaincode query or invoke. It results in the decoded JSON
+// response, or the response as a string if it is not JSON.
+type Call struct {
+	Fcn  string   `yaml:"fcn"`
+	Args []string `yaml:"args"`
+}
+
+// Action returns the name of the action of the step
+func (s *Step) Action() string {
+	actions := s.actions()
+	if len(actions) != 1 {
+		return ""
+	}
+	return actions[0]
+}
+
+func (s *Step) actions() (actions []string) {
+	for name, set := range map[string]bool{
+		"post":     s.Post != nil,
+		"register": s.Register != nil,
+		"predict":  s.Predict != nil,
+		"wait":     s.Wait != nil,
+		"report":   s.Report != nil,
+		"learn":    s.Learn != nil,
+		"query":    s.Query != nil,
+		"invoke":   s.Invoke != nil,
+		"download": s.Download != nil,
+	} {
+		if set {
+			actions = append(actions, name)
+		}
+	}
+	sort.Strings(actions)
+	return actions
+}
+
+// Title names the i-th step in the reports
+func (s *Step) Title(i int) string {
+	if s.Name != "" {
+		return s.Name
+	}
+	return fmt.Sprintf("step %d: %s", i+1, s.Action())
+}
+
+func (s *Step) validate() error {
+	actions := s.actions()
+	if len(actions) != 1 {
+		return fmt.Errorf("should have exactly one action of post, register, predict, wait, report, learn, query, invoke, download, has %v", actions)
+	}
+	switch {
+	case s.Wait != nil:
+		if s.Wait.Key == "" || s.Wait.Status == "" {
+			return fmt.Errorf("wait: key and status must be set")
+		}
+		if !has(UpletStatuses, s.Wait.Status) {
+			return fmt.Errorf("wait: invalid status %q, should be one of %v", s.Wait.Status, UpletStatuses)
+		}
+	case s.Report != nil:
+		if s.Report.Key == "" || s.Report.Status == "" {
+			return fmt.Errorf("report: key and status must be set")
+		}
+	case s.Learn != nil && s.Learn.Model == "":
+		return fmt.Errorf("learn: model must be set")
+	case s.Download != nil && (s.Download.Resource == "" || s.Download.ID == ""):
+		return fmt.Errorf("download: resource and id must be set")
+	case s.Query != nil && s.Query.Fcn == "", s.Invoke != nil && s.Invoke.Fcn == "":
+		return fmt.Errorf("%s: fcn must be set", actions[0])
+	case s.Predict != nil && (s.Predict.Data == "") != (s.Predict.Problem == ""):
+		return fmt.Errorf("predict: data and problem must be set together")
+	}
+	if s.Fails && (len(s.Assert) > 0 || len(s.Save) > 0) {
+		return fmt.Errorf("a step expected to fail cannot assert nor save")
+	}
+	for _, a := range s.Assert {
+		if a.Path == "" {
+			return fmt.Errorf("assert: path must be set")
+		}
+	}
+	return nil
+}
+
+// Load reads and validates a scenario file
+func Load(path string) (*Scenario, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("Error reading scenario: %s", err)
+	}
+	s := &Scenario{File: path}
+	if err := yaml.UnmarshalStrict(data, s); err != nil {
+		return nil, fmt.Errorf("Error parsing scenario %s: %s", path, err)
+	}
+	if s.Name == "" {
+		s.Name = strings.TrimSuffix(filepath.Base(path), filepath.Ext(path))
+	}
+	if s.Fixtures != "" && !filepath.IsAbs(s.Fixtures) {
+		s.Fixtures = filepath.Join(filepath.Dir(path), s.Fixtures)
+	}
+	for _, requirement := range s.Requires {
+		if !has(Requirements, requirement) {
+			return nil, fmt.Errorf("scenario %s: unknown requirement %q, should be one of %v", path, requirement, Requirements)
+		}
+	}
+	if len(s.Steps) == 0 {
+		return nil, fmt.Errorf("scenario %s: no steps", path)
+	}
+	for i := range s.Steps {
+		if err := s.Steps[i].validate(); err != nil {
+			return nil, fmt.Errorf("scenario %s: step %d: %s", path, i+1, err)
+		}
+	}
+	return s, nil
+}
+
+// LoadDir loads the .yaml and .yml scenario files of a directory, by name
+func LoadDir(dir string) ([]*Scenario, error) {
+	files, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return nil, fmt.Errorf("Error reading scenarios: %s", err)
+	}
+	var scenarios []*Scenario
+	names := make(map[string]string)
+	for _, file := range files {
+		if ext := filepath.Ext(file.Name()); file.IsDir() || (ext != ".yaml" && ext != ".yml") {
+			continue
+		}
+		s, err := Load(filepath.Join(dir, file.Name()))
+		if err != nil {
+			return nil, err
+		}
+		if other, ok := names[s.Name]; ok {
+			return nil, fmt.Errorf("scenarios %s and %s are both named %q", other, s.File, s.Name)
+		}
+		names[s.Name] = s.File
+		scenarios = append(scenarios, s)
+	}
+	if len(scenarios) == 0 {
+		return nil, fmt.Errorf("no scenario in %s", dir)
+	}
+	return scenarios, nil
+}
@@ -0,0 +1,336 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"strings"
+
+	"github.com/MorpheoOrg/morpheo-go-packages/common"
+
+	"github.com/MorpheoOrg/morpheo-devenv/tests/localcompute"
+	"github.com/MorpheoOrg/morpheo-devenv/tests/report"
+	"github.com/MorpheoOrg/morpheo-devenv/tests/scenario"
+)
+
+// runScenarios runs the scenario files of a directory, each as a suite of the
+// report named after it, and logs the outcome of each
+func runScenarios(rep *report.Report, dir string) {
+	scenarios, err := scenario.LoadDir(dir)
+	if err != nil {
+		rep.NewSuite("scenarios").Run("load scenarios", func() error { return err })
+		return
+	}
+
+	suites := make([]*report.Suite, len(scenarios))
+	skipped := make([]string, len(scenarios))
+	for i, s := range scenarios {
+		suites[i] = rep.NewSuite("scenario " + s.Name)
+		if missing := missingRequirements(s); len(missing) > 0 {
+			skipped[i] = "requires " + strings.Join(missing, ", ")
+			for j := range s.Steps {
+				suites[i].Skip(s.Steps[j].Title(j), skipped[i])
+			}
+			continue
+		}
+		log.Printf("[scenario] Running %s (%s)", s.Name, s.File)
+		runScenario(suites[i], s)
+	}
+
+	for i, s := range scenarios {
+		outcome := "PASSED"
+		if skipped[i] != "" {
+			outcome = "SKIPPED, " + skipped[i]
+		}
+		for _, step := range suites[i].Steps {
+			if step.Outcome == report.Failed {
+				outcome = fmt.Sprintf("FAILED at %q: %s", step.Name, step.Error)
+				break
+			}
+			if step.Outcome == report.Skipped && skipped[i] == "" {
+				outcome = fmt.Sprintf("PASSED, skipping from %q: %s", step.Name, step.Reason)
+				skipped[i] = step.Reason
+			}
+		}
+		log.Printf("[scenario] %s: %s", s.Name, outcome)
+	}
+}
+
+// missingRequirements returns the requirements of a scenario the current
+// setup does not meet
+func missingRequirements(s *scenario.Scenario) (missing []string) {
+	for _, requirement := range s.Requires {
+		if requirement == scenario.RequireLocalCompute && worker == nil {
+			missing = append(missing, requirement)
+		}
+	}
+	return missing
+}
+
+// runScenario runs the steps of a scenario on its own copy of its fixtures.
+// Scenarios always run on fresh UUIDs, so that they conflict neither with
+// each other nor with the built-in tests.
+func runScenario(suite *report.Suite, s *scenario.Scenario) {
+	var fixtures *common.DataParser
+	registration := newRegistration()
+	vars := scenario.Vars{}
+
+	suite.Run("load fixtures", func() (err error) {
+		path := s.Fixtures
+		if path == "" {
+			path = pathFixturesYAML
+		}
+		if fixtures, err = common.ParseDataFromFile(path); err != nil {
+			return fmt.Errorf("Error parsing %s: %s", path, err)
+		}
+		return isolateFixtures(fixtures)
+	})
+
+	skipReason := ""
+	for i := range s.Steps {
+		step := s.Steps[i]
+		// Pre-trained models are a side channel of the local worker: the
+		// orchestrator cannot start a learnuplet from a given model
+		if step.Learn != nil && worker == nil {
+			skipReason = "learn requires the local compute worker"
+		}
+		if skipReason != "" {
+			suite.Skip(step.Title(i), skipReason)
+			continue
+		}
+		suite.Run(step.Title(i), func() error {
+			return runStep(step, fixtures, registration, vars)
+		})
+	}
+}
+
+// runStep runs the action of a step, then checks and saves its result
+func runStep(step scenario.Step, fixtures *common.DataParser, registration *Registration, vars scenario.Vars) error {
+	step, err := expandStep(step, vars)
+	if err != nil {
+		return err
+	}
+	result, err := doStep(step, fixtures, registration)
+	if step.Fails {
+		if err == nil {
+			return fmt.Errorf("%s succeeded, expected it to fail", step.Action())
+		}
+		log.Printf("[scenario] %s failed as expected: %s", step.Action(), err)
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	for i := range step.Assert {
+		if err := step.Assert[i].Check(result, vars); err != nil {
+			return fmt.Errorf("assertion failed: %s", err)
+		}
+	}
+	for name, expr := range step.Save {
+		value, err := vars.Eval(expr, result)
+		if err != nil {
+			return fmt.Errorf("Error saving %s: %s", name, err)
+		}
+		vars[name] = value
+		log.Printf("[scenario] Saved %s: %v", name, value)
+	}
+	return nil
+}
+
+// expandStep returns a copy of a step, with the variables referenced by its
+// action expanded
+func expandStep(step scenario.Step, vars scenario.Vars) (scenario.Step, error) {
+	var err error
+	expand := func(s *string) {
+		if err == nil {
+			*s, err = vars.Expand(*s)
+		}
+	}
+	expandCall := func(call *scenario.Call) *scenario.Call {
+		c := *call
+		expand(&c.Fcn)
+		if err == nil {
+			c.Args, err = vars.ExpandAll(c.Args)
+		}
+		return &c
+	}
+
+	switch {
+	case step.Predict != nil:
+		p := *step.Predict
+		expand(&p.Data)
+		expand(&p.Problem)
+		step.Predict = &p
+	case step.Wait != nil:
+		w := *step.Wait
+		expand(&w.Key)
+		step.Wait = &w
+	case step.Report != nil:
+		r := *step.Report
+		expand(&r.Key)
+		expand(&r.Worker)
+		expand(&r.Status)
+		step.Report = &r
+	case step.Learn != nil:
+		l := *step.Learn
+		expand(&l.Model)
+		expand(&l.Algo)
+		step.Learn = &l
+	case step.Download != nil:
+		d := *step.Download
+		expand(&d.Resource)
+		expand(&d.ID)
+		step.Download = &d
+	case step.Query != nil:
+		step.Query = expandCall(step.Query)
+	case step.Invoke != nil:
+		step.Invoke = expandCall(step.Invoke)
+	}
+	return step, err
+}
+
+// doStep runs the action of a step, and returns its result as decoded JSON
+func doStep(step scenario.Step, fixtures *common.DataParser, registration *Registration) (interface{}, error) {
+	switch {
+	case step.Post != nil:
+		posted, err := postFixtures(fixtures, *step.Post)
+		return kindsResult(posted), err
+
+	case step.Register != nil:
+		keys, err := registerFixtures(registration, fixtures, *step.Register)
+		return kindsResult(keys), err
+
+	case step.Predict != nil:
+		var keys []string
+		if step.Predict.Data == "" {
+			var err error
+			if keys, err = requestPredictionsChaincode(fixtures); err != nil {
+				return nil, err
+			}
+		} else {
+			log.Printf("[peer-API] Requesting prediction on data %s for problem %s...", step.Predict.Data, step.Predict.Problem)
+			key, _, err := peer.Invoke("requestPrediction", []string{step.Predict.Data, step.Predict.Problem})
+			if err != nil {
+				return nil, fmt.Errorf("[peer-API] Error requesting prediction on data %s: %s", step.Predict.Data, err)
+			}
+			keys = []string{string(key)}
+		}
+		return stringsResult(keys), nil
+
+	case step.Wait != nil:
+		key, timeout := step.Wait.Key, step.Wait.Timeout
+		if timeout == 0 {
+			timeout = cfg.WaitTimeout
+		}
+		kind := "item"
+		if i := strings.Index(key, "_"); i > 0 {
+			kind = key[:i]
+		}
+		if err := waitUpletStatusWithin(kind, key, step.Wait.Status, timeout); err != nil {
+			return nil, err
+		}
+		return queryItemResult(key)
+
+	case step.Report != nil:
+		r := step.Report
+		if r.Worker != "" {
+			if _, _, err := peer.Invoke("setUpletWorker", []string{r.Key, r.Worker}); err != nil {
+				return nil, fmt.Errorf("[peer-API] Error taking learnuplet %s as %s: %s", r.Key, r.Worker, err)
+			}
+		}
+		log.Printf("[peer-API] Reporting learnuplet %s %s...", r.Key, r.Status)
+		if _, _, err := peer.ReportLearn(r.Key, r.Status, r.Perf, r.TrainPerf, r.TestPerf); err != nil {
+			return nil, fmt.Errorf("[peer-API] Error reporting learnuplet %s: %s", r.Key, err)
+		}
+		return queryItemResult(r.Key)
+
+	case step.Learn != nil:
+		return learnFromModel(step.Learn, fixtures, registration)
+
+	case step.Download != nil:
+		log.Printf("[storage] Downloading %s/%s...", step.Download.Resource, step.Download.ID)
+		blob, err := getStorageBlob(step.Download.Resource, step.Download.ID)
+		if err != nil {
+			return nil, err
+		}
+		defer blob.Close()
+		data, err := ioutil.ReadAll(blob)
+		if err != nil {
+			return nil, fmt.Errorf("Error reading %s/%s: %s", step.Download.Resource, step.Download.ID, err)
+		}
+		return decodeResult(data), nil
+
+	case step.Query != nil:
+		response, err := peer.Query(step.Query.Fcn, step.Query.Args)
+		if err != nil {
+			return nil, fmt.Errorf("[peer-API] Error %s %v: %s", step.Query.Fcn, step.Query.Args, err)
+		}
+		return decodeResult(response), nil
+
+	case step.Invoke != nil:
+		response, _, err := peer.Invoke(step.Invoke.Fcn, step.Invoke.Args)
+		if err != nil {
+			return nil, fmt.Errorf("[peer-API] Error %s %v: %s", step.Invoke.Fcn, step.Invoke.Args, err)
+		}
+		return decodeResult(response), nil
+	}
+	return nil, fmt.Errorf("step has no action")
+}
+
+// learnFromModel registers a copy of a fixture algo, which the local compute
+// worker trains from a pre-trained model. runScenario skips it without the
+// local compute worker.
+func learnFromModel(learn *scenario.Learn, fixtures *common.DataParser, registration *Registration) (interface{}, error) {
+	algo := learn.Algo
+	if algo == "" {
+		for _, model := range fixtures.Storage.Model {
+			if model.ID.String() == learn.Model {
+				algo = model.Algo.String()
+			}
+		}
+	}
+	if algo == "" && len(fixtures.Storage.Algo) > 0 {
+		algo = fixtures.Storage.Algo[0].ID.String()
+	}
+	address, key, err := registerAlgoCopy(fixtures, registration, algo, "from model "+learn.Model, localcompute.Algo{Model: learn.Model})
+	if err != nil {
+		return nil, err
+	}
+	return map[string]interface{}{"key": key, "storageAddress": address}, nil
+}
+
+func queryItemResult(key string) (interface{}, error) {
+	response, err := peer.Query("queryItem", []string{key})
+	if err != nil {
+		return nil, fmt.Errorf("[peer-API] Error queryItem %s: %s", key, err)
+	}
+	return decodeResult(response), nil
+}
+
+// decodeResult decodes a chaincode response, keeping it as a string if it is
+// not JSON, such as the keys returned by the registrations
+func decodeResult(response []byte) interface{} {
+	var result interface{}
+	if err := json.Unmarshal(response, &result); err != nil {
+		return string(response)
+	}
+	return result
+}
+
+func kindsResult(byKind map[string][]string) interface{} {
+	result := make(map[string]interface{}, len(byKind))
+	for kind, list := range byKind {
+		result[kind] = stringsResult(list)
+	}
+	return result
+}
+
+func stringsResult(list []string) []interface{} {
+	result := make([]interface{}, len(list))
+	for i, s := range list {
+		result[i] = s
+	}
+	return result
+}
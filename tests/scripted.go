@@ -0,0 +1,177 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"path/filepath"
+	"strconv"
+
+	"github.com/MorpheoOrg/morpheo-go-packages/common"
+
+	"github.com/MorpheoOrg/morpheo-devenv/tests/fixtures/scripted"
+	"github.com/MorpheoOrg/morpheo-devenv/tests/localcompute"
+	"github.com/MorpheoOrg/morpheo-devenv/tests/report"
+)
+
+// scriptedAlgo is a fastest algo built to report a given score
+type scriptedAlgo struct {
+	Score   float64
+	Bin     string
+	Address string
+	Key     string
+}
+
+// testScriptedRanking registers a fastest algo per scripted score on the
+// problems of the fixture algo, and checks the ledger reports exactly these
+// scores and predicts with the model of the highest-scored algo
+func testScriptedRanking(suite *report.Suite, fixtures *common.DataParser, registration *Registration) {
+	var algos []*scriptedAlgo
+
+	// Each score is built into its own binary, as an algo is its own image
+	// on the docker compute
+	suite.Run("build scripted algos", func() error {
+		src := filepath.Join(filepath.Dir(pathFixturesYAML), "algo/fastest")
+		for _, score := range cfg.ScriptedScores {
+			text := strconv.FormatFloat(score, 'g', -1, 64)
+			algo := &scriptedAlgo{Score: score, Bin: filepath.Join(worker.WorkDir, "fastest-"+text)}
+			if err := goBuild(algo.Bin, src, "-ldflags", "-X main.scriptedScore="+text); err != nil {
+				return err
+			}
+			algos = append(algos, algo)
+		}
+		return nil
+	})
+
+	suite.Run("register scripted algos", func() (err error) {
+		for _, algo := range algos {
+			name := fmt.Sprintf("scripted %g", algo.Score)
+			algo.Address, algo.Key, err = registerFixtureAlgo(fixtures, registration, name, localcompute.Algo{Bin: algo.Bin})
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+
+	suite.Run("wait scripted learnuplets", func() error {
+		_, err := waiter.Until(ctx, "the learnuplets of the scripted algos to be done", cfg.WaitTimeout, func() (string, bool, error) {
+			done := 0
+			for _, algo := range algos {
+				statuses, err := algoLearnupletStatuses(algo.Key)
+				if err != nil {
+					return "", false, err
+				}
+				if statuses["failed"] > 0 {
+					return "", false, fmt.Errorf("a learnuplet of algo %s scripted with score %g failed", algo.Key, algo.Score)
+				}
+				if statuses["done"] > 0 && len(statuses) == 1 {
+					done++
+				}
+			}
+			return fmt.Sprintf("%d/%d algos done", done, len(algos)), done == len(algos), nil
+		})
+		return err
+	})
+
+	// The perf and the perf on each test file are reported as scripted
+	suite.Run("check scripted perfs", func() error {
+		learnuplets, err := getLearnuplets("done")
+		if err != nil {
+			return err
+		}
+		for _, algo := range algos {
+			for _, learnuplet := range learnuplets {
+				if learnuplet.Algo != algo.Key {
+					continue
+				}
+				if err := checkScriptedPerf(learnuplet, algo.Score); err != nil {
+					return fmt.Errorf("[learn] Invalid perf for learnuplet %s: %s", learnuplet.Key, err)
+				}
+			}
+		}
+		log.Println("[learn] SUCCESSFUL! Perfs match the scripted scores.")
+		return nil
+	})
+
+	// The chaincode predicts with the best model of the problem, which must
+	// come from the algo scripted with the highest score
+	suite.Run("check ranking", func() error {
+		if len(fixtures.Chaincode.Prediction) == 0 {
+			return fmt.Errorf("no prediction fixture to request a prediction with")
+		}
+		best := algos[0]
+		for _, algo := range algos {
+			if algo.Score > best.Score {
+				best = algo
+			}
+		}
+
+		prediction := fixtures.Chaincode.Prediction[0]
+		problem := registration.problem(prediction.Problem)
+		if problem == nil {
+			return fmt.Errorf("problem %s of the prediction fixture was not registered by this run", prediction.Problem)
+		}
+		problemKey := problem.Key
+		learnuplets, err := getLearnuplets("done")
+		if err != nil {
+			return err
+		}
+		models := make(map[string]bool)
+		for _, learnuplet := range learnuplets {
+			if learnuplet.Problem != problemKey {
+				continue
+			}
+			if learnuplet.Algo == best.Key {
+				models[learnuplet.ModelEnd] = true
+			} else if learnuplet.Perf >= best.Score {
+				return fmt.Errorf("learnuplet %s of algo %s has perf %g on problem %s, not below the best scripted score %g: use a higher score", learnuplet.Key, learnuplet.Algo, learnuplet.Perf, problemKey, best.Score)
+			}
+		}
+
+		key, _, err := peer.Invoke("requestPrediction", []string{prediction.Data, prediction.Problem})
+		if err != nil {
+			return fmt.Errorf("[peer-API] Error requesting prediction on data %s: %s", prediction.Data, err)
+		}
+		preduplet, err := getPreduplet(string(key))
+		if err != nil {
+			return err
+		}
+		if !models[preduplet.Model] {
+			return fmt.Errorf("preduplet %s predicts with model %s, expected a model of algo %s scripted with the highest score %g", preduplet.Key, preduplet.Model, best.Key, best.Score)
+		}
+		log.Printf("[learn] SUCCESSFUL! The chaincode predicts with model %s of algo %s, scripted with score %g", preduplet.Model, best.Key, best.Score)
+		return waitUpletDone("preduplet", preduplet.Key)
+	})
+}
+
+// algoLearnupletStatuses counts the learnuplets of an algo by status
+func algoLearnupletStatuses(algoKey string) (map[string]int, error) {
+	learnuplets, err := getAlgoLearnuplets(algoKey)
+	if err != nil {
+		return nil, err
+	}
+	statuses := make(map[string]int)
+	for _, learnuplet := range learnuplets {
+		statuses[learnuplet.Status]++
+	}
+	return statuses, nil
+}
+
+// checkScriptedPerf compares the perfs of a done learnuplet to the scripted
+// score. Both sides come from the same float64, so they must be equal.
+func checkScriptedPerf(learnuplet common.LearnupletChaincode, score float64) error {
+	if learnuplet.Perf != score {
+		return fmt.Errorf("perf %g, expected the scripted score %g", learnuplet.Perf, score)
+	}
+	for _, file := range learnuplet.TestData {
+		expected := scripted.FileScore(score, file)
+		testPerf, ok := learnuplet.TestPerf[file]
+		if !ok {
+			return fmt.Errorf("no test perf for %s", file)
+		}
+		if testPerf != expected {
+			return fmt.Errorf("test perf %g for %s, expected %g", testPerf, file, expected)
+		}
+	}
+	return nil
+}
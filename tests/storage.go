@@ -0,0 +1,259 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"mime/multipart"
+	"net/http"
+
+	"github.com/MorpheoOrg/morpheo-go-packages/common"
+)
+
+// StorageError is an error status returned by Storage
+type StorageError struct {
+	Method     string
+	URL        string
+	StatusCode int
+	Status     string
+}
+
+func (e *StorageError) Error() string {
+	return fmt.Sprintf("[storage] Error %s %s: %s", e.Method, e.URL, e.Status)
+}
+
+// isStorageStatus tells whether err is a StorageError with a given status code
+func isStorageStatus(err error, statusCode int) bool {
+	storageErr, ok := err.(*StorageError)
+	return ok && storageErr.StatusCode == statusCode
+}
+
+// StorageResource is the metadata of a Storage resource
+type StorageResource struct {
+	ID       string `json:"uuid"`
+	Checksum string `json:"checksum"`
+}
+
+// DriftError is returned when posting a fixture Storage already has with a
+// different content
+type DriftError struct {
+	Resource string
+	ID       string
+	Stored   string
+	Fixture  string
+}
+
+func (e *DriftError) Error() string {
+	return fmt.Sprintf("[storage] %s/%s differs from its fixture: stored with sha256 %s, fixture sha256 %s, use -replace to post it again",
+		e.Resource, e.ID, e.Stored, e.Fixture)
+}
+
+// doStorage sends a request to Storage, returning a StorageError if it does
+// not succeed. The caller closes the body of the response.
+func doStorage(method, path string, body io.Reader, contentType string) (*http.Response, error) {
+	url := fmt.Sprintf("http://%s:%d/%s", storage.Hostname, storage.Port, path)
+	req, err := http.NewRequest(method, url, body)
+	if err != nil {
+		return nil, fmt.Errorf("[storage] Error building request %s: %s", url, err)
+	}
+	if contentType != "" {
+		req.Header.Set("Content-Type", contentType)
+	}
+	req.SetBasicAuth(storage.User, storage.Password)
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("[storage] Error %s %s: %s", method, url, err)
+	}
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		resp.Body.Close()
+		return nil, &StorageError{Method: method, URL: url, StatusCode: resp.StatusCode, Status: resp.Status}
+	}
+	return resp, nil
+}
+
+// getStorageBlob fetches the blob of a Storage resource
+func getStorageBlob(resource, id string) (io.ReadCloser, error) {
+	resp, err := doStorage(http.MethodGet, resource+"/"+id+"/blob", nil, "")
+	if err != nil {
+		return nil, err
+	}
+	return resp.Body, nil
+}
+
+// getStorageResource fetches the metadata of a Storage resource
+func getStorageResource(resource, id string) (*StorageResource, error) {
+	resp, err := doStorage(http.MethodGet, resource+"/"+id, nil, "")
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	res := &StorageResource{}
+	if err := json.NewDecoder(resp.Body).Decode(res); err != nil {
+		return nil, fmt.Errorf("[storage] Error Unmarshal-ing %s/%s: %s", resource, id, err)
+	}
+	return res, nil
+}
+
+// listStorage returns the metadata of the Storage resources of a type
+func listStorage(resource string) ([]StorageResource, error) {
+	resp, err := doStorage(http.MethodGet, resource, nil, "")
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	var resources []StorageResource
+	if err := json.NewDecoder(resp.Body).Decode(&resources); err != nil {
+		return nil, fmt.Errorf("[storage] Error Unmarshal-ing %s list: %s", resource, err)
+	}
+	return resources, nil
+}
+
+// deleteStorageResource deletes a Storage resource and its blob
+func deleteStorageResource(resource, id string) error {
+	resp, err := doStorage(http.MethodDelete, resource+"/"+id, nil, "")
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	return nil
+}
+
+// postStorageBlob uploads a blob to Storage as a multipart form
+func postStorageBlob(resource, id string, blob []byte) error {
+	body := &bytes.Buffer{}
+	form := multipart.NewWriter(body)
+	if err := form.WriteField("uuid", id); err != nil {
+		return err
+	}
+	part, err := form.CreateFormFile("blob", id)
+	if err != nil {
+		return err
+	}
+	if _, err := part.Write(blob); err != nil {
+		return err
+	}
+	if err := form.Close(); err != nil {
+		return err
+	}
+
+	resp, err := doStorage(http.MethodPost, resource, body, form.FormDataContentType())
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	return nil
+}
+
+// sumStorageBlob returns the sha256 of a Storage resource, from its metadata
+// if Storage has it, or else by downloading its blob
+func sumStorageBlob(resource, id string) (string, error) {
+	res, err := getStorageResource(resource, id)
+	if err != nil {
+		return "", err
+	}
+	if len(res.Checksum) == 2*sha256.Size {
+		return res.Checksum, nil
+	}
+	return hashStorageBlob(resource, id)
+}
+
+// hashStorageBlob downloads the blob of a Storage resource and returns its
+// sha256, whatever checksum Storage records for it
+func hashStorageBlob(resource, id string) (string, error) {
+	blob, err := getStorageBlob(resource, id)
+	if err != nil {
+		return "", err
+	}
+	defer blob.Close()
+	hash := sha256.New()
+	if _, err := io.Copy(hash, blob); err != nil {
+		return "", fmt.Errorf("[storage] Error reading %s/%s: %s", resource, id, err)
+	}
+	return hex.EncodeToString(hash.Sum(nil)), nil
+}
+
+// postConflict turns the error of a post into a 409 StorageError when Storage
+// has the resource by now, i.e. when someone else posted it in the meantime.
+// The Storage client errors do not tell the status.
+func postConflict(resource, id string, err error) error {
+	if _, getErr := getStorageResource(resource, id); getErr != nil {
+		return err
+	}
+	return &StorageError{
+		Method:     http.MethodPost,
+		URL:        fmt.Sprintf("http://%s:%d/%s", storage.Hostname, storage.Port, resource),
+		StatusCode: http.StatusConflict,
+		Status:     fmt.Sprintf("%d %s (%s)", http.StatusConflict, http.StatusText(http.StatusConflict), err),
+	}
+}
+
+// postStorageFixture posts the fixture file of a resource with post. If
+// Storage already has the resource, it compares their checksums: a resource
+// with the content of the fixture is left as is, whereas a different one is
+// a DriftError, unless -replace is set, which deletes and posts it again. A
+// resource posted concurrently is compared the same way.
+// It returns false if there is no fixture file to post.
+func postStorageFixture(fixtures *common.DataParser, resource, id string, post func(blob io.Reader) error) (bool, error) {
+	file, err := fixtures.GetData(resource, fixtureID(id))
+	if err != nil {
+		log.Printf("[storage]%s", err)
+		return false, nil
+	}
+	if closer, ok := file.(io.Closer); ok {
+		defer closer.Close()
+	}
+	// Hash the fixture file, then rewind it to post it, without loading
+	// large data files in memory
+	blob, ok := file.(io.ReadSeeker)
+	if !ok {
+		data, err := ioutil.ReadAll(file)
+		if err != nil {
+			return false, fmt.Errorf("[storage] Error reading fixture %s/%s: %s", resource, id, err)
+		}
+		blob = bytes.NewReader(data)
+	}
+	hash := sha256.New()
+	if _, err := io.Copy(hash, blob); err != nil {
+		return false, fmt.Errorf("[storage] Error reading fixture %s/%s: %s", resource, id, err)
+	}
+	sum := hex.EncodeToString(hash.Sum(nil))
+
+	// A resource posted by someone else after the comparison makes the post
+	// conflict: compare again, once
+	for attempt := 1; ; attempt++ {
+		stored, err := sumStorageBlob(resource, id)
+		switch {
+		case isStorageStatus(err, http.StatusNotFound):
+		case err != nil:
+			return false, err
+		case stored == sum:
+			log.Printf("[storage] %s/%s already exists", resource, id)
+			return true, nil
+		case !cfg.Replace:
+			return false, &DriftError{Resource: resource, ID: id, Stored: stored, Fixture: sum}
+		default:
+			log.Printf("[storage] Replacing %s/%s, stored with sha256 %s instead of %s...", resource, id, stored, sum)
+			if err := deleteStorageResource(resource, id); err != nil {
+				return false, err
+			}
+		}
+
+		if _, err := blob.Seek(0, io.SeekStart); err != nil {
+			return false, fmt.Errorf("[storage] Error reading fixture %s/%s: %s", resource, id, err)
+		}
+		err = post(blob)
+		if err == nil {
+			return true, nil
+		}
+		err = postConflict(resource, id, err)
+		if !isStorageStatus(err, http.StatusConflict) || attempt > 1 {
+			return false, fmt.Errorf("[storage] Error posting %s/%s: %s", resource, id, err)
+		}
+		log.Printf("[storage] %s/%s was posted meanwhile, comparing it again", resource, id)
+	}
+}
@@ -0,0 +1,122 @@
+// Package wait waits for chaincode items to reach a given status. It reacts
+// to chaincode events when the peer provides them, and otherwise polls with
+// an adaptive backoff.
+package wait
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"time"
+)
+
+// Event is a chaincode event. Any event triggers a new check of the waited
+// condition, so its content is only used for logging.
+type Event struct {
+	Name string
+	Key  string
+}
+
+// EventSource is implemented by peers able to push chaincode events
+type EventSource interface {
+	// Subscribe returns a channel receiving the chaincode events, and a
+	// function to call to stop receiving them
+	Subscribe() (events <-chan Event, cancel func(), err error)
+}
+
+// Condition checks the waited item. It returns its current status, and
+// whether the wait is over.
+type Condition func() (status string, done bool, err error)
+
+// TimeoutError is returned when the waited condition was not met in time
+type TimeoutError struct {
+	What       string
+	LastStatus string
+	Waited     time.Duration
+	Err        error
+}
+
+func (e *TimeoutError) Error() string {
+	return fmt.Sprintf("timeout waiting for %s after %s (last status: %q): %s", e.What, e.Waited, e.LastStatus, e.Err)
+}
+
+// Waiter waits for conditions, using Events if set and polling otherwise.
+// Polling starts every MinInterval, and slows down by Factor up to
+// MaxInterval for as long as the status does not change.
+type Waiter struct {
+	Events      EventSource
+	MinInterval time.Duration
+	MaxInterval time.Duration
+	Factor      float64
+}
+
+// NewWaiter returns a Waiter with the default polling intervals. events can
+// be nil.
+func NewWaiter(events EventSource) *Waiter {
+	return &Waiter{
+		Events:      events,
+		MinInterval: 500 * time.Millisecond,
+		MaxInterval: 20 * time.Second,
+		Factor:      2,
+	}
+}
+
+// Until waits for cond to be done. It gives up when ctx is done or after
+// timeout, if not zero, returning a *TimeoutError.
+func (w *Waiter) Until(ctx context.Context, what string, timeout time.Duration, cond Condition) (status string, err error) {
+	if timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, timeout)
+		defer cancel()
+	}
+
+	var events <-chan Event
+	if w.Events != nil {
+		var cancel func()
+		events, cancel, err = w.Events.Subscribe()
+		if err != nil {
+			log.Printf("[wait] Chaincode events unavailable, polling instead: %s", err)
+			events = nil
+		} else {
+			defer cancel()
+		}
+	}
+
+	start := time.Now()
+	interval := w.MinInterval
+	lastStatus := ""
+	for {
+		status, done, err := cond()
+		if err != nil {
+			return status, err
+		}
+		if done {
+			return status, nil
+		}
+		if status != lastStatus {
+			interval = w.MinInterval
+			lastStatus = status
+		}
+
+		log.Printf("[wait] Waiting for %s. Last status: %s. Checking again in %s...", what, lastStatus, interval)
+		timer := time.NewTimer(interval)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return lastStatus, &TimeoutError{
+				What:       what,
+				LastStatus: lastStatus,
+				Waited:     time.Since(start).Round(time.Millisecond),
+				Err:        ctx.Err(),
+			}
+		case event := <-events:
+			timer.Stop()
+			log.Printf("[wait] Event %s on %s, checking %s", event.Name, event.Key, what)
+		case <-timer.C:
+			interval = time.Duration(float64(interval) * w.Factor)
+			if interval > w.MaxInterval {
+				interval = w.MaxInterval
+			}
+		}
+	}
+}